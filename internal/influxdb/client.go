@@ -99,6 +99,27 @@ func (c *Client) Write(msgName string, msgID uint32, data map[string]interface{}
 	return nil
 }
 
+// WriteTagged writes a point to a measurement that is not a mavlink message, such as
+// stats computed by Hub. The tags tell apart the points of the measurement, for
+// example the link a point describes.
+func (c *Client) WriteTagged(measurement string, tags map[string]string, data map[string]interface{}) error {
+	if !c.IsConnected() {
+		return errInluxDBNotConnected
+	}
+	p := influxdb2.NewPointWithMeasurement(measurement).SetTime(time.Now())
+	for tag, value := range tags {
+		p.AddTag(tag, value)
+	}
+	for field, value := range data {
+		p.AddField(field, value)
+	}
+
+	c.writer.WritePoint(p)
+	c.writer.Flush()
+
+	return nil
+}
+
 // QueryMsgID will request all the fields for the Mavlink message with the specified ID.
 // A full list of mavlink message IDs can be found here http://mavlink.io/en/messages/common.html
 //
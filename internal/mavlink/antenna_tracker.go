@@ -15,11 +15,11 @@ import (
 func (c *Client) verifyAntennaTrackerConnection() {
 	_, err := net.Dial("udp", net.JoinHostPort(c.antennaTrackerIP, c.antennaTrackerPort))
 	if err != nil {
-		c.connectedToAntennaTracker = false
+		c.connectedToAntennaTracker.Store(false)
 		Log.Errorf("Error with connecting to antenna tracker. Reason: %s", err.Error())
 		return
 	}
-	c.connectedToAntennaTracker = true
+	c.connectedToAntennaTracker.Store(true)
 }
 
 // forwardToAntennaTracker is an event handler that will take an event frame and forward it to the antenna tracker.
@@ -32,12 +32,12 @@ func (c *Client) forwardToAntennaTracker(evt *gomavlib.EventFrame, _ *gomavlib.N
 	if msg, ok := evt.Frame.GetMessage().(*common.MessageGlobalPositionInt); ok {
 		conn, err := net.Dial("udp", net.JoinHostPort(c.antennaTrackerIP, c.antennaTrackerPort))
 		if err != nil {
-			c.connectedToAntennaTracker = false
+			c.connectedToAntennaTracker.Store(false)
 			Log.Errorf("Error with connecting to antenna tracker. Reason: %s", err.Error())
 			return
 		}
 
-		c.connectedToAntennaTracker = true
+		c.connectedToAntennaTracker.Store(true)
 
 		lat := float64(msg.Lat) / 1e07
 		lon := float64(msg.Lon) / 1e07
@@ -0,0 +1,456 @@
+package mav
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+)
+
+// ErrInvalidBatteryThresholds is returned by SetBatteryThresholds when the thresholds
+// don't make sense.
+var ErrInvalidBatteryThresholds = errors.New("battery thresholds must be from 0 to 5 V and the low cell voltage must be above the critical cell voltage")
+
+// ErrInvalidBatteryConfig is returned by SetBatteryConfigs when a battery's
+// configuration doesn't make sense.
+var ErrInvalidBatteryConfig = errors.New("batteries must have 0 (unknown) to 14 cells and a capacity of 0 (unknown) mAh or more")
+
+// BatteryLevel is how worried to be about a battery.
+type BatteryLevel string
+
+// Levels of a battery. A battery is as bad as the worse of its lowest cell voltage,
+// or its average cell voltage if the cells aren't measured (see BatteryThresholds
+// and BatteryConfig), and the charge state reported by the autopilot.
+const (
+	BatteryOK       BatteryLevel = "ok"
+	BatteryLow      BatteryLevel = "low"
+	BatteryCritical BatteryLevel = "critical"
+	// BatteryUnknown is for batteries without a cell voltage or a charge state
+	BatteryUnknown BatteryLevel = "unknown"
+)
+
+const (
+	// maxCellMillivolts is the highest voltage of a single cell. Autopilots that don't
+	// measure the cells send the voltage of the whole battery in the first cells
+	// instead, which is always above it for batteries of more than one cell.
+	maxCellMillivolts = 5000
+	// maxBatteryCells is how many cells BATTERY_STATUS has room for
+	maxBatteryCells = 14
+
+	// batteryRateWindow is how far back the consumed capacity is looked at to work out
+	// the average current of a battery
+	batteryRateWindow = time.Minute
+	// minBatteryRateSpan is how much of batteryRateWindow must have been seen before
+	// the average current is used instead of the instantaneous current
+	minBatteryRateSpan = 5 * time.Second
+)
+
+// BatteryThresholds are the cell voltages in volts below which a battery is low or
+// critical.
+type BatteryThresholds struct {
+	LowCellVoltage      float64 `json:"low_cell_voltage"`
+	CriticalCellVoltage float64 `json:"critical_cell_voltage"`
+}
+
+// DefaultBatteryThresholds are used until SetBatteryThresholds is called. They suit
+// LiPo cells under load.
+var DefaultBatteryThresholds = BatteryThresholds{LowCellVoltage: 3.6, CriticalCellVoltage: 3.4}
+
+// BatteryConfig is what BATTERY_STATUS doesn't tell about a battery.
+type BatteryConfig struct {
+	// Cells is the number of cells in series, used to work out the cell voltage of
+	// batteries whose cells the autopilot doesn't measure, such as ArduPilot without
+	// a cell monitor. 0 if unknown.
+	Cells int `json:"cells"`
+	// CapacityMah is the capacity of the battery when full, used to work out how long
+	// it lasts if the autopilot doesn't estimate it. 0 if unknown.
+	CapacityMah int `json:"capacity_mah"`
+}
+
+// Battery is the latest BATTERY_STATUS of one of the plane's batteries. Values the
+// autopilot does not know are left out.
+type Battery struct {
+	ID uint8 `json:"id"`
+	// CellVoltages are the voltages of every cell in volts, including the cells in
+	// voltages_ext. Empty if the autopilot only measures the whole battery.
+	CellVoltages      []float64 `json:"cell_voltages"`
+	LowestCellVoltage *float64  `json:"lowest_cell_voltage,omitempty"`
+	// Cells is the number of cells the autopilot measures, or else the number in the
+	// battery's BatteryConfig. 0 if unknown.
+	Cells int `json:"cells"`
+	// AverageCellVoltage is Voltage divided by Cells. The level of the battery is
+	// judged by it if the autopilot doesn't measure the cells.
+	AverageCellVoltage *float64 `json:"average_cell_voltage,omitempty"`
+	// Voltage is the voltage of the whole battery in volts
+	Voltage float64 `json:"voltage"`
+	// Current is in amps
+	Current *float64 `json:"current,omitempty"`
+	// AverageCurrent is in amps, worked out from the capacity consumed over the last
+	// minute. It is the instantaneous current until enough has been consumed.
+	AverageCurrent *float64 `json:"average_current,omitempty"`
+	ConsumedMah    *float64 `json:"consumed_mah,omitempty"`
+	// RemainingPercent is the remaining capacity estimated by the autopilot
+	RemainingPercent *int `json:"remaining_percent,omitempty"`
+	// SecondsRemaining is the autopilot's estimate of how long the battery lasts, or
+	// else how long the capacity in its BatteryConfig that isn't consumed yet lasts at
+	// AverageCurrent
+	SecondsRemaining *float64 `json:"seconds_remaining,omitempty"`
+	// Temperature is in degrees Celsius
+	Temperature *float64 `json:"temperature,omitempty"`
+	// ChargeState is the MAV_BATTERY_CHARGE_STATE of the battery, such as "OK" or "LOW"
+	ChargeState string `json:"charge_state"`
+	// Faults are the names of the MAV_BATTERY_FAULT bits that are set, such as
+	// "DEEP_DISCHARGE"
+	Faults []string     `json:"faults"`
+	Level  BatteryLevel `json:"level"`
+	// Time is when the BATTERY_STATUS arrived
+	Time time.Time `json:"time"`
+}
+
+// batteryState is what is known about a battery. Protected by batteryMutex.
+type batteryState struct {
+	status   *common.MessageBatteryStatus
+	received time.Time
+	// consumption is the capacity consumed over the last batteryRateWindow, oldest first
+	consumption []consumptionSample
+}
+
+// consumptionSample is the capacity of a battery consumed by some time.
+type consumptionSample struct {
+	time time.Time
+	mah  float64
+}
+
+// batteryChargeStateNames maps MAV_BATTERY_CHARGE_STATE values to their names in the
+// MAVLink spec.
+// https://mavlink.io/en/messages/common.html#MAV_BATTERY_CHARGE_STATE
+var batteryChargeStateNames = map[common.MAV_BATTERY_CHARGE_STATE]string{
+	common.MAV_BATTERY_CHARGE_STATE_UNDEFINED: "UNDEFINED",
+	common.MAV_BATTERY_CHARGE_STATE_OK:        "OK",
+	common.MAV_BATTERY_CHARGE_STATE_LOW:       "LOW",
+	common.MAV_BATTERY_CHARGE_STATE_CRITICAL:  "CRITICAL",
+	common.MAV_BATTERY_CHARGE_STATE_EMERGENCY: "EMERGENCY",
+	common.MAV_BATTERY_CHARGE_STATE_FAILED:    "FAILED",
+	common.MAV_BATTERY_CHARGE_STATE_UNHEALTHY: "UNHEALTHY",
+	common.MAV_BATTERY_CHARGE_STATE_CHARGING:  "CHARGING",
+}
+
+// batteryFaultNames are the names of the MAV_BATTERY_FAULT bits in the order they are
+// listed in Battery.Faults.
+// https://mavlink.io/en/messages/common.html#MAV_BATTERY_FAULT
+var batteryFaultNames = []struct {
+	fault common.MAV_BATTERY_FAULT
+	name  string
+}{
+	{common.MAV_BATTERY_FAULT_DEEP_DISCHARGE, "DEEP_DISCHARGE"},
+	{common.MAV_BATTERY_FAULT_SPIKES, "SPIKES"},
+	{common.MAV_BATTERY_FAULT_CELL_FAIL, "CELL_FAIL"},
+	{common.MAV_BATTERY_FAULT_OVER_CURRENT, "OVER_CURRENT"},
+	{common.MAV_BATTERY_FAULT_OVER_TEMPERATURE, "OVER_TEMPERATURE"},
+	{common.MAV_BATTERY_FAULT_UNDER_TEMPERATURE, "UNDER_TEMPERATURE"},
+	{common.MAV_BATTERY_FAULT_INCOMPATIBLE_VOLTAGE, "INCOMPATIBLE_VOLTAGE"},
+	{common.MAV_BATTERY_FAULT_INCOMPATIBLE_FIRMWARE, "INCOMPATIBLE_FIRMWARE"},
+	{common.BATTERY_FAULT_INCOMPATIBLE_CELLS_CONFIGURATION, "INCOMPATIBLE_CELLS_CONFIGURATION"},
+}
+
+// SetBatteryThresholds changes the cell voltages below which batteries are low or
+// critical.
+func (c *Client) SetBatteryThresholds(thresholds BatteryThresholds) error {
+	low, critical := thresholds.LowCellVoltage, thresholds.CriticalCellVoltage
+	if math.IsNaN(low) || math.IsNaN(critical) || critical <= 0 || low <= critical || low > maxCellMillivolts/1000 {
+		return ErrInvalidBatteryThresholds
+	}
+
+	c.batteryMutex.Lock()
+	defer c.batteryMutex.Unlock()
+
+	c.batteryThresholds = thresholds
+	return nil
+}
+
+// GetBatteryThresholds returns the cell voltages below which batteries are low or
+// critical.
+func (c *Client) GetBatteryThresholds() BatteryThresholds {
+	c.batteryMutex.Lock()
+	defer c.batteryMutex.Unlock()
+
+	return c.batteryThresholds
+}
+
+// SetBatteryConfigs replaces the configuration of the plane's batteries, keyed by
+// battery ID. Returns an error without changing anything if a configuration is
+// invalid.
+func (c *Client) SetBatteryConfigs(configs map[uint8]BatteryConfig) error {
+	for _, config := range configs {
+		if config.Cells < 0 || config.Cells > maxBatteryCells || config.CapacityMah < 0 {
+			return ErrInvalidBatteryConfig
+		}
+	}
+
+	c.batteryMutex.Lock()
+	defer c.batteryMutex.Unlock()
+
+	c.batteryConfigs = make(map[uint8]BatteryConfig, len(configs))
+	for id, config := range configs {
+		c.batteryConfigs[id] = config
+	}
+	return nil
+}
+
+// GetBatteryConfigs returns the configuration of the plane's batteries, keyed by
+// battery ID.
+func (c *Client) GetBatteryConfigs() map[uint8]BatteryConfig {
+	c.batteryMutex.Lock()
+	defer c.batteryMutex.Unlock()
+
+	configs := make(map[uint8]BatteryConfig, len(c.batteryConfigs))
+	for id, config := range c.batteryConfigs {
+		configs[id] = config
+	}
+	return configs
+}
+
+// ParseBatteryValues parses comma separated "id:value" pairs of battery IDs and
+// whole numbers, such as the cell count of every battery.
+// Example: "0:6,1:12"
+func ParseBatteryValues(list string) (map[uint8]int, error) {
+	values := make(map[uint8]int)
+	for _, pair := range SplitList(list) {
+		idStr, valueStr, _ := strings.Cut(pair, ":")
+		id, err := strconv.ParseUint(idStr, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid battery value %q. Expected id:value with an ID from 0 to 255", pair)
+		}
+		value, err := strconv.Atoi(valueStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid battery value %q. Expected id:value with a whole number", pair)
+		}
+		values[uint8(id)] = value
+	}
+	return values, nil
+}
+
+// GetBatteries returns the latest state of every battery of the plane, sorted by ID.
+func (c *Client) GetBatteries() []Battery {
+	c.batteryMutex.Lock()
+	defer c.batteryMutex.Unlock()
+
+	batteries := make([]Battery, 0, len(c.batteries))
+	for id, state := range c.batteries {
+		batteries = append(batteries, state.battery(id, c.batteryThresholds, c.batteryConfigs[id]))
+	}
+	sort.Slice(batteries, func(i, j int) bool {
+		return batteries[i].ID < batteries[j].ID
+	})
+	return batteries
+}
+
+// GetBatteryVoltages returns the latest voltage of the first cell of every battery in
+// millivolts, keyed by battery ID.
+func (c *Client) GetBatteryVoltages() map[uint8]int {
+	c.batteryMutex.Lock()
+	defer c.batteryMutex.Unlock()
+
+	voltages := make(map[uint8]int, len(c.batteries))
+	for id, state := range c.batteries {
+		voltages[id] = int(state.status.Voltages[0])
+	}
+	return voltages
+}
+
+// updateBattery stores a BATTERY_STATUS from the plane and keeps track of the
+// capacity consumed to work out the average current.
+func (c *Client) updateBattery(msg *common.MessageBatteryStatus, received time.Time) {
+	c.batteryMutex.Lock()
+	defer c.batteryMutex.Unlock()
+
+	state, ok := c.batteries[msg.Id]
+	if !ok {
+		state = &batteryState{}
+		c.batteries[msg.Id] = state
+	}
+	state.status = msg
+	state.received = received
+
+	if msg.CurrentConsumed < 0 {
+		state.consumption = nil
+		return
+	}
+	sample := consumptionSample{time: received, mah: float64(msg.CurrentConsumed)}
+	if n := len(state.consumption); n > 0 && sample.mah < state.consumption[n-1].mah {
+		// the battery was swapped or its consumption was reset
+		state.consumption = nil
+	}
+	state.consumption = append(state.consumption, sample)
+	for len(state.consumption) > 1 && received.Sub(state.consumption[0].time) > batteryRateWindow {
+		state.consumption = state.consumption[1:]
+	}
+}
+
+// battery returns the state of a battery as a Battery.
+func (s *batteryState) battery(id uint8, thresholds BatteryThresholds, config BatteryConfig) Battery {
+	msg := s.status
+	battery := Battery{
+		ID:          id,
+		ChargeState: batteryChargeStateName(msg.ChargeState),
+		Faults:      decodeBatteryFaults(msg.FaultBitmask),
+		Time:        s.received,
+	}
+
+	millivolts := cellMillivolts(msg)
+	cellsMeasured := len(millivolts) > 0
+	battery.CellVoltages = []float64{}
+	for _, mv := range millivolts {
+		battery.Voltage += float64(mv) / 1000
+		cellsMeasured = cellsMeasured && mv <= maxCellMillivolts
+	}
+	if cellsMeasured {
+		lowest := math.Inf(1)
+		for _, mv := range millivolts {
+			battery.CellVoltages = append(battery.CellVoltages, float64(mv)/1000)
+			lowest = math.Min(lowest, float64(mv)/1000)
+		}
+		battery.LowestCellVoltage = &lowest
+		battery.Cells = len(millivolts)
+	} else {
+		battery.Cells = config.Cells
+	}
+	if battery.Cells > 0 {
+		average := battery.Voltage / float64(battery.Cells)
+		battery.AverageCellVoltage = &average
+	}
+
+	if msg.CurrentBattery >= 0 {
+		current := float64(msg.CurrentBattery) / 100
+		battery.Current = &current
+	}
+	if msg.CurrentConsumed >= 0 {
+		consumed := float64(msg.CurrentConsumed)
+		battery.ConsumedMah = &consumed
+	}
+	if msg.BatteryRemaining >= 0 {
+		remaining := int(msg.BatteryRemaining)
+		battery.RemainingPercent = &remaining
+	}
+	if msg.Temperature != math.MaxInt16 {
+		temperature := float64(msg.Temperature) / 100
+		battery.Temperature = &temperature
+	}
+
+	battery.AverageCurrent = s.averageCurrent()
+	if msg.TimeRemaining > 0 {
+		seconds := float64(msg.TimeRemaining)
+		battery.SecondsRemaining = &seconds
+	} else {
+		battery.SecondsRemaining = secondsRemaining(config.CapacityMah, battery.ConsumedMah, battery.AverageCurrent)
+	}
+
+	cellVoltage := battery.LowestCellVoltage
+	if cellVoltage == nil {
+		cellVoltage = battery.AverageCellVoltage
+	}
+	battery.Level = batteryLevel(cellVoltage, msg.ChargeState, thresholds)
+	return battery
+}
+
+// averageCurrent returns the average current in amps over the consumption that was
+// kept, or the instantaneous current if not enough of it was kept. Returns nil if
+// neither is known.
+func (s *batteryState) averageCurrent() *float64 {
+	if n := len(s.consumption); n > 1 {
+		first, last := s.consumption[0], s.consumption[n-1]
+		if span := last.time.Sub(first.time); span >= minBatteryRateSpan {
+			current := (last.mah - first.mah) / span.Hours() / 1000
+			return &current
+		}
+	}
+	if s.status.CurrentBattery >= 0 {
+		current := float64(s.status.CurrentBattery) / 100
+		return &current
+	}
+	return nil
+}
+
+// secondsRemaining returns how long the capacity of a battery that isn't consumed yet
+// lasts at a current in amps. Returns nil if any of them is unknown or nothing is
+// being consumed.
+func secondsRemaining(capacityMah int, consumedMah *float64, current *float64) *float64 {
+	if capacityMah <= 0 || consumedMah == nil || current == nil || *current <= 0 {
+		return nil
+	}
+	remainingMah := math.Max(float64(capacityMah)-*consumedMah, 0)
+	seconds := remainingMah / (*current * 1000) * 3600
+	return &seconds
+}
+
+// cellMillivolts returns the voltages of the cells of a BATTERY_STATUS in
+// millivolts. Unused cells are UINT16_MAX in voltages and 0 in voltages_ext.
+func cellMillivolts(msg *common.MessageBatteryStatus) []uint16 {
+	cells := []uint16{}
+	for _, mv := range msg.Voltages {
+		if mv == math.MaxUint16 {
+			return cells
+		}
+		cells = append(cells, mv)
+	}
+	for _, mv := range msg.VoltagesExt {
+		if mv == 0 {
+			break
+		}
+		cells = append(cells, mv)
+	}
+	return cells
+}
+
+// batteryLevel returns the level of a battery from its lowest or average cell
+// voltage, which may be unknown, and the charge state reported by the autopilot.
+func batteryLevel(cellVoltage *float64, chargeState common.MAV_BATTERY_CHARGE_STATE, thresholds BatteryThresholds) BatteryLevel {
+	level := BatteryUnknown
+	if cellVoltage != nil {
+		switch {
+		case *cellVoltage < thresholds.CriticalCellVoltage:
+			return BatteryCritical
+		case *cellVoltage < thresholds.LowCellVoltage:
+			level = BatteryLow
+		default:
+			level = BatteryOK
+		}
+	}
+
+	switch chargeState {
+	case common.MAV_BATTERY_CHARGE_STATE_OK, common.MAV_BATTERY_CHARGE_STATE_CHARGING:
+		if level == BatteryUnknown {
+			level = BatteryOK
+		}
+	case common.MAV_BATTERY_CHARGE_STATE_LOW:
+		level = BatteryLow
+	case common.MAV_BATTERY_CHARGE_STATE_CRITICAL, common.MAV_BATTERY_CHARGE_STATE_EMERGENCY,
+		common.MAV_BATTERY_CHARGE_STATE_FAILED, common.MAV_BATTERY_CHARGE_STATE_UNHEALTHY:
+		level = BatteryCritical
+	}
+	return level
+}
+
+// batteryChargeStateName returns the MAVLink name of a MAV_BATTERY_CHARGE_STATE.
+func batteryChargeStateName(state common.MAV_BATTERY_CHARGE_STATE) string {
+	if name, ok := batteryChargeStateNames[state]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// decodeBatteryFaults returns the names of the MAV_BATTERY_FAULT bits that are set.
+func decodeBatteryFaults(bitmask common.MAV_BATTERY_FAULT) []string {
+	faults := []string{}
+	for _, f := range batteryFaultNames {
+		if bitmask&f.fault != 0 {
+			faults = append(faults, f.name)
+		}
+	}
+	return faults
+}
@@ -0,0 +1,140 @@
+package mav
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tritonuas/gcs/internal/mavlink/mavtest"
+)
+
+// batteryStatus returns a BATTERY_STATUS of a battery with 12 cells at 3.8 V.
+func batteryStatus(consumed int32, remaining int8) *common.MessageBatteryStatus {
+	msg := &common.MessageBatteryStatus{
+		Id:               1,
+		Temperature:      math.MaxInt16,
+		CurrentBattery:   2000,
+		CurrentConsumed:  consumed,
+		BatteryRemaining: remaining,
+		VoltagesExt:      [4]uint16{3800, 3800},
+		FaultBitmask:     common.MAV_BATTERY_FAULT_SPIKES | common.MAV_BATTERY_FAULT_OVER_CURRENT,
+	}
+	for i := range msg.Voltages {
+		msg.Voltages[i] = 3800
+	}
+	return msg
+}
+
+func TestBattery(t *testing.T) {
+	c := New(nil, "127.0.0.1", "1", "udp:127.0.0.1:1")
+	start := time.Now()
+
+	c.updateBattery(batteryStatus(1000, 90), start)
+	batteries := c.GetBatteries()
+	require.Len(t, batteries, 1)
+	battery := batteries[0]
+	assert.Equal(t, uint8(1), battery.ID)
+	assert.Len(t, battery.CellVoltages, 12)
+	assert.InDelta(t, 45.6, battery.Voltage, 0.001)
+	assert.Equal(t, 3.8, *battery.LowestCellVoltage)
+	assert.Equal(t, []string{"SPIKES", "OVER_CURRENT"}, battery.Faults)
+	assert.Nil(t, battery.Temperature)
+	assert.Equal(t, BatteryOK, battery.Level)
+	assert.Equal(t, 20.0, *battery.AverageCurrent)
+	// how long the battery lasts is unknown without its capacity
+	assert.Nil(t, battery.SecondsRemaining)
+
+	// 9000 of 10000 mAh are left, which last 27 minutes at 20 A
+	require.NoError(t, c.SetBatteryConfigs(map[uint8]BatteryConfig{1: {CapacityMah: 10000}}))
+	assert.InDelta(t, 27*60, *c.GetBatteries()[0].SecondsRemaining, 1)
+
+	// the average current takes over from the instantaneous current
+	c.updateBattery(batteryStatus(1100, 89), start.Add(10*time.Second))
+	battery = c.GetBatteries()[0]
+	assert.InDelta(t, 36.0, *battery.AverageCurrent, 0.001)
+	assert.Equal(t, map[uint8]int{1: 3800}, c.GetBatteryVoltages())
+
+	require.NoError(t, c.SetBatteryThresholds(BatteryThresholds{LowCellVoltage: 3.9, CriticalCellVoltage: 3.5}))
+	assert.Equal(t, BatteryLow, c.GetBatteries()[0].Level)
+	assert.ErrorIs(t, c.SetBatteryThresholds(BatteryThresholds{LowCellVoltage: 3.5, CriticalCellVoltage: 3.5}), ErrInvalidBatteryThresholds)
+	assert.ErrorIs(t, c.SetBatteryThresholds(BatteryThresholds{LowCellVoltage: math.NaN(), CriticalCellVoltage: 3.5}), ErrInvalidBatteryThresholds)
+	assert.ErrorIs(t, c.SetBatteryThresholds(BatteryThresholds{LowCellVoltage: math.Inf(1), CriticalCellVoltage: 3.5}), ErrInvalidBatteryThresholds)
+	assert.ErrorIs(t, c.SetBatteryThresholds(BatteryThresholds{LowCellVoltage: 6, CriticalCellVoltage: 3.5}), ErrInvalidBatteryThresholds)
+	assert.Equal(t, 3.9, c.GetBatteryThresholds().LowCellVoltage)
+
+	// an autopilot that doesn't measure the cells sends the voltage of the whole battery
+	msg := batteryStatus(-1, -1)
+	msg.Voltages = [10]uint16{math.MaxUint16 - 1, 2000, math.MaxUint16, math.MaxUint16, math.MaxUint16, math.MaxUint16, math.MaxUint16, math.MaxUint16, math.MaxUint16, math.MaxUint16}
+	msg.VoltagesExt = [4]uint16{}
+	msg.ChargeState = common.MAV_BATTERY_CHARGE_STATE_CRITICAL
+	c.updateBattery(msg, start.Add(20*time.Second))
+	battery = c.GetBatteries()[0]
+	assert.Empty(t, battery.CellVoltages)
+	assert.Nil(t, battery.LowestCellVoltage)
+	assert.InDelta(t, 67.534, battery.Voltage, 0.001)
+	assert.Nil(t, battery.SecondsRemaining)
+	assert.Equal(t, "CRITICAL", battery.ChargeState)
+	assert.Equal(t, BatteryCritical, battery.Level)
+
+	// with a cell count, the average cell voltage is judged by the thresholds
+	msg.Voltages[0], msg.Voltages[1] = 50000, math.MaxUint16
+	msg.ChargeState = common.MAV_BATTERY_CHARGE_STATE_UNDEFINED
+	c.updateBattery(msg, start.Add(30*time.Second))
+	battery = c.GetBatteries()[0]
+	assert.Nil(t, battery.AverageCellVoltage)
+	assert.Equal(t, BatteryUnknown, battery.Level)
+	assert.ErrorIs(t, c.SetBatteryConfigs(map[uint8]BatteryConfig{1: {Cells: 15}}), ErrInvalidBatteryConfig)
+	assert.ErrorIs(t, c.SetBatteryConfigs(map[uint8]BatteryConfig{1: {CapacityMah: -1}}), ErrInvalidBatteryConfig)
+	require.NoError(t, c.SetBatteryConfigs(map[uint8]BatteryConfig{1: {Cells: 14}}))
+	battery = c.GetBatteries()[0]
+	assert.Equal(t, 14, battery.Cells)
+	assert.InDelta(t, 3.571, *battery.AverageCellVoltage, 0.001)
+	assert.Equal(t, BatteryLow, battery.Level)
+	assert.Equal(t, map[uint8]BatteryConfig{1: {Cells: 14}}, c.GetBatteryConfigs())
+}
+
+func TestParseBatteryValues(t *testing.T) {
+	values, err := ParseBatteryValues("0:6, 1:12,")
+	require.NoError(t, err)
+	assert.Equal(t, map[uint8]int{0: 6, 1: 12}, values)
+
+	_, err = ParseBatteryValues("256:6")
+	assert.Error(t, err)
+	_, err = ParseBatteryValues("0:6.5")
+	assert.Error(t, err)
+}
+
+func TestBatteryFromAutopilot(t *testing.T) {
+	port := freeUDPPort(t)
+	// a battery that lasts 18 seconds
+	ap, err := mavtest.NewAutopilot(mavtest.AutopilotConf{
+		Address: fmt.Sprintf("127.0.0.1:%d", port),
+		Battery: &mavtest.Battery{Cells: 12, FullCellVoltage: 4.2, EmptyCellVoltage: 3.5, Current: 20, Capacity: 100},
+	})
+	require.NoError(t, err)
+	t.Cleanup(ap.Close)
+	c := newTestClient(t, port)
+	require.NoError(t, c.SetBatteryConfigs(map[uint8]BatteryConfig{0: {CapacityMah: 100}}))
+
+	var battery Battery
+	require.Eventually(t, func() bool {
+		batteries := c.GetBatteries()
+		if len(batteries) == 0 {
+			return false
+		}
+		battery = batteries[0]
+		return battery.RemainingPercent != nil && *battery.RemainingPercent < 95
+	}, 5*time.Second, 20*time.Millisecond)
+
+	assert.Len(t, battery.CellVoltages, 12)
+	assert.Equal(t, 25.0, *battery.Temperature)
+	assert.Equal(t, 20.0, *battery.Current)
+	require.NotNil(t, battery.SecondsRemaining)
+	actual := (100 - *battery.ConsumedMah) / 20000 * 3600
+	assert.InDelta(t, actual, *battery.SecondsRemaining, 3)
+}
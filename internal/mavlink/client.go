@@ -2,6 +2,8 @@ package mav
 
 import (
 	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gomavlib"
@@ -28,6 +30,11 @@ const systemID byte = 125
 // Some common component types: https://mavlink.io/en/messages/common.html#MAV_COMPONENT
 const componentID byte = 1
 
+// heartbeatPeriod is how often Hub's mavlink node sends a HEARTBEAT to every channel.
+// The MAVLink spec recommends 1Hz, and UDP server endpoints (like a SITL instance) will
+// not learn about Hub until they receive the first one.
+const heartbeatPeriod = 1 * time.Second
+
 // Client holds data relating to communicating to the plane and other mavlink devices (MissionPlanner/QGC).
 //
 // It has three main functionalities:
@@ -38,18 +45,120 @@ const componentID byte = 1
 type Client struct {
 	influxdbClient *influxdb.Client
 
-	connectedToPlane          bool
-	connectedToAntennaTracker bool
+	// influxMutex protects which messages are stored in InfluxDB
+	influxMutex    sync.RWMutex
+	influxMessages InfluxDBMessages
+	influxInclude  map[uint32]bool
+	influxExclude  map[uint32]bool
+
+	// connectedToAntennaTracker is written by the antenna tracker handler and read by
+	// anything checking the connection
+	connectedToAntennaTracker atomic.Bool
 
+	// endpointsMutex protects the endpoints Listen connects to, which are replaced by
+	// UpdateEndpoints
+	endpointsMutex   sync.RWMutex
 	endpointConnInfo EndpointData
 
-	// mavlinkNode        *gomavlib.Node
-	eventFrameHandlers []EventFrameHandler
+	// planeMutex protects the node and the plane's channel/IDs, which are written by
+	// the Listen goroutine and read by anything that sends messages to the plane.
+	// Messages to the plane are written by Listen, which takes them from outgoing
+	// until listenDone is closed (see SendToPlane).
+	planeMutex           sync.RWMutex
+	mavlinkNode          *gomavlib.Node
+	listenDone           chan struct{}
+	outgoing             chan outgoingMessage
+	planeEndpointConf    gomavlib.EndpointConf
+	planeEndpointChannel *gomavlib.Channel // channel opened by the plane's endpoint, if any
+	planeChannel         *gomavlib.Channel // channel the plane's heartbeat was heard on
+	planeSystemID        byte
+	planeComponentID     byte
+
+	// handlersMutex protects the eventFrameHandlers slice, which is replaced (never
+	// modified in place) whenever handlers are registered or reordered
+	handlersMutex      sync.RWMutex
+	eventFrameHandlers []*registeredHandler
+	handlersDone       chan struct{} // closed by Close, which stops queued handlers and background goroutines
+	closeOnce          sync.Once
+
+	// routerMutex protects the options of every endpoint, the channels they opened and
+	// the routes learned through them, which are only changed by the Listen loop
+	routerMutex         sync.RWMutex
+	endpointConfigs     []*endpointConfig
+	routerChannels      map[*gomavlib.Channel]*routerChannel
+	routes              map[routeKey]*Route
+	hasFilteredChannels bool
+
+	// linkStatsMutex protects the traffic counted on every open channel
+	linkStatsMutex sync.Mutex
+	linkStats      map[*gomavlib.Channel]*linkStats
+
+	// linkMutex protects the time of the last HEARTBEAT from every system
+	linkMutex    sync.Mutex
+	linkTimeouts LinkTimeouts
+	heartbeats   map[uint8]*systemLink
+
+	// tlogMutex protects the tlog recording in progress, if any
+	tlogMutex    sync.Mutex
+	tlogDir      string
+	tlogMaxSize  int64
+	tlogMaxTotal int64
+	tlog         *tlogRecording
+
+	missionMutex    sync.Mutex
+	missionUpload   *missionUpload
+	missionDownload *missionDownload
+	planeMission    *PlaneMission
+
+	progressMutex   sync.Mutex
+	missionProgress MissionProgress
+
+	stateMutex sync.Mutex
+	planeState *PlaneState // nil until the plane's first HEARTBEAT
+
+	// commandMutex protects pendingCommands, which holds a channel for every command
+	// that is waiting for its COMMAND_ACK
+	commandMutex    sync.Mutex
+	pendingCommands map[common.MAV_CMD]chan *common.MessageCommandAck
+
+	// paramMutex protects the parameter cache, the download in progress and
+	// pendingParams, which holds a channel for every parameter read or set that is
+	// waiting for its PARAM_VALUE
+	paramMutex        sync.Mutex
+	params            map[string]Param
+	paramCount        int             // -1 until the plane reports its parameter count
+	paramIndices      map[uint16]bool // indices received in the current or last download
+	paramsUpdated     time.Time
+	paramFetch        *paramFetch
+	paramFetchRetries int
+	pendingParams     map[string]chan Param
+
+	// ratesMutex protects the message rates requested from the plane and the messages
+	// that should go back to their default rate. ratesApplyMutex is held while the
+	// rates are being requested.
+	ratesMutex      sync.Mutex
+	messageRates    map[uint32]*messageRate
+	ratesToReset    map[uint32]bool
+	ratesApplyMutex sync.Mutex
+	ratesRequested  chan struct{}
+
+	// latestMutex protects the last message of every kind received from the plane
+	latestMutex    sync.RWMutex
+	latestMessages map[uint32]latestMessage
+
+	// streamsMutex protects the set of open telemetry streams
+	streamsMutex     sync.RWMutex
+	telemetryStreams map[*TelemetryStream]bool
 
 	antennaTrackerIP   string
 	antennaTrackerPort string
 
-	LatestBatteryInfo map[uint8]int
+	// batteryMutex protects the state and configuration of every battery and the
+	// battery thresholds
+	batteryMutex      sync.Mutex
+	batteries         map[uint8]*batteryState
+	batteryConfigs    map[uint8]BatteryConfig
+	batteryThresholds BatteryThresholds
 
 	endpointChangeChannel chan bool // Note: whether it is true/false does not make a difference. Any val signifies change.
 }
@@ -59,12 +168,25 @@ func (c *Client) Kill() {
 	c.endpointChangeChannel <- false
 }
 
+// Close stops the queued EventFrameHandlers along with the goroutines that keep the
+// link stats, link states and message rates up to date. These keep running when
+// Listen stops so that Listen can be called again, so only Close a client that won't
+// listen anymore.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		if c.handlersDone != nil {
+			close(c.handlersDone)
+		}
+	})
+}
+
 // New creates a new mavlink client that can communicate with the plane and other mavlink devices (MissionPlanner/QGC)
 //
 // Parameters:
 //   - influxdbClient: Client to communicate with Influx database that stores plane telemtry
 //   - planeConnInfo: Description of plane connection information. Format for TCP or UDP connections: "connType:address:port".
-//     Format for serial connections: "connType:address". Examples: "udp:localhost:14551", "tcp:192.168.1.7:14550", "serial:/dev/ttyUSB0"
+//     Format for serial connections: "connType:address". Examples: "udp:localhost:14551", "tcp:192.168.1.7:14550", "serial:/dev/ttyUSB0".
+//     Options such as the baud rate can follow a "?" (see ParseEndpoint). Example: "serial:/dev/ttyUSB0?baud=115200"
 //   - routerDevicesConnInfo: variadic parameter that holds any number of strings with information to connect to Mavlink devices.
 //     The router will be responsible for forwarding Mavlink EventFrames to them. The format of the strings matches that of the
 //     planeConnInfo parameter.
@@ -81,27 +203,84 @@ func New(influxdbClient *influxdb.Client, antennaTrackerIP string, antennaTracke
 
 	c.influxdbClient = influxdbClient
 
-	c.LatestBatteryInfo = make(map[uint8]int)
-
-	// TODO: setup a method and route to modify the handlers
-	c.eventFrameHandlers = []EventFrameHandler{
-		(*Client).forwardEventFrame,
-		(*Client).writeMsgToInfluxDB,
-		(*Client).handleMissionUpload,
-		(*Client).handleMissionDownload,
-		(*Client).monitorMission,
-		(*Client).forwardToAntennaTracker,
-		(*Client).handleBatteryUpdate,
+	c.batteries = make(map[uint8]*batteryState)
+	c.batteryConfigs = make(map[uint8]BatteryConfig)
+	c.batteryThresholds = DefaultBatteryThresholds
+
+	c.missionProgress = MissionProgress{CurrentSeq: -1}
+	c.pendingCommands = make(map[common.MAV_CMD]chan *common.MessageCommandAck)
+	c.params = make(map[string]Param)
+	c.paramCount = -1
+	c.paramIndices = make(map[uint16]bool)
+	c.pendingParams = make(map[string]chan Param)
+
+	// routing, finding the plane and the protocols that talk to the plane happen on
+	// the Listen loop so they never fall behind or lose a frame. Everything else gets
+	// its own queue so that slow InfluxDB writes or antenna tracker connections can't
+	// hold up routing to QGC.
+	c.handlersDone = make(chan struct{})
+	inlineHandlers := []struct {
+		name    string
+		handler EventFrameHandler
+	}{
+		{HandlerForward, (*Client).forwardEventFrame},
+		{HandlerPlaneChannel, (*Client).trackPlaneChannel},
+		// frames dropped by a full queue would show up as packets lost on the link
+		{HandlerLinkStats, (*Client).countLinkTraffic},
+		{HandlerMissionUpload, (*Client).handleMissionUpload},
+		{HandlerMissionDownload, (*Client).handleMissionDownload},
+		{HandlerCommandAck, (*Client).handleCommandAck},
+		{HandlerParams, (*Client).handleParamValue},
 	}
+	for _, h := range inlineHandlers {
+		c.RegisterHandler(h.name, h.handler) //nolint: errcheck
+	}
+	queuedHandlers := []struct {
+		name    string
+		handler EventFrameHandler
+	}{
+		{HandlerPlaneState, (*Client).trackPlaneState},
+		{HandlerInfluxDB, (*Client).writeMsgToInfluxDB},
+		{HandlerMissionProgress, (*Client).monitorMission},
+		{HandlerAntennaTracker, (*Client).forwardToAntennaTracker},
+		{HandlerBattery, (*Client).handleBatteryUpdate},
+		{HandlerLinkMonitor, (*Client).trackHeartbeats},
+		{HandlerTelemetryStream, (*Client).streamTelemetry},
+		{HandlerLatestTelemetry, (*Client).storeLatestTelemetry},
+	}
+	for _, h := range queuedHandlers {
+		c.RegisterQueuedHandler(h.name, h.handler, defaultHandlerQueueSize) //nolint: errcheck
+	}
+	c.RegisterQueuedHandler(HandlerTlog, (*Client).recordTlog, tlogQueueSize) //nolint: errcheck
+
+	c.linkStats = make(map[*gomavlib.Channel]*linkStats)
+	go c.monitorLinkStats()
+	c.linkTimeouts = DefaultLinkTimeouts
+	c.heartbeats = make(map[uint8]*systemLink)
+	go c.monitorLinks()
+	c.tlogDir = DefaultTlogDir
+	c.tlogMaxSize = DefaultTlogMaxSize
+	c.tlogMaxTotal = DefaultTlogMaxTotalSize
+	c.messageRates = make(map[uint32]*messageRate)
+	defaultRates, _ := parseMessageRates(DefaultMessageRates) //nolint: errcheck
+	for id, hz := range defaultRates {
+		c.messageRates[id] = &messageRate{hz: hz}
+	}
+	c.ratesToReset = make(map[uint32]bool)
+	c.ratesRequested = make(chan struct{}, 1)
+	go c.maintainMessageRates()
+	c.telemetryStreams = make(map[*TelemetryStream]bool)
+	c.latestMessages = make(map[uint32]latestMessage)
 
 	c.antennaTrackerIP = antennaTrackerIP
 	c.antennaTrackerPort = antennaTrackerPort
 
 	c.endpointChangeChannel = make(chan bool, 1)
+	c.outgoing = make(chan outgoingMessage)
 
-	// verify the plane and antenna tracker connection in the background to prevent the current goroutine from
-	// blocking if the plane/antenna tracker isn't connected
-	go c.verifyPlaneConnection()
+	// verify the antenna tracker connection in the background to prevent the current goroutine from
+	// blocking if the antenna tracker isn't connected. The plane's connection is judged
+	// by its heartbeats instead (see link_monitor.go).
 	go c.verifyAntennaTrackerConnection()
 
 	Log.Error(actualRouterDevices)
@@ -109,16 +288,10 @@ func New(influxdbClient *influxdb.Client, antennaTrackerIP string, antennaTracke
 	return c
 }
 
-// IsConnectedToPlane reports whether the client is currently connected to the
-// plane Mavlink endpoint.
-func (c *Client) IsConnectedToPlane() bool {
-	return c.connectedToPlane
-}
-
 // IsConnectedToAntennaTracker reports whether the client is currently
 // connected to the antenna tracker.
 func (c *Client) IsConnectedToAntennaTracker() bool {
-	return c.connectedToAntennaTracker
+	return c.connectedToAntennaTracker.Load()
 }
 
 // Listen will listen for incoming mavlink events.
@@ -127,47 +300,64 @@ func (c *Client) IsConnectedToAntennaTracker() bool {
 func (c *Client) Listen() {
 	loop := func(n *gomavlib.Node, _ chan bool) bool {
 		Log.Info("Starting up new mavlink Listen loop")
-		for e := range n.Events() {
+		for {
+			var e gomavlib.Event
 			select {
 			case b := <-c.endpointChangeChannel:
 				return b
-			default:
-				// Do nothing if the channel is empty
+			case out := <-c.outgoing:
+				c.writeOutgoing(n, out)
+				continue
+			case evt, ok := <-n.Events():
+				if !ok {
+					return false
+				}
+				e = evt
 			}
 			switch evt := e.(type) {
 			case *gomavlib.EventChannelOpen:
 				Log.Infof("Mavlink channel opened at %s", evt.Channel.Endpoint().Conf())
+				c.openRouterChannel(evt.Channel)
+				c.openLinkStats(evt.Channel)
+				c.trackOpenedChannel(evt.Channel)
 			case *gomavlib.EventChannelClose:
 				Log.Infof("Mavlink channel closed at %s", evt.Channel.Endpoint().Conf())
+				c.closeRouterChannel(evt.Channel)
+				c.closeLinkStats(evt.Channel)
+				c.forgetPlaneChannel(evt.Channel)
+			case *gomavlib.EventParseError:
+				c.recordParseError(evt.Channel, evt.Error)
 			case *gomavlib.EventFrame:
-				for _, handler := range c.eventFrameHandlers {
-					handler(c, evt, n)
-				}
+				c.runEventFrameHandlers(evt, n)
 			}
 		}
-		return false
 	}
 
 	for {
 		// TODO: handle errors properly in this loop
-		planeEndpoint, _ := NewEndpoint(c.endpointConnInfo.Plane) //nolint: errcheck
+		endpointConnInfo := c.getEndpointConnInfo()
+		planeEndpoint, planeOptions, _ := ParseEndpoint(endpointConnInfo.Plane) //nolint: errcheck
+		endpointConfigs := []*endpointConfig{{conf: planeEndpoint, options: planeOptions, plane: true}}
 
 		routerEndpoints := make([]gomavlib.EndpointConf, 0)
-		for _, endptStr := range c.endpointConnInfo.Router {
-			endpt, err := NewEndpoint(endptStr)
+		for _, endptStr := range endpointConnInfo.Router {
+			endpt, options, err := ParseEndpoint(endptStr)
 			if err != nil {
 				continue
 			}
 			routerEndpoints = append(routerEndpoints, endpt)
+			endpointConfigs = append(endpointConfigs, &endpointConfig{conf: endpt, options: options})
 		}
+		c.setEndpointConfigs(endpointConfigs)
+		c.resetLinkStats()
 
 		node, err := gomavlib.NewNode(gomavlib.NodeConf{
-			Endpoints:           append(routerEndpoints, planeEndpoint),
-			Dialect:             common.Dialect,
-			OutVersion:          gomavlib.V2,
-			OutSystemID:         systemID,
-			OutComponentID:      componentID,
-			StreamRequestEnable: true,
+			Endpoints:       append(routerEndpoints, planeEndpoint),
+			Dialect:         common.Dialect,
+			OutVersion:      gomavlib.V2,
+			OutSystemID:     systemID,
+			OutComponentID:  componentID,
+			HeartbeatPeriod: heartbeatPeriod,
 		})
 
 		if err != nil {
@@ -177,7 +367,14 @@ func (c *Client) Listen() {
 			continue
 		}
 
-		if !loop(node, c.endpointChangeChannel) {
+		c.setMavlinkNode(node, planeEndpoint)
+		keepListening := loop(node, c.endpointChangeChannel)
+		c.setMavlinkNode(nil, nil)
+		node.Close()
+
+		if !keepListening {
+			c.stopTlogIfRecording()
+			c.closeTelemetryStreams()
 			return
 		}
 	}
@@ -185,7 +382,17 @@ func (c *Client) Listen() {
 
 // UpdateEndpoints updates mavilnk endpoints
 func (c *Client) UpdateEndpoints(planeEndpoint string, routerEndpoints []string) {
-	c.endpointConnInfo.Plane = planeEndpoint
-	c.endpointConnInfo.Router = routerEndpoints
+	c.endpointsMutex.Lock()
+	c.endpointConnInfo = EndpointData{Plane: planeEndpoint, Router: append([]string{}, routerEndpoints...)}
+	c.endpointsMutex.Unlock()
+
 	c.endpointChangeChannel <- true
 }
+
+// getEndpointConnInfo returns a copy of the endpoints Listen connects to.
+func (c *Client) getEndpointConnInfo() EndpointData {
+	c.endpointsMutex.RLock()
+	defer c.endpointsMutex.RUnlock()
+
+	return EndpointData{Plane: c.endpointConnInfo.Plane, Router: append([]string{}, c.endpointConnInfo.Router...)}
+}
@@ -0,0 +1,63 @@
+package mav
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestConcurrentClientAccess reads the client's state from many goroutines while the
+// fake autopilot streams frames and the endpoints are replaced. Run with -race.
+func TestConcurrentClientAccess(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	c := newTestClient(t, port)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				c.GetBatteryVoltages()
+				c.IsConnectedToAntennaTracker()
+				c.GetPlaneEndpoint() //nolint: errcheck
+				c.GetRouterEndpoints()
+				c.GetLatestTelemetry("GLOBAL_POSITION_INT") //nolint: errcheck
+				c.GetPlaneState()
+				c.GetSystemLinks()
+				c.GetLinkStats()
+				c.GetRoutes()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		c.UpdateEndpoints(ap.Endpoint(), []string{"udp:127.0.0.1:1"})
+		time.Sleep(100 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	assert.Equal(t, ap.Endpoint(), c.getEndpointConnInfo().Plane)
+	assert.Equal(t, []string{"udp:127.0.0.1:1"}, c.GetRouterEndpoints())
+	require.Eventually(t, func() bool {
+		voltages := c.GetBatteryVoltages()
+		return voltages[0] > 3500 && c.IsConnectedToAntennaTracker()
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// the returned map is a copy
+	voltages := c.GetBatteryVoltages()
+	voltages[0] = 0
+	assert.NotEqual(t, 0, c.GetBatteryVoltages()[0])
+}
@@ -0,0 +1,248 @@
+package mav
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/msg"
+)
+
+// ErrCommandInProgress is returned when a command is sent while the same command is
+// still waiting for a COMMAND_ACK. COMMAND_ACK only carries the command ID, so two of
+// the same command in flight could not be told apart.
+var ErrCommandInProgress = errors.New("the same command is already waiting for a response from the plane")
+
+// ErrUnknownMode is returned when trying to switch the plane to a mode that ArduPlane does not have.
+var ErrUnknownMode = errors.New("unknown flight mode")
+
+// commandTimeout is how long to wait for a COMMAND_ACK before resending a command.
+const commandTimeout = 1 * time.Second
+
+// commandMaxRetries is how many times a command is resent before giving up on it.
+const commandMaxRetries = 3
+
+// forceArmMagic is the param2 value of MAV_CMD_COMPONENT_ARM_DISARM that forces
+// arming/disarming regardless of pre-arm checks or being in the air.
+const forceArmMagic = 21196
+
+// Results reported when a command ends without a final COMMAND_ACK from the plane.
+const (
+	CommandResultTimeout = "TIMEOUT"
+	CommandResultNotSent = "NOT_SENT"
+)
+
+// commandResultNames maps MAV_RESULT values to their names in the MAVLink spec.
+// https://mavlink.io/en/messages/common.html#MAV_RESULT
+var commandResultNames = map[common.MAV_RESULT]string{
+	common.MAV_RESULT_ACCEPTED:             "MAV_RESULT_ACCEPTED",
+	common.MAV_RESULT_TEMPORARILY_REJECTED: "MAV_RESULT_TEMPORARILY_REJECTED",
+	common.MAV_RESULT_DENIED:               "MAV_RESULT_DENIED",
+	common.MAV_RESULT_UNSUPPORTED:          "MAV_RESULT_UNSUPPORTED",
+	common.MAV_RESULT_FAILED:               "MAV_RESULT_FAILED",
+	common.MAV_RESULT_IN_PROGRESS:          "MAV_RESULT_IN_PROGRESS",
+	common.MAV_RESULT_CANCELLED:            "MAV_RESULT_CANCELLED",
+}
+
+// CommandResult describes how the plane responded to a command.
+type CommandResult struct {
+	Command uint16 `json:"command"`
+	// Result is the MAV_RESULT name from the plane's final COMMAND_ACK,
+	// or TIMEOUT/NOT_SENT if the plane never acknowledged the command.
+	Result   string  `json:"result"`
+	Accepted bool    `json:"accepted"`
+	Progress uint8   `json:"progress"`
+	Attempts int     `json:"attempts"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// CommandLong sends a COMMAND_LONG to the plane and waits for the matching COMMAND_ACK.
+//
+// The command is resent up to commandMaxRetries times if no COMMAND_ACK arrives
+// within commandTimeout, incrementing the confirmation field on every resend as
+// required by https://mavlink.io/en/services/command.html. MAV_RESULT_IN_PROGRESS
+// acknowledgements extend the wait instead of ending it.
+//
+// An error is only returned if the command could not be sent at all. Whether the
+// plane accepted it is reported in the CommandResult.
+func (c *Client) CommandLong(command common.MAV_CMD, params [7]float32) (CommandResult, error) {
+	targetSystem, targetComponent, err := c.GetPlaneIDs()
+	if err != nil {
+		return CommandResult{Command: uint16(command), Result: CommandResultNotSent}, err
+	}
+
+	return c.sendCommand(command, func(attempt int) msg.Message {
+		return &common.MessageCommandLong{
+			TargetSystem:    targetSystem,
+			TargetComponent: targetComponent,
+			Command:         command,
+			Confirmation:    uint8(attempt),
+			Param1:          params[0],
+			Param2:          params[1],
+			Param3:          params[2],
+			Param4:          params[3],
+			Param5:          params[4],
+			Param6:          params[5],
+			Param7:          params[6],
+		}
+	})
+}
+
+// CommandInt sends a COMMAND_INT to the plane and waits for the matching COMMAND_ACK.
+// Latitude and longitude are in degrees and altitude is in meters relative to frame.
+//
+// Retries work the same way as CommandLong, except that COMMAND_INT has no
+// confirmation field so the same message is resent.
+func (c *Client) CommandInt(command common.MAV_CMD, frame common.MAV_FRAME, params [4]float32, lat float64, lon float64, alt float32) (CommandResult, error) {
+	targetSystem, targetComponent, err := c.GetPlaneIDs()
+	if err != nil {
+		return CommandResult{Command: uint16(command), Result: CommandResultNotSent}, err
+	}
+
+	commandMsg := &common.MessageCommandInt{
+		TargetSystem:    targetSystem,
+		TargetComponent: targetComponent,
+		Frame:           frame,
+		Command:         command,
+		Param1:          params[0],
+		Param2:          params[1],
+		Param3:          params[2],
+		Param4:          params[3],
+		X:               int32(lat * 1e7),
+		Y:               int32(lon * 1e7),
+		Z:               alt,
+	}
+	return c.sendCommand(command, func(int) msg.Message {
+		return commandMsg
+	})
+}
+
+// ReturnToLaunch commands the plane to return to its launch point.
+func (c *Client) ReturnToLaunch() (CommandResult, error) {
+	return c.CommandLong(common.MAV_CMD_NAV_RETURN_TO_LAUNCH, [7]float32{})
+}
+
+// Loiter switches the plane to LOITER mode around its current position.
+func (c *Client) Loiter() (CommandResult, error) {
+	return c.SetMode("LOITER")
+}
+
+// LoiterAt commands the plane to fly to a point and loiter there. Altitude is in meters
+// relative to home and radius is in meters (0 uses the autopilot's default radius).
+func (c *Client) LoiterAt(lat float64, lon float64, alt float32, radius float32) (CommandResult, error) {
+	params := [4]float32{
+		-1, // default ground speed
+		float32(common.MAV_DO_REPOSITION_FLAGS_CHANGE_MODE),
+		radius,
+		float32(math.NaN()), // keep the current yaw behaviour
+	}
+	return c.CommandInt(common.MAV_CMD_DO_REPOSITION, common.MAV_FRAME_GLOBAL_RELATIVE_ALT_INT, params, lat, lon, alt)
+}
+
+// Arm arms the plane's motors. force skips the autopilot's pre-arm checks.
+func (c *Client) Arm(force bool) (CommandResult, error) {
+	return c.CommandLong(common.MAV_CMD_COMPONENT_ARM_DISARM, [7]float32{1, forceParam(force)})
+}
+
+// Disarm disarms the plane's motors. force disarms even if the plane is flying.
+func (c *Client) Disarm(force bool) (CommandResult, error) {
+	return c.CommandLong(common.MAV_CMD_COMPONENT_ARM_DISARM, [7]float32{0, forceParam(force)})
+}
+
+// SetMode switches the plane to an ArduPlane flight mode such as "AUTO", "RTL" or "FBWA".
+// Returns ErrUnknownMode if the mode does not exist.
+func (c *Client) SetMode(mode string) (CommandResult, error) {
+	customMode, ok := arduPlaneModeNumber(mode)
+	if !ok {
+		return CommandResult{Command: uint16(common.MAV_CMD_DO_SET_MODE), Result: CommandResultNotSent}, ErrUnknownMode
+	}
+	return c.CommandLong(common.MAV_CMD_DO_SET_MODE, [7]float32{float32(common.MAV_MODE_FLAG_CUSTOM_MODE_ENABLED), float32(customMode)})
+}
+
+func forceParam(force bool) float32 {
+	if force {
+		return forceArmMagic
+	}
+	return 0
+}
+
+// sendCommand sends the message built by buildMsg and waits for the COMMAND_ACK
+// of command, resending as needed. attempt starts at 0 for the first transmission.
+func (c *Client) sendCommand(command common.MAV_CMD, buildMsg func(attempt int) msg.Message) (CommandResult, error) {
+	result := CommandResult{Command: uint16(command), Result: CommandResultNotSent}
+
+	acks := make(chan *common.MessageCommandAck, 8)
+	c.commandMutex.Lock()
+	if _, ok := c.pendingCommands[command]; ok {
+		c.commandMutex.Unlock()
+		return result, ErrCommandInProgress
+	}
+	c.pendingCommands[command] = acks
+	c.commandMutex.Unlock()
+
+	defer func() {
+		c.commandMutex.Lock()
+		delete(c.pendingCommands, command)
+		c.commandMutex.Unlock()
+	}()
+
+	started := time.Now()
+	for attempt := 0; attempt <= commandMaxRetries; attempt++ {
+		if attempt > 0 {
+			Log.Warnf("No COMMAND_ACK for command %d. Resending (retry %d/%d)", command, attempt, commandMaxRetries)
+		}
+		if err := c.SendToPlane(buildMsg(attempt)); err != nil {
+			return result, err
+		}
+		result.Attempts = attempt + 1
+		result.Result = CommandResultTimeout
+		expired := time.After(commandTimeout)
+
+	waitForAck:
+		for {
+			select {
+			case ack := <-acks:
+				result.Progress = ack.Progress
+				if ack.Result == common.MAV_RESULT_IN_PROGRESS {
+					expired = time.After(commandTimeout)
+					continue
+				}
+				result.Result = commandResultName(ack.Result)
+				result.Accepted = ack.Result == common.MAV_RESULT_ACCEPTED
+				result.Seconds = time.Since(started).Seconds()
+				return result, nil
+			case <-expired:
+				break waitForAck
+			}
+		}
+	}
+
+	result.Seconds = time.Since(started).Seconds()
+	Log.Errorf("Command %d timed out after %d retries", command, commandMaxRetries)
+	return result, nil
+}
+
+// deliverCommandAck hands a COMMAND_ACK to the command waiting for it, if any.
+func (c *Client) deliverCommandAck(ack *common.MessageCommandAck) {
+	c.commandMutex.Lock()
+	defer c.commandMutex.Unlock()
+
+	acks, ok := c.pendingCommands[ack.Command]
+	if !ok {
+		return
+	}
+	select {
+	case acks <- ack:
+	default:
+		// the command is flooded with IN_PROGRESS acks; dropping one is harmless
+	}
+}
+
+// commandResultName returns the MAVLink name of a MAV_RESULT.
+func commandResultName(result common.MAV_RESULT) string {
+	if name, ok := commandResultNames[result]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,54 @@
+package mav
+
+import (
+	"testing"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tritonuas/gcs/internal/mavlink/mavtest"
+)
+
+func TestCommandLong(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	ap.SendInProgressFirst(true)
+	c := newTestClient(t, port)
+
+	result, err := c.SetMode("auto")
+	require.NoError(t, err)
+	assert.True(t, result.Accepted)
+	assert.Equal(t, "MAV_RESULT_ACCEPTED", result.Result)
+	assert.Equal(t, 1, result.Attempts)
+
+	commands := ap.Commands()
+	require.Len(t, commands, 1)
+	assert.Equal(t, common.MAV_CMD_DO_SET_MODE, commands[0].Command)
+	assert.Equal(t, float32(10), commands[0].Param2)
+	assert.Equal(t, mavtest.ModeAuto, ap.Mode())
+}
+
+func TestCommandLongRetries(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	ap.IgnoreCommands(1)
+	ap.SetCommandResult(common.MAV_RESULT_DENIED)
+	c := newTestClient(t, port)
+
+	result, err := c.Arm(false)
+	require.NoError(t, err)
+	assert.False(t, result.Accepted)
+	assert.Equal(t, "MAV_RESULT_DENIED", result.Result)
+	assert.Equal(t, 2, result.Attempts)
+
+	commands := ap.Commands()
+	require.Len(t, commands, 2)
+	assert.Equal(t, uint8(0), commands[0].Confirmation)
+	assert.Equal(t, uint8(1), commands[1].Confirmation)
+}
+
+func TestSetModeUnknown(t *testing.T) {
+	c := &Client{}
+	_, err := c.SetMode("BARREL_ROLL")
+	assert.ErrorIs(t, err, ErrUnknownMode)
+}
@@ -3,6 +3,10 @@ package mav
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/aler9/gomavlib"
@@ -10,56 +14,356 @@ import (
 
 var errUndefinedEndpointType = errors.New("mavlink endpoint has an undefined type")
 
+// ErrInvalidEndpoint is returned for endpoint strings that NewEndpoint can not parse.
+var ErrInvalidEndpoint = errors.New("invalid mavlink endpoint")
+
+// defaultSerialBaud is the baud rate of serial endpoints that do not set one. It matches SiK telemetry radios.
+const defaultSerialBaud = 57600
+
+// serialBauds are the baud rates accepted by the baud option of serial endpoints.
+var serialBauds = map[int]bool{
+	9600: true, 19200: true, 38400: true, 57600: true, 111100: true, 115200: true,
+	230400: true, 256000: true, 460800: true, 500000: true, 921600: true, 1500000: true,
+}
+
 // EndpointData contains the mavlink endpoints for the plane and router. The
 // mavlink client will listen for messages from the plane and forward messages
 // to all the router endpoints.
+//
+// Each endpoint is a string in the format accepted by ParseEndpoint, options included.
 type EndpointData struct {
 	Plane  string   `json:"plane"`
 	Router []string `json:"router"`
 }
 
-// NewEndpoint creates a new Mavlink endpoint and returns it
+// EndpointOptions are the options that can follow an endpoint string after a "?".
+type EndpointOptions struct {
+	// Baud is the baud rate of a serial endpoint, set with "baud=115200"
+	Baud int `json:"baud,omitempty"`
+	// ReadOnly endpoints are only listened to. Hub does not forward or send any messages
+	// to them, apart from its own HEARTBEAT. Set with "readonly".
+	ReadOnly bool `json:"read_only"`
+	// NoForward endpoints are not routed anywhere else, but Hub still uses their
+	// messages itself and can send messages to them. Set with "noforward".
+	NoForward bool `json:"no_forward"`
+
+	// The filters below only apply to frames the router forwards to the endpoint,
+	// not to messages Hub sends itself. Messages are given by name or ID, and lists are
+	// comma separated, such as "deny_msg=ATTITUDE,VFR_HUD".
+
+	// AllowMessages forwards only these message IDs to the endpoint. Set with "allow_msg".
+	AllowMessages []uint32 `json:"allow_messages,omitempty"`
+	// DenyMessages never forwards these message IDs to the endpoint. Set with "deny_msg".
+	DenyMessages []uint32 `json:"deny_messages,omitempty"`
+	// AllowSystems forwards only frames from these system IDs to the endpoint. Set with "allow_sys".
+	AllowSystems []uint8 `json:"allow_systems,omitempty"`
+	// DenySystems never forwards frames from these system IDs to the endpoint. Set with "deny_sys".
+	DenySystems []uint8 `json:"deny_systems,omitempty"`
+	// RateLimits is the most times per second each message ID is forwarded to the
+	// endpoint from every system and component. Set with "rate=ATTITUDE:2,VFR_HUD:1".
+	RateLimits map[uint32]float64 `json:"rate_limits,omitempty"`
+
+	// Speed is how many times faster than real time a replay endpoint plays its tlog,
+	// set with "speed=2". "speed=max" plays it as fast as Hub can handle the frames.
+	// Defaults to 1.
+	Speed float64 `json:"speed,omitempty"`
+}
+
+// NewEndpoint creates a new Mavlink endpoint and returns it. Any options after a "?"
+// are validated but otherwise ignored (see ParseEndpoint).
 //
 // Parameters:
 //   - mavDevice:Format for TCP or UDP connections: "connType:address:port".
 //     Format for serial connections: "connType:address". Examples: "udp:localhost:14551", "tcp:192.168.1.7:14550", "serial:/dev/ttyUSB0"
 //
+// Connection types:
+//   - serial: serial port
+//   - udp, tcp: connect to a device that is listening at address:port
+//   - udpin, tcpin: listen at address:port for devices to connect to Hub, like mavproxy's
+//     --out=udpin/tcpin. Use 0.0.0.0 as the address to accept devices on any interface.
+//   - udpbcast: broadcast to every device on the subnet of a broadcast address, such as
+//     "udpbcast:192.168.1.255:14550", and receive from any of them
+//   - replay: play the frames of a tlog file recorded by StartTlog (or Mission Planner)
+//     as if they came from a plane, such as "replay:/path/file.tlog?speed=2". Messages
+//     sent to it are discarded. Playback of the plane endpoint can be paused and seeked
+//     (see SeekReplay).
+//
 // Returns:
 //   - gomavlib.EndpointConf: Endpoint to be used to communicate with
-//   - error: nil unless an invalid connection type is provided
+//   - error: nil unless an invalid connection type or option is provided
 func NewEndpoint(mavDeviceConnInfo string) (gomavlib.EndpointConf, error) {
+	endpointConf, _, err := ParseEndpoint(mavDeviceConnInfo)
+	return endpointConf, err
+}
+
+// ParseEndpoint creates a new Mavlink endpoint like NewEndpoint and also returns the
+// options that follow the endpoint after a "?", in URL query format:
+//
+//	serial:/dev/ttyUSB0?baud=115200
+//	udp:192.168.1.7:14551?readonly
+//	tcpin:0.0.0.0:14552?noforward&readonly
+//	udp:192.168.1.5:14555?deny_msg=PARAM_VALUE&rate=ATTITUDE:2&deny_sys=255
+//	replay:tlogs/2023-04-01_12-00-00.tlog?speed=2
+//
+// See EndpointOptions for every option.
+func ParseEndpoint(mavDeviceConnInfo string) (gomavlib.EndpointConf, EndpointOptions, error) {
+	mavDeviceConnInfo, rawOptions, _ := strings.Cut(mavDeviceConnInfo, "?")
 	mavDeviceSplit := strings.Split(mavDeviceConnInfo, ":")
 
 	// Stores the type of device where information will be read from (udp, tcp, or serial connection)
 	connType := mavDeviceSplit[0]
 	address := strings.Join(mavDeviceSplit[1:], ":")
 
+	options, err := parseEndpointOptions(rawOptions, connType)
+	if err != nil {
+		return nil, options, err
+	}
+
 	switch connType {
 	case "serial":
-		return gomavlib.EndpointSerial{Address: fmt.Sprintf("%s:57600", address)}, nil
+		return gomavlib.EndpointSerial{Address: fmt.Sprintf("%s:%d", address, options.Baud)}, options, nil
 
 	case "udp":
-		return gomavlib.EndpointUDPClient{Address: address}, nil
+		return gomavlib.EndpointUDPClient{Address: address}, options, nil
 
 	case "tcp":
-		return gomavlib.EndpointTCPClient{Address: address}, nil
+		return gomavlib.EndpointTCPClient{Address: address}, options, nil
+
+	case "udpin":
+		return gomavlib.EndpointUDPServer{Address: address}, options, nil
+
+	case "tcpin":
+		return gomavlib.EndpointTCPServer{Address: address}, options, nil
+
+	case "udpbcast":
+		return gomavlib.EndpointUDPBroadcast{BroadcastAddress: address}, options, nil
+
+	case "replay":
+		return gomavlib.EndpointCustom{ReadWriteCloser: newTlogReplay(address, options.Speed)}, options, nil
 
 	default:
-		return nil, errUndefinedEndpointType
+		return nil, options, errUndefinedEndpointType
+	}
+}
+
+// parseEndpointOptions parses the options of an endpoint string (the part after "?").
+// The baud option is only allowed for serial endpoints, which default to
+// defaultSerialBaud, and the speed option for replay endpoints.
+func parseEndpointOptions(rawOptions string, connType string) (EndpointOptions, error) {
+	options := EndpointOptions{}
+	serial, replay := connType == "serial", connType == "replay"
+	if serial {
+		options.Baud = defaultSerialBaud
+	}
+	if replay {
+		options.Speed = 1
+	}
+
+	values, err := url.ParseQuery(rawOptions)
+	if err != nil {
+		return options, fmt.Errorf("invalid endpoint options %q: %w", rawOptions, err)
+	}
+	for name, value := range values {
+		switch name {
+		case "baud":
+			if !serial {
+				return options, errors.New("the baud option is only supported by serial endpoints")
+			}
+			baud, err := strconv.Atoi(value[0])
+			if err != nil || !serialBauds[baud] {
+				return options, fmt.Errorf("unsupported baud rate %q", value[0])
+			}
+			options.Baud = baud
+		case "speed":
+			if !replay {
+				return options, errors.New("the speed option is only supported by replay endpoints")
+			}
+			options.Speed, err = parseReplaySpeed(value[0])
+		case "readonly":
+			options.ReadOnly, err = parseEndpointFlag(name, value[0])
+		case "noforward":
+			options.NoForward, err = parseEndpointFlag(name, value[0])
+		case "allow_msg":
+			options.AllowMessages, err = parseMessageList(value)
+		case "deny_msg":
+			options.DenyMessages, err = parseMessageList(value)
+		case "allow_sys":
+			options.AllowSystems, err = parseSystemList(value)
+		case "deny_sys":
+			options.DenySystems, err = parseSystemList(value)
+		case "rate":
+			options.RateLimits, err = parseRateLimits(value)
+		default:
+			return options, fmt.Errorf("unknown endpoint option %q", name)
+		}
+		if err != nil {
+			return options, err
+		}
+	}
+	return options, nil
+}
+
+// parseReplaySpeed parses the speed option of a replay endpoint. "max" is returned as
+// 0, which plays frames without waiting.
+func parseReplaySpeed(value string) (float64, error) {
+	if value == "max" {
+		return 0, nil
+	}
+	speed, err := strconv.ParseFloat(value, 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid replay speed %q. Expected a number above 0 or max", value)
+	}
+	return speed, nil
+}
+
+// parseMessageList parses comma separated message names or IDs.
+func parseMessageList(values []string) ([]uint32, error) {
+	ids := []uint32{}
+	for _, name := range SplitList(values...) {
+		id, ok := MessageID(name)
+		if !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownMessage, name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseSystemList parses comma separated system IDs.
+func parseSystemList(values []string) ([]uint8, error) {
+	ids := []uint8{}
+	for _, idStr := range SplitList(values...) {
+		id, err := strconv.ParseUint(idStr, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid system ID %q", idStr)
+		}
+		ids = append(ids, uint8(id))
+	}
+	return ids, nil
+}
+
+// parseRateLimits parses comma separated "message:rate" pairs, where rate is in Hz.
+func parseRateLimits(values []string) (map[uint32]float64, error) {
+	limits := make(map[uint32]float64)
+	for _, limit := range SplitList(values...) {
+		name, rateStr, _ := strings.Cut(limit, ":")
+		id, ok := MessageID(name)
+		if !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownMessage, name)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate limit %q. Expected message:rate with a rate in Hz above 0", limit)
+		}
+		limits[id] = rate
+	}
+	return limits, nil
+}
+
+// SplitList splits comma separated lists, ignoring empty entries. It is used for the
+// values of list options, which can be repeated or comma separated, and for lists in
+// Hub's configuration.
+func SplitList(values ...string) []string {
+	items := []string{}
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// parseEndpointFlag parses a boolean endpoint option, which is true if it has no value.
+func parseEndpointFlag(name string, value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q for endpoint option %s", value, name)
+	}
+	return flag, nil
+}
+
+// ValidateEndpoint checks that an endpoint string and its options can be turned into
+// an endpoint by ParseEndpoint, including that TCP and UDP endpoints have a port.
+func ValidateEndpoint(mavDeviceConnInfo string) error {
+	endpointConf, err := NewEndpoint(mavDeviceConnInfo)
+	if err != nil {
+		return fmt.Errorf("%w %q: %s", ErrInvalidEndpoint, mavDeviceConnInfo, err.Error())
+	}
+
+	var address string
+	switch endpoint := endpointConf.(type) {
+	case gomavlib.EndpointSerial:
+		return nil
+	case gomavlib.EndpointUDPClient:
+		address = endpoint.Address
+	case gomavlib.EndpointTCPClient:
+		address = endpoint.Address
+	case gomavlib.EndpointUDPServer:
+		address = endpoint.Address
+	case gomavlib.EndpointTCPServer:
+		address = endpoint.Address
+	case gomavlib.EndpointUDPBroadcast:
+		address = endpoint.BroadcastAddress
+	case gomavlib.EndpointCustom:
+		if replay, ok := endpoint.ReadWriteCloser.(*tlogReplay); ok {
+			if _, err := os.Stat(replay.path); err != nil {
+				return fmt.Errorf("%w %q: %s", ErrInvalidEndpoint, mavDeviceConnInfo, err.Error())
+			}
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("%w %q: %s", ErrInvalidEndpoint, mavDeviceConnInfo, err.Error())
 	}
+	return nil
 }
 
 // StringifyEndpoint will fetch a string represnetation of an endpoint
-// depending on the endpoint type.
+// depending on the endpoint type. The string can be turned back into the same
+// endpoint with NewEndpoint.
 func StringifyEndpoint(endpointConf gomavlib.EndpointConf) (string, error) {
 	Log.Infof("endpoint is %s %T", endpointConf, endpointConf)
 	switch endpoint := endpointConf.(type) {
 	case gomavlib.EndpointSerial:
-		return fmt.Sprintf("serial:%s", endpoint.Address), nil
+		address, baud := endpoint.Address, defaultSerialBaud
+		if i := strings.LastIndex(address, ":"); i >= 0 {
+			if b, err := strconv.Atoi(address[i+1:]); err == nil {
+				address, baud = address[:i], b
+			}
+		}
+		if baud != defaultSerialBaud {
+			return fmt.Sprintf("serial:%s?baud=%d", address, baud), nil
+		}
+		return fmt.Sprintf("serial:%s", address), nil
 	case gomavlib.EndpointTCPClient:
 		return fmt.Sprintf("tcp:%s", endpoint.Address), nil
 	case gomavlib.EndpointUDPClient:
 		return fmt.Sprintf("udp:%s", endpoint.Address), nil
+	case gomavlib.EndpointTCPServer:
+		return fmt.Sprintf("tcpin:%s", endpoint.Address), nil
+	case gomavlib.EndpointUDPServer:
+		return fmt.Sprintf("udpin:%s", endpoint.Address), nil
+	case gomavlib.EndpointUDPBroadcast:
+		return fmt.Sprintf("udpbcast:%s", endpoint.BroadcastAddress), nil
+	case gomavlib.EndpointCustom:
+		replay, ok := endpoint.ReadWriteCloser.(*tlogReplay)
+		if !ok {
+			return "", errUndefinedEndpointType
+		}
+		// the endpoint is described as configured, whatever speed it is replayed at now
+		switch replay.configuredSpeed {
+		case 1:
+			return fmt.Sprintf("replay:%s", replay.path), nil
+		case 0:
+			return fmt.Sprintf("replay:%s?speed=max", replay.path), nil
+		default:
+			return fmt.Sprintf("replay:%s?speed=%g", replay.path, replay.configuredSpeed), nil
+		}
 	default:
 		return "", errUndefinedEndpointType
 	}
@@ -68,5 +372,5 @@ func StringifyEndpoint(endpointConf gomavlib.EndpointConf) (string, error) {
 // GetRouterEndpoints will return a list of endpoints (represented with strings)
 // that the router is forwarding EventFrames to.
 func (c *Client) GetRouterEndpoints() []string {
-	return c.endpointConnInfo.Router
+	return c.getEndpointConnInfo().Router
 }
@@ -0,0 +1,142 @@
+package mav
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointRoundTrip(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		conf     gomavlib.EndpointConf
+	}{
+		{"serial:/dev/ttyUSB0", gomavlib.EndpointSerial{Address: "/dev/ttyUSB0:57600"}},
+		{"serial:/dev/ttyACM0?baud=115200", gomavlib.EndpointSerial{Address: "/dev/ttyACM0:115200"}},
+		{"udp:localhost:14551", gomavlib.EndpointUDPClient{Address: "localhost:14551"}},
+		{"tcp:192.168.1.7:14550", gomavlib.EndpointTCPClient{Address: "192.168.1.7:14550"}},
+		{"udpin:0.0.0.0:14550", gomavlib.EndpointUDPServer{Address: "0.0.0.0:14550"}},
+		{"tcpin:127.0.0.1:14551", gomavlib.EndpointTCPServer{Address: "127.0.0.1:14551"}},
+		{"udpbcast:192.168.1.255:14550", gomavlib.EndpointUDPBroadcast{BroadcastAddress: "192.168.1.255:14550"}},
+	}
+	for _, test := range tests {
+		conf, err := NewEndpoint(test.endpoint)
+		require.NoError(t, err, test.endpoint)
+		assert.Equal(t, test.conf, conf)
+
+		endpoint, err := StringifyEndpoint(conf)
+		require.NoError(t, err)
+		assert.Equal(t, test.endpoint, endpoint)
+
+		assert.NoError(t, ValidateEndpoint(test.endpoint))
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	assert.ErrorIs(t, ValidateEndpoint("bluetooth:plane"), ErrInvalidEndpoint)
+	assert.ErrorIs(t, ValidateEndpoint("tcpin:0.0.0.0"), ErrInvalidEndpoint)
+	assert.ErrorIs(t, ValidateEndpoint("udp"), ErrInvalidEndpoint)
+	assert.ErrorIs(t, ValidateEndpoint("serial:/dev/ttyUSB0?baud=1234"), ErrInvalidEndpoint)
+	assert.ErrorIs(t, ValidateEndpoint("udp:localhost:14550?baud=57600"), ErrInvalidEndpoint)
+	assert.ErrorIs(t, ValidateEndpoint("udp:localhost:14550?fast"), ErrInvalidEndpoint)
+	assert.ErrorIs(t, ValidateEndpoint("udp:localhost:14550?readonly=maybe"), ErrInvalidEndpoint)
+	assert.ErrorIs(t, ValidateEndpoint("replay:/no/such/flight.tlog"), ErrInvalidEndpoint)
+}
+
+func TestParseEndpointOptions(t *testing.T) {
+	conf, options, err := ParseEndpoint("tcpin:0.0.0.0:14552?readonly&noforward=false")
+	require.NoError(t, err)
+	assert.Equal(t, gomavlib.EndpointTCPServer{Address: "0.0.0.0:14552"}, conf)
+	assert.Equal(t, EndpointOptions{ReadOnly: true}, options)
+
+	_, options, err = ParseEndpoint("serial:/dev/ttyUSB0?noforward")
+	require.NoError(t, err)
+	assert.Equal(t, EndpointOptions{Baud: 57600, NoForward: true}, options)
+
+	_, options, err = ParseEndpoint("udp:127.0.0.1:14550?allow_msg=HEARTBEAT,33&deny_sys=255&rate=attitude:2.5")
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{0, 33}, options.AllowMessages)
+	assert.Equal(t, []uint8{255}, options.DenySystems)
+	assert.Equal(t, map[uint32]float64{30: 2.5}, options.RateLimits)
+
+	conf, options, err = ParseEndpoint("replay:tlogs/flight.tlog?speed=2.5")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, options.Speed)
+	endpoint, err := StringifyEndpoint(conf)
+	require.NoError(t, err)
+	assert.Equal(t, "replay:tlogs/flight.tlog?speed=2.5", endpoint)
+	// the endpoint stays as configured when the replay speed is changed
+	require.NoError(t, conf.(gomavlib.EndpointCustom).ReadWriteCloser.(*tlogReplay).setSpeed(4))
+	endpoint, err = StringifyEndpoint(conf)
+	require.NoError(t, err)
+	assert.Equal(t, "replay:tlogs/flight.tlog?speed=2.5", endpoint)
+
+	_, options, err = ParseEndpoint("replay:tlogs/flight.tlog?speed=max")
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, options.Speed)
+
+	for _, s := range []string{
+		"udp:127.0.0.1:14550?deny_msg=NOT_A_MESSAGE",
+		"udp:127.0.0.1:14550?speed=2",
+		"replay:tlogs/flight.tlog?speed=-1",
+		"udp:127.0.0.1:14550?allow_sys=256",
+		"udp:127.0.0.1:14550?rate=ATTITUDE",
+		"udp:127.0.0.1:14550?rate=ATTITUDE:0",
+	} {
+		_, _, err = ParseEndpoint(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestReadOnlyEndpoint(t *testing.T) {
+	planePort, gcsPort := freeUDPPort(t), freeUDPPort(t)
+	ap := newTestAutopilot(t, planePort)
+	c := New(nil, "127.0.0.1", "1",
+		fmt.Sprintf("udp:127.0.0.1:%d", planePort),
+		fmt.Sprintf("udpin:127.0.0.1:%d?readonly", gcsPort))
+	go c.Listen()
+	t.Cleanup(c.Kill)
+
+	gcs, err := gomavlib.NewNode(gomavlib.NodeConf{
+		Endpoints:       []gomavlib.EndpointConf{gomavlib.EndpointUDPClient{Address: fmt.Sprintf("127.0.0.1:%d", gcsPort)}},
+		Dialect:         common.Dialect,
+		OutVersion:      gomavlib.V2,
+		OutSystemID:     255,
+		HeartbeatPeriod: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(gcs.Close)
+
+	// the GCS is still routed to the plane...
+	planeHeardGCS := make(chan struct{})
+	ap.OnFrame(func(evt *gomavlib.EventFrame) {
+		if evt.SystemID() == 255 {
+			select {
+			case planeHeardGCS <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	// ...but nothing from the plane reaches the GCS
+	timeout := time.After(2 * time.Second)
+	heardGCS := false
+	for {
+		select {
+		case e := <-gcs.Events():
+			if evt, ok := e.(*gomavlib.EventFrame); ok {
+				assert.NotEqual(t, byte(1), evt.SystemID(), "plane frame routed to a read-only endpoint")
+			}
+		case <-planeHeardGCS:
+			heardGCS = true
+		case <-timeout:
+			assert.True(t, heardGCS, "GCS frames were not routed to the plane")
+			return
+		}
+	}
+}
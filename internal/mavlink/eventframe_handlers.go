@@ -1,23 +1,27 @@
 package mav
 
 import (
-	"fmt"
+	"time"
 
 	"github.com/aler9/gomavlib"
 	"github.com/aler9/gomavlib/pkg/dialects/common"
+	mavmsg "github.com/aler9/gomavlib/pkg/msg"
 )
 
 // EventFrameHandler is type of function that takes a Mavlink
 // EventFrame and performs further processing on it.
 //
 // If you want to add some functionality that deals with incoming EventFrames,
-// create a function with the matching signature. Currently these handlers
-// are used in the Listen method in mavlink/client.go, where all incoming
-// EventFrames will be fed into them.
+// create a function with the matching signature and register it under a name
+// with RegisterQueuedHandler, or RegisterHandler if it has to run before the frame
+// is routed any further (the built-in handlers are registered in New). The Listen
+// method in mavlink/client.go feeds every incoming EventFrame into the enabled
+// handlers, which can be toggled and reordered at runtime (see handler_registry.go).
 type EventFrameHandler func(*Client, *gomavlib.EventFrame, *gomavlib.Node)
 
-// forwardEventFrame forwards event frames to all other channels except the
-// channel the frame originated from
+// forwardEventFrame routes event frames to the other channels: frames addressed
+// to a system only go to the channels it was heard on, and the rest go to all
+// channels except the one the frame originated from (see routeFrame)
 func (c *Client) forwardEventFrame(evt *gomavlib.EventFrame, node *gomavlib.Node) {
 	// msg := evt.Frame.GetMessage()
 
@@ -26,7 +30,43 @@ func (c *Client) forwardEventFrame(evt *gomavlib.EventFrame, node *gomavlib.Node
 	// 	time.Sleep(1 * time.Second)
 	// }
 
-	node.WriteFrameExcept(evt.Channel, evt.Frame)
+	c.routeFrame(evt, node)
+}
+
+// countLinkTraffic counts every frame towards the stats of the channel it was
+// received on (see GetLinkStats).
+func (c *Client) countLinkTraffic(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+	c.recordFrame(evt, time.Now())
+}
+
+// trackHeartbeats notes when every system's HEARTBEAT arrives to monitor the health
+// of its link (see link_monitor.go).
+func (c *Client) trackHeartbeats(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+	if msg, ok := evt.Frame.GetMessage().(*common.MessageHeartbeat); ok {
+		c.recordHeartbeat(evt, msg, time.Now())
+	}
+}
+
+// recordTlog writes every frame to the tlog recording in progress, if any (see
+// StartTlog).
+func (c *Client) recordTlog(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+	c.recordTlogFrame(evt, time.Now())
+}
+
+// trackPlaneChannel remembers which channel the plane is connected on so that
+// messages can be sent directly to it. The plane is identified by a HEARTBEAT
+// from a flight controller, which excludes other ground stations such as QGC.
+func (c *Client) trackPlaneChannel(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+	msg, ok := evt.Frame.GetMessage().(*common.MessageHeartbeat)
+	if !ok {
+		return
+	}
+
+	if msg.Type == common.MAV_TYPE_GCS || msg.Autopilot == common.MAV_AUTOPILOT_INVALID || evt.SystemID() == systemID {
+		return
+	}
+
+	c.setPlaneChannel(evt.Channel, evt.SystemID(), evt.ComponentID())
 }
 
 // forwardEventFrame forwards messages to all other channels except the
@@ -35,101 +75,29 @@ func (c *Client) forwardMessage(evt *gomavlib.EventFrame, node *gomavlib.Node) {
 	node.WriteMessageExcept(evt.Channel, evt.Frame.GetMessage())
 }
 
-// writeMsgToInfluxDB will take an eventFrame and write the data from the
-// Mavlink message to InfluxDB (if it's one of the messages we want to store)
-// TODO: add signals board messages and anything else that seems useful
+// writeMsgToInfluxDB will take an eventFrame and write every field of its Mavlink
+// message to InfluxDB (see influxDBFields), unless the message is left out by
+// SetInfluxDBMessages.
 func (c *Client) writeMsgToInfluxDB(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
-	if !c.influxdbClient.IsConnected() {
+	if c.influxdbClient == nil || !c.influxdbClient.IsConnected() {
 		return
 	}
 	msg := evt.Frame.GetMessage()
-	msgName := ""
-	data := make(map[string]interface{})
+	if _, unknown := msg.(*mavmsg.MessageRaw); unknown {
+		// messages outside the common dialect have no fields to store
+		return
+	}
+	store, enumNames := c.storesInInfluxDB(msg.GetID())
+	if !store {
+		return
+	}
 
-	switch msg := msg.(type) {
-	case *common.MessageGlobalPositionInt:
-		msgName = "GLOBAL_POSITION_INT"
-
-		data["time_boot_ms"] = msg.TimeBootMs
-		data["lat"] = msg.Lat
-		data["lon"] = msg.Lon
-		data["alt"] = msg.Alt
-		data["relative_alt"] = msg.RelativeAlt
-		data["vx"] = msg.Vx
-		data["vy"] = msg.Vy
-		data["vz"] = msg.Vz
-		data["hdg"] = msg.Hdg
-
-	case *common.MessageAttitude:
-		msgName = "ATTITUDE"
-
-		data["time_boot_ms"] = msg.TimeBootMs
-		data["roll"] = msg.Roll
-		data["pitch"] = msg.Pitch
-		data["yaw"] = msg.Yaw
-		data["rollspeed"] = msg.Rollspeed
-		data["pitchspeed"] = msg.Pitchspeed
-		data["yawspeed"] = msg.Yawspeed
-
-	case *common.MessageVfrHud:
-		msgName = "VFR_HUD"
-
-		data["airspeed"] = msg.Airspeed
-		data["groundspeed"] = msg.Groundspeed
-		data["heading"] = msg.Heading
-		data["throttle"] = msg.Throttle
-		data["alt"] = msg.Alt
-		data["climb"] = msg.Climb
-
-	case *common.MessageBatteryStatus:
-		msgName = "BATTERY_STATUS"
-		data["id"] = uint64(msg.Id)
-		data["temperature"] = int64(msg.Temperature)
-		// data["voltages"] = msg.Voltages
-		for i, voltage := range msg.Voltages {
-			data[fmt.Sprintf("voltage%d", i)] = uint64(voltage)
-		}
-		data["current_battery"] = int64(msg.CurrentBattery)
-		data["current_consumed"] = int64(msg.CurrentConsumed)
-		data["energy_consumed"] = int64(msg.EnergyConsumed)
-		data["battery_remaining"] = int64(msg.BatteryRemaining)
-		data["time_remaining"] = int64(msg.TimeRemaining)
-		data["charge_state"] = int64(msg.ChargeState)
-		data["mode"] = int64(msg.Mode)
-		data["fault_bitmask"] = int64(msg.FaultBitmask)
-
-	case *common.MessageHeartbeat:
-		msgName = "HEARTBEAT"
-
-		data["type"] = msg.Type
-		data["autopilot"] = msg.Autopilot
-		data["base_mode"] = (uint32)(msg.BaseMode)
-		data["custom_mode"] = msg.CustomMode
-		data["system_status"] = msg.SystemStatus
-		data["mavlink_version"] = msg.MavlinkVersion
-
-	// case *common.MessageHygrometerSensor:
-	// 	fields := []string{"id", "temperature", "humidity"}
-	// 	vals := []float64{float64(msg.Id), float64(msg.Temperature), float64(msg.Humidity)}
-	// 	writeToInflux(msg.GetID(), fmt.Sprintf("HYGROMETER_SENSOR%v", msg.Id), fields, vals, writeAPI)
-	// case *common.MessageEscStatus:
-	// 	fields := []string{"index", "rpm", "voltage", "current"}
-	// 	vals := []float64{float64(msg.Index), float64(msg.Rpm[msg.Index]), float64(msg.Humidity[ms])}
-	// 	writeToInflux(msg.GetID(), "HYGROMETER_SENSOR", fields, vals, writeAPI)
-	case *common.MessageNamedValueFloat:
-		msgName = "NAMED_VALUE_FLOAT"
-
-		data["time_boot_ms"] = msg.TimeBootMs
-		data["name"] = msg.Name
-		data["value"] = msg.Value
-	}
-
-	// If we parsed a message then write it. Otherwise it can be ignored
-	if msgName != "" && len(data) != 0 {
-		err := c.influxdbClient.Write(msgName, msg.GetID(), data)
-		if err != nil {
-			Log.Errorf("Cannot write message %s to InfluxDB. Reason: %s", msgName, err.Error())
-		}
+	msgName := MessageName(msg)
+	data := influxDBFields(msg, enumNames)
+
+	err := c.influxdbClient.Write(msgName, msg.GetID(), data)
+	if err != nil {
+		Log.Errorf("Cannot write message %s to InfluxDB. Reason: %s", msgName, err.Error())
 	}
 }
 
@@ -144,61 +112,146 @@ func (c *Client) writeMsgToInfluxDB(evt *gomavlib.EventFrame, _ *gomavlib.Node)
 //
 // See https://mavlink.io/en/services/mission.html#uploading_mission for details
 // on the entire mission uploading process.
-// TODO: Check client for an update to a channel to know
-// when to upload mission and what the waypoints are.
-// Client has to have previously sent a MISSION_COUNT message to the plane
-func (c *Client) handleMissionUpload(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
-	switch evt.Frame.GetMessage().(type) {
+// Frames are ignored unless an upload was previously started with StartMissionUpload.
+func (c *Client) handleMissionUpload(evt *gomavlib.EventFrame, node *gomavlib.Node) {
+	upload := c.currentMissionUpload()
+	if upload == nil || evt.SystemID() != upload.targetSystem {
+		return
+	}
+
+	switch msg := evt.Frame.GetMessage().(type) {
 	case *common.MessageMissionAck:
-		// TODO: save if mission upload suceeded/failed
+		if msg.TargetSystem != systemID || msg.MissionType != common.MAV_MISSION_TYPE_MISSION {
+			return
+		}
+		result := missionResultName(msg.Type)
+		Log.Infof("Mission upload finished with result %s", result)
+		c.finishMissionUpload(upload, result)
 	case *common.MessageMissionRequestInt:
-		// TODO: send MISSION_ITEM_INT back to plane channel
+		if msg.TargetSystem != systemID || msg.MissionType != common.MAV_MISSION_TYPE_MISSION {
+			return
+		}
+		c.sendMissionUploadItem(node, msg.Seq, true)
 	case *common.MessageMissionRequest:
-		// TODO: send MISSION_ITEM back to plane channel (deprecated)
+		// deprecated, but older autopilots may still request items this way
+		if msg.TargetSystem != systemID || msg.MissionType != common.MAV_MISSION_TYPE_MISSION {
+			return
+		}
+		c.sendMissionUploadItem(node, msg.Seq, false)
+	}
+}
+
+// trackPlaneState decodes the flight mode and arming state from the plane's HEARTBEAT
+// (see GetPlaneState)
+func (c *Client) trackPlaneState(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+	msg, ok := evt.Frame.GetMessage().(*common.MessageHeartbeat)
+	if !ok || !c.isFromPlane(evt) {
+		return
+	}
+
+	c.updatePlaneState(msg)
+}
+
+// handleCommandAck passes COMMAND_ACKs from the plane to the command that is waiting
+// for them (see CommandLong). Acknowledgements meant for other ground stations are ignored.
+func (c *Client) handleCommandAck(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+	msg, ok := evt.Frame.GetMessage().(*common.MessageCommandAck)
+	if !ok || !c.isFromPlane(evt) {
+		return
+	}
+
+	// target_system is a MAVLink 2 extension, so it is 0 if the plane only speaks MAVLink 1
+	if msg.TargetSystem != 0 && msg.TargetSystem != systemID {
+		return
+	}
+
+	c.deliverCommandAck(msg)
+}
+
+// handleParamValue stores parameters sent by the plane in the parameter cache
+// (see StartParamFetch, ReadParam and SetParam)
+func (c *Client) handleParamValue(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+	msg, ok := evt.Frame.GetMessage().(*common.MessageParamValue)
+	if !ok || !c.isFromPlane(evt) {
+		return
 	}
+
+	c.updateParam(msg)
 }
 
-// handleBatteryUpdate stores the most recent recorded voltage for each battery in the
-// client's battery map
+// handleBatteryUpdate stores the BATTERY_STATUS of each of the plane's batteries
+// (see GetBatteries)
 func (c *Client) handleBatteryUpdate(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
-	switch msg := evt.Frame.GetMessage().(type) { //nolint: gocritic
-	case *common.MessageBatteryStatus:
-		if msg.BatteryRemaining != 0 { // hacky fix to wierd battery voltage behavior we're seeing
-			c.LatestBatteryInfo[msg.Id] = int(msg.Voltages[0])
-		}
+	msg, ok := evt.Frame.GetMessage().(*common.MessageBatteryStatus)
+	if !ok || !c.isFromPlane(evt) {
+		return
 	}
+
+	c.updateBattery(msg, time.Now())
 }
 
-// handleMissionUpload will process frames associated with uploading a mission.
+// handleMissionDownload will process frames associated with downloading a mission.
 //
 // Steps:
-//  1. GCS sends MISSION_REQUEST_INT (use StartMissionDownload function)
+//  1. GCS sends MISSION_REQUEST_LIST (use StartMissionDownload function)
 //  2. Plane sends MISSION_COUNT
 //  3. GCS sends MISSION_REQUEST_INT
-//  4. Steps 2 and 3 and repeated until all waypoints have been sent
-//  5. GCS sends MISSION_ACK
+//  4. Plane sends MISSION_ITEM_INT
+//  5. Steps 3 and 4 and repeated until all waypoints have been received
+//  6. GCS sends MISSION_ACK
 //
 // See https://mavlink.io/en/services/mission.html#download_mission for details
 // on the entire mission downloading process.
-// TODO: Client has to have previously sent a MISSION_REQUEST_LIST message to the plane
-func (c *Client) handleMissionDownload(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
-	switch evt.Frame.GetMessage().(type) {
+// Frames are ignored unless a download was previously started with StartMissionDownload.
+func (c *Client) handleMissionDownload(evt *gomavlib.EventFrame, node *gomavlib.Node) {
+	download := c.currentMissionDownload()
+	if download == nil || evt.SystemID() != download.targetSystem {
+		return
+	}
+
+	switch msg := evt.Frame.GetMessage().(type) {
 	case *common.MessageMissionCount:
-		// TODO: send MISSION_REQUEST_INT
+		if msg.TargetSystem != systemID || msg.MissionType != common.MAV_MISSION_TYPE_MISSION {
+			return
+		}
+		c.handleMissionDownloadCount(node, msg.Count)
 	case *common.MessageMissionItemInt:
-		// TODO: save to currMission and send MISSION_REQUEST_INT
+		if msg.TargetSystem != systemID || msg.MissionType != common.MAV_MISSION_TYPE_MISSION {
+			return
+		}
+		c.handleMissionDownloadItem(node, msg.Seq, missionItemFromMessageInt(msg))
 	case *common.MessageMissionItem:
-		// TODO: save to currMission and send MISSION_REQUEST (deprecated)
+		// deprecated, but older autopilots may answer MISSION_REQUEST_INT with it
+		if msg.TargetSystem != systemID || msg.MissionType != common.MAV_MISSION_TYPE_MISSION {
+			return
+		}
+		c.handleMissionDownloadItem(node, msg.Seq, missionItemFromMessage(msg))
+	case *common.MessageMissionAck:
+		// the plane only sends MISSION_ACK during a download if something went wrong
+		if msg.TargetSystem != systemID || msg.MissionType != common.MAV_MISSION_TYPE_MISSION || msg.Type == common.MAV_MISSION_ACCEPTED {
+			return
+		}
+		result := missionResultName(msg.Type)
+		Log.Errorf("Plane aborted mission download with result %s", result)
+		c.finishMissionDownload(download, result)
 	}
 }
 
 // monitorMission will handle messages relating to the progress of the current mission
 // and which mission is currently on the plane.
 func (c *Client) monitorMission(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
-	switch evt.Frame.GetMessage().(type) {
+	if !c.isFromPlane(evt) {
+		return
+	}
+
+	switch msg := evt.Frame.GetMessage().(type) {
 	case *common.MessageMissionItemReached:
-		// TODO: save to currMissionProgress
+		c.updateMissionItemReached(msg.Seq)
+		c.writeMissionProgressToInfluxDB()
 	case *common.MessageMissionCurrent:
-		// TODO: save to currMission
+		c.updateMissionCurrent(msg.Seq)
+		c.writeMissionProgressToInfluxDB()
+	case *common.MessageGlobalPositionInt:
+		c.updateMissionPosition(msg)
 	}
 }
@@ -0,0 +1,342 @@
+package mav
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aler9/gomavlib"
+)
+
+// ErrHandlerExists is returned when registering a handler under a name that is already taken.
+var ErrHandlerExists = errors.New("an EventFrameHandler with this name is already registered")
+
+// ErrHandlerNotFound is returned when configuring a handler that is not registered.
+var ErrHandlerNotFound = errors.New("no EventFrameHandler with this name is registered")
+
+// Names of the EventFrameHandlers registered by New.
+const (
+	HandlerForward         = "forward"
+	HandlerPlaneChannel    = "plane_channel"
+	HandlerPlaneState      = "plane_state"
+	HandlerInfluxDB        = "influxdb"
+	HandlerMissionUpload   = "mission_upload"
+	HandlerMissionDownload = "mission_download"
+	HandlerMissionProgress = "mission_progress"
+	HandlerCommandAck      = "command_ack"
+	HandlerParams          = "params"
+	HandlerAntennaTracker  = "antenna_tracker"
+	HandlerBattery         = "battery"
+	HandlerLinkStats       = "link_stats"
+	HandlerLinkMonitor     = "link_monitor"
+	HandlerTlog            = "tlog"
+	HandlerTelemetryStream = "telemetry_stream"
+	HandlerLatestTelemetry = "latest_telemetry"
+)
+
+// defaultHandlerQueueSize is how many frames a queued handler can fall behind by
+// before frames are dropped for it.
+const defaultHandlerQueueSize = 256
+
+// HandlerInfo describes a registered EventFrameHandler and how it has performed.
+type HandlerInfo struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Order is the position the handler runs (or is queued) in for every frame, starting at 0
+	Order int `json:"order"`
+	// Queued is false for handlers that run on the Listen loop itself (see RegisterHandler)
+	Queued        bool   `json:"queued"`
+	QueueLength   int    `json:"queue_length"`
+	QueueCapacity int    `json:"queue_capacity"`
+	Dropped       uint64 `json:"dropped"`
+
+	Calls  uint64 `json:"calls"`
+	Panics uint64 `json:"panics"`
+	// LastPanic is the value the handler last panicked with
+	LastPanic       string  `json:"last_panic,omitempty"`
+	AvgMicroseconds float64 `json:"avg_microseconds"`
+	MaxMicroseconds float64 `json:"max_microseconds"`
+}
+
+// HandlerConfig changes whether a handler is enabled. Enabled is left unchanged if nil.
+type HandlerConfig struct {
+	Name    string `json:"name"`
+	Enabled *bool  `json:"enabled"`
+}
+
+// HandlerSettings changes the order handlers run in and whether they are enabled.
+// Handlers are only reordered if Order is given.
+type HandlerSettings struct {
+	// Order lists the handlers to run first, in the order given (see SetHandlerOrder)
+	Order    []string        `json:"order"`
+	Handlers []HandlerConfig `json:"handlers"`
+}
+
+// registeredHandler is an EventFrameHandler in the client's registry along with its stats.
+type registeredHandler struct {
+	name    string
+	handler EventFrameHandler
+	// queue holds frames waiting for the handler's own goroutine, or is nil if the
+	// handler runs on the Listen loop
+	queue chan queuedFrame
+
+	// statsMutex protects everything below, which is updated after every frame
+	statsMutex sync.Mutex
+	enabled    bool
+	calls      uint64
+	dropped    uint64
+	panics     uint64
+	lastPanic  string
+	totalTime  time.Duration
+	maxTime    time.Duration
+}
+
+// queuedFrame is a frame waiting to be handled by a queued handler.
+type queuedFrame struct {
+	evt  *gomavlib.EventFrame
+	node *gomavlib.Node
+}
+
+// RegisterHandler adds a handler that will run on the Listen loop for every incoming
+// EventFrame, after the handlers that are already registered. Every frame waits for
+// these handlers, so only use this for handlers that must never fall behind, such as
+// routing. Anything that does I/O should use RegisterQueuedHandler instead. These
+// handlers must not call SendToPlane, which waits for the Listen loop, but can write
+// to the node they are given.
+//
+// Handlers can be registered while Listen is running. Returns ErrHandlerExists if
+// the name is taken.
+func (c *Client) RegisterHandler(name string, handler EventFrameHandler) error {
+	return c.registerHandler(&registeredHandler{name: name, handler: handler, enabled: true})
+}
+
+// RegisterQueuedHandler adds a handler that runs on its own goroutine, so that it can
+// not hold up routing or the other handlers. Frames are queued for the handler in
+// the same order as for RegisterHandler. Once queueSize frames are waiting, new frames
+// are dropped for this handler and counted in HandlerInfo.Dropped.
+//
+// The node passed to a queued handler may already be closed by the time it runs, so
+// messages should be sent with SendToPlane instead. Queued handlers keep running
+// across Listen calls until the client is closed (see Close).
+func (c *Client) RegisterQueuedHandler(name string, handler EventFrameHandler, queueSize int) error {
+	if queueSize <= 0 {
+		queueSize = defaultHandlerQueueSize
+	}
+	h := &registeredHandler{name: name, handler: handler, enabled: true, queue: make(chan queuedFrame, queueSize)}
+	if err := c.registerHandler(h); err != nil {
+		return err
+	}
+	go c.runHandlerQueue(h)
+	return nil
+}
+
+func (c *Client) registerHandler(handler *registeredHandler) error {
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+
+	for _, h := range c.eventFrameHandlers {
+		if h.name == handler.name {
+			return fmt.Errorf("%w: %s", ErrHandlerExists, handler.name)
+		}
+	}
+	c.eventFrameHandlers = append(c.eventFrameHandlers, handler)
+	return nil
+}
+
+// SetHandlerEnabled turns a registered handler on or off without losing its position or stats.
+func (c *Client) SetHandlerEnabled(name string, enabled bool) error {
+	handler, err := c.findHandler(name)
+	if err != nil {
+		return err
+	}
+
+	handler.statsMutex.Lock()
+	handler.enabled = enabled
+	handler.statsMutex.Unlock()
+	Log.Infof("EventFrameHandler %s enabled: %t", name, enabled)
+	return nil
+}
+
+// SetHandlerOrder changes the order handlers run in. The named handlers run first,
+// in the given order, followed by the rest in their current order.
+func (c *Client) SetHandlerOrder(names []string) error {
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+
+	ordered := make([]*registeredHandler, 0, len(c.eventFrameHandlers))
+	placed := make(map[string]bool, len(names))
+	for _, name := range names {
+		if placed[name] {
+			return fmt.Errorf("%s is listed more than once", name)
+		}
+		found := false
+		for _, h := range c.eventFrameHandlers {
+			if h.name == name {
+				ordered = append(ordered, h)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %s", ErrHandlerNotFound, name)
+		}
+		placed[name] = true
+	}
+	for _, h := range c.eventFrameHandlers {
+		if !placed[h.name] {
+			ordered = append(ordered, h)
+		}
+	}
+
+	// replaced rather than modified so runEventFrameHandlers can keep iterating over the old slice
+	c.eventFrameHandlers = ordered
+	return nil
+}
+
+// ConfigureHandlers applies HandlerSettings: the handlers in its order are moved to
+// the front (see SetHandlerOrder) and its handler configs are enabled or disabled
+// without being moved. Nothing is changed if any of the handlers is not registered.
+func (c *Client) ConfigureHandlers(settings HandlerSettings) error {
+	for _, config := range settings.Handlers {
+		if _, err := c.findHandler(config.Name); err != nil {
+			return err
+		}
+	}
+	if len(settings.Order) > 0 {
+		if err := c.SetHandlerOrder(settings.Order); err != nil {
+			return err
+		}
+	}
+
+	for _, config := range settings.Handlers {
+		if config.Enabled == nil {
+			continue
+		}
+		if err := c.SetHandlerEnabled(config.Name, *config.Enabled); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetHandlers returns every registered handler in the order they run.
+func (c *Client) GetHandlers() []HandlerInfo {
+	c.handlersMutex.RLock()
+	handlers := c.eventFrameHandlers
+	c.handlersMutex.RUnlock()
+
+	infos := make([]HandlerInfo, 0, len(handlers))
+	for i, h := range handlers {
+		h.statsMutex.Lock()
+		info := HandlerInfo{
+			Name:            h.name,
+			Enabled:         h.enabled,
+			Order:           i,
+			Queued:          h.queue != nil,
+			QueueLength:     len(h.queue),
+			QueueCapacity:   cap(h.queue),
+			Dropped:         h.dropped,
+			Calls:           h.calls,
+			Panics:          h.panics,
+			LastPanic:       h.lastPanic,
+			MaxMicroseconds: float64(h.maxTime) / float64(time.Microsecond),
+		}
+		if h.calls > 0 {
+			info.AvgMicroseconds = float64(h.totalTime) / float64(h.calls) / float64(time.Microsecond)
+		}
+		h.statsMutex.Unlock()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// runEventFrameHandlers passes an EventFrame to every enabled handler in order,
+// either by running it right away or by adding it to the handler's queue.
+func (c *Client) runEventFrameHandlers(evt *gomavlib.EventFrame, node *gomavlib.Node) {
+	c.handlersMutex.RLock()
+	handlers := c.eventFrameHandlers
+	c.handlersMutex.RUnlock()
+
+	for _, h := range handlers {
+		h.run(c, evt, node)
+	}
+}
+
+// run calls the handler, or queues the frame for it, if the handler is enabled.
+func (h *registeredHandler) run(c *Client, evt *gomavlib.EventFrame, node *gomavlib.Node) {
+	h.statsMutex.Lock()
+	enabled := h.enabled
+	h.statsMutex.Unlock()
+	if !enabled {
+		return
+	}
+
+	if h.queue == nil {
+		h.call(c, evt, node)
+		return
+	}
+
+	select {
+	case h.queue <- queuedFrame{evt: evt, node: node}:
+	default:
+		h.statsMutex.Lock()
+		h.dropped++
+		dropped := h.dropped
+		h.statsMutex.Unlock()
+		// logging every drop would slow the Listen loop down even further
+		if dropped == 1 || dropped%1000 == 0 {
+			Log.Warnf("EventFrameHandler %s is falling behind. %d frames dropped so far", h.name, dropped)
+		}
+	}
+}
+
+// runHandlerQueue feeds a queued handler its frames until the client is closed.
+func (c *Client) runHandlerQueue(h *registeredHandler) {
+	for {
+		select {
+		case queued := <-h.queue:
+			h.call(c, queued.evt, queued.node)
+		case <-c.handlersDone:
+			return
+		}
+	}
+}
+
+// call runs the handler, recording how long it took. A panicking handler is logged
+// and counted instead of taking down the Listen loop or its queue.
+func (h *registeredHandler) call(c *Client, evt *gomavlib.EventFrame, node *gomavlib.Node) {
+	started := time.Now()
+	defer func() {
+		elapsed := time.Since(started)
+		recovered := recover()
+
+		h.statsMutex.Lock()
+		defer h.statsMutex.Unlock()
+		h.calls++
+		h.totalTime += elapsed
+		if elapsed > h.maxTime {
+			h.maxTime = elapsed
+		}
+		if recovered != nil {
+			h.panics++
+			h.lastPanic = fmt.Sprint(recovered)
+			Log.Errorf("EventFrameHandler %s panicked on message %d: %v", h.name, evt.Frame.GetMessage().GetID(), recovered)
+		}
+	}()
+
+	h.handler(c, evt, node)
+}
+
+// findHandler returns the registered handler with the given name.
+func (c *Client) findHandler(name string) (*registeredHandler, error) {
+	c.handlersMutex.RLock()
+	defer c.handlersMutex.RUnlock()
+
+	for _, h := range c.eventFrameHandlers {
+		if h.name == name {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrHandlerNotFound, name)
+}
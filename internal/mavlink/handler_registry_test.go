@@ -0,0 +1,128 @@
+package mav
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerRegistry(t *testing.T) {
+	c := &Client{}
+	calls := []string{}
+	record := func(name string) EventFrameHandler {
+		return func(*Client, *gomavlib.EventFrame, *gomavlib.Node) {
+			calls = append(calls, name)
+		}
+	}
+	require.NoError(t, c.RegisterHandler("a", record("a")))
+	require.NoError(t, c.RegisterHandler("b", record("b")))
+	require.NoError(t, c.RegisterHandler("panics", func(*Client, *gomavlib.EventFrame, *gomavlib.Node) {
+		panic("oops")
+	}))
+	require.NoError(t, c.RegisterHandler("c", record("c")))
+	assert.ErrorIs(t, c.RegisterHandler("a", record("a")), ErrHandlerExists)
+
+	evt := &gomavlib.EventFrame{Frame: &frame.V2Frame{Message: &common.MessageHeartbeat{}}}
+
+	// a panicking handler does not stop the ones after it
+	c.runEventFrameHandlers(evt, nil)
+	assert.Equal(t, []string{"a", "b", "c"}, calls)
+
+	// enabling or disabling a handler doesn't move it
+	disabled := false
+	require.NoError(t, c.ConfigureHandlers(HandlerSettings{Handlers: []HandlerConfig{{Name: "b", Enabled: &disabled}}}))
+	calls = nil
+	c.runEventFrameHandlers(evt, nil)
+	assert.Equal(t, []string{"a", "c"}, calls)
+
+	require.NoError(t, c.ConfigureHandlers(HandlerSettings{Order: []string{"c"}}))
+	calls = nil
+	c.runEventFrameHandlers(evt, nil)
+	assert.Equal(t, []string{"c", "a"}, calls)
+
+	assert.ErrorIs(t, c.ConfigureHandlers(HandlerSettings{Order: []string{"a"}, Handlers: []HandlerConfig{{Name: "missing"}}}), ErrHandlerNotFound)
+	assert.ErrorIs(t, c.ConfigureHandlers(HandlerSettings{Order: []string{"missing"}}), ErrHandlerNotFound)
+
+	handlers := c.GetHandlers()
+	require.Len(t, handlers, 4)
+	assert.Equal(t, "c", handlers[0].Name)
+	assert.Equal(t, "a", handlers[1].Name)
+	assert.Equal(t, "b", handlers[2].Name)
+	assert.False(t, handlers[2].Enabled)
+	assert.Equal(t, uint64(1), handlers[2].Calls)
+	assert.Equal(t, "panics", handlers[3].Name)
+	assert.Equal(t, uint64(3), handlers[3].Panics)
+	assert.Equal(t, "oops", handlers[3].LastPanic)
+}
+
+func TestQueuedHandlerDrops(t *testing.T) {
+	c := &Client{handlersDone: make(chan struct{})}
+	t.Cleanup(c.Close)
+
+	release := make(chan struct{})
+	handled := make(chan struct{}, 10)
+	require.NoError(t, c.RegisterQueuedHandler("slow", func(*Client, *gomavlib.EventFrame, *gomavlib.Node) {
+		<-release
+		handled <- struct{}{}
+	}, 2))
+	inlineCalls := 0
+	require.NoError(t, c.RegisterHandler("inline", func(*Client, *gomavlib.EventFrame, *gomavlib.Node) {
+		inlineCalls++
+	}))
+
+	evt := &gomavlib.EventFrame{Frame: &frame.V2Frame{Message: &common.MessageHeartbeat{}}}
+	// the first frame is taken off the queue by the blocked handler, the next two
+	// fill the queue and the last two are dropped
+	c.runEventFrameHandlers(evt, nil)
+	require.Eventually(t, func() bool { return c.GetHandlers()[0].QueueLength == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 4; i++ {
+		c.runEventFrameHandlers(evt, nil)
+	}
+	assert.Equal(t, 5, inlineCalls)
+
+	handlers := c.GetHandlers()
+	assert.True(t, handlers[0].Queued)
+	assert.Equal(t, 2, handlers[0].QueueLength)
+	assert.Equal(t, 2, handlers[0].QueueCapacity)
+	assert.Equal(t, uint64(2), handlers[0].Dropped)
+	assert.False(t, handlers[1].Queued)
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-handled
+	}
+	require.Eventually(t, func() bool { return c.GetHandlers()[0].Calls == 3 }, time.Second, time.Millisecond)
+}
+
+func TestQueuedHandlersOutliveListen(t *testing.T) {
+	port := freeUDPPort(t)
+	newTestAutopilot(t, port)
+	c := New(nil, "127.0.0.1", "1", fmt.Sprintf("udp:127.0.0.1:%d", port))
+	t.Cleanup(c.Close)
+
+	var heartbeats atomic.Int64
+	require.NoError(t, c.RegisterQueuedHandler("heartbeats", func(_ *Client, evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+		if _, ok := evt.Frame.GetMessage().(*common.MessageHeartbeat); ok {
+			heartbeats.Add(1)
+		}
+	}, 0))
+
+	for i := 0; i < 2; i++ {
+		stopped := make(chan struct{})
+		go func() {
+			c.Listen()
+			close(stopped)
+		}()
+		seen := heartbeats.Load()
+		require.Eventually(t, func() bool { return heartbeats.Load() > seen }, 5*time.Second, 20*time.Millisecond, "listen %d", i)
+		c.Kill()
+		<-stopped
+	}
+}
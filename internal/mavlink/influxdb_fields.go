@@ -0,0 +1,225 @@
+package mav
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/msg"
+)
+
+// InfluxDBMessages chooses which mavlink messages are stored in InfluxDB and how.
+type InfluxDBMessages struct {
+	// Include lists the names or IDs of the messages to store. Every message is
+	// stored if it is empty.
+	Include []string `json:"include"`
+	// Exclude lists messages that are never stored, even if they are included.
+	Exclude []string `json:"exclude"`
+	// EnumNames stores the enums Hub knows the names of, such as MAV_TYPE, as strings
+	// instead of numbers. Bitmasks such as base_mode are always stored as numbers.
+	// The HEARTBEAT and BATTERY_STATUS enums are always stored like Hub stored them
+	// before every message was stored (see keepBaselineInfluxDBFields).
+	EnumNames bool `json:"enum_names"`
+}
+
+// influxDBEnumNames maps the types of the enums Hub knows the names of to a function
+// that names their values.
+var influxDBEnumNames = map[reflect.Type]func(uint64) string{
+	reflect.TypeOf(common.MAV_TYPE(0)):           func(v uint64) string { return mavTypeName(common.MAV_TYPE(v)) },
+	reflect.TypeOf(common.MAV_STATE(0)):          func(v uint64) string { return systemStatusName(common.MAV_STATE(v)) },
+	reflect.TypeOf(common.MAV_RESULT(0)):         func(v uint64) string { return commandResultName(common.MAV_RESULT(v)) },
+	reflect.TypeOf(common.MAV_MISSION_RESULT(0)): func(v uint64) string { return missionResultName(common.MAV_MISSION_RESULT(v)) },
+	reflect.TypeOf(common.MAV_PARAM_TYPE(0)):     func(v uint64) string { return paramTypeName(common.MAV_PARAM_TYPE(v)) },
+}
+
+// autopilotNames maps MAV_AUTOPILOT values to their names in the MAVLink spec.
+// https://mavlink.io/en/messages/common.html#MAV_AUTOPILOT
+var autopilotNames = map[common.MAV_AUTOPILOT]string{
+	common.MAV_AUTOPILOT_GENERIC:       "GENERIC",
+	common.MAV_AUTOPILOT_ARDUPILOTMEGA: "ARDUPILOTMEGA",
+	common.MAV_AUTOPILOT_INVALID:       "INVALID",
+	common.MAV_AUTOPILOT_PX4:           "PX4",
+}
+
+// influxDBField is how a field of a message type is stored in InfluxDB.
+type influxDBField struct {
+	index int
+	// name is the name of the field in the MAVLink spec. The elements of arrays are
+	// stored as the singular of name followed by their index, such as voltage0.
+	name   string
+	array  bool
+	isEnum bool
+}
+
+// influxDBFieldsCache caches the fields of every message type passed to messageFields.
+var influxDBFieldsCache sync.Map // reflect.Type -> []influxDBField
+
+// SetInfluxDBMessages changes which messages are stored in InfluxDB. Returns an error
+// without changing anything if a message name is unknown.
+func (c *Client) SetInfluxDBMessages(messages InfluxDBMessages) error {
+	include, err := parseMessageList(messages.Include)
+	if err != nil {
+		return err
+	}
+	exclude, err := parseMessageList(messages.Exclude)
+	if err != nil {
+		return err
+	}
+
+	c.influxMutex.Lock()
+	defer c.influxMutex.Unlock()
+
+	c.influxMessages = messages
+	c.influxInclude = messageSet(include)
+	c.influxExclude = messageSet(exclude)
+	return nil
+}
+
+// GetInfluxDBMessages returns which messages are stored in InfluxDB.
+func (c *Client) GetInfluxDBMessages() InfluxDBMessages {
+	c.influxMutex.RLock()
+	defer c.influxMutex.RUnlock()
+
+	return c.influxMessages
+}
+
+// storesInInfluxDB reports whether a message is stored in InfluxDB and whether its
+// enums are stored as names.
+func (c *Client) storesInInfluxDB(msgID uint32) (store bool, enumNames bool) {
+	c.influxMutex.RLock()
+	defer c.influxMutex.RUnlock()
+
+	if c.influxExclude[msgID] || (len(c.influxInclude) > 0 && !c.influxInclude[msgID]) {
+		return false, false
+	}
+	return true, c.influxMessages.EnumNames
+}
+
+// influxDBFields returns the fields of a message as they are stored in InfluxDB, like
+// telemetryFields but with the fields of existing measurements kept as they were.
+func influxDBFields(m msg.Message, enumNames bool) map[string]interface{} {
+	fields := telemetryFields(m, enumNames)
+	keepBaselineInfluxDBFields(m, fields)
+	return fields
+}
+
+// keepBaselineInfluxDBFields stores the enums of the messages Hub stored before every
+// message was stored the way it stored them then, whatever EnumNames is. InfluxDB
+// rejects writes that change the type of a field, so anything else would break
+// writing to existing buckets.
+func keepBaselineInfluxDBFields(m msg.Message, fields map[string]interface{}) {
+	switch m := m.(type) {
+	case *common.MessageHeartbeat:
+		fields["type"] = "MAV_TYPE_" + mavTypeName(m.Type)
+		fields["autopilot"] = "MAV_AUTOPILOT_" + autopilotName(m.Autopilot)
+		fields["base_mode"] = uint64(m.BaseMode)
+		fields["system_status"] = "MAV_STATE_" + systemStatusName(m.SystemStatus)
+	case *common.MessageBatteryStatus:
+		fields["charge_state"] = int64(m.ChargeState)
+		fields["mode"] = int64(m.Mode)
+		fields["fault_bitmask"] = int64(m.FaultBitmask)
+	}
+}
+
+// autopilotName returns the MAVLink name of a MAV_AUTOPILOT.
+func autopilotName(autopilot common.MAV_AUTOPILOT) string {
+	if name, ok := autopilotNames[autopilot]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// messageFields returns the fields of a message as InfluxDB fields named like in the
+// MAVLink spec, such as time_boot_ms. Integers are stored as int64 or uint64 by their
+// sign, arrays are flattened to one field per element, and enums are stored as int64
+// or, with enumNames, as the names Hub knows for them.
+func messageFields(m msg.Message, enumNames bool) map[string]interface{} {
+	value := reflect.ValueOf(m).Elem()
+	fields := messageTypeFields(value.Type())
+
+	data := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		fieldValue := value.Field(field.index)
+		if !field.array {
+			data[field.name] = influxDBValue(fieldValue, field.isEnum, enumNames)
+			continue
+		}
+		for i := 0; i < fieldValue.Len(); i++ {
+			data[field.name+strconv.Itoa(i)] = influxDBValue(fieldValue.Index(i), field.isEnum, enumNames)
+		}
+	}
+	return data
+}
+
+// messageTypeFields returns how the fields of a message type are stored.
+func messageTypeFields(t reflect.Type) []influxDBField {
+	if cached, ok := influxDBFieldsCache.Load(t); ok {
+		return cached.([]influxDBField)
+	}
+
+	fields := make([]influxDBField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		field := influxDBField{
+			index:  i,
+			name:   fieldName(structField),
+			array:  structField.Type.Kind() == reflect.Array,
+			isEnum: structField.Tag.Get("mavenum") != "",
+		}
+		if field.array {
+			field.name = strings.TrimSuffix(field.name, "s")
+		}
+		fields = append(fields, field)
+	}
+	influxDBFieldsCache.Store(t, fields)
+	return fields
+}
+
+// fieldName returns the name a field of a gomavlib message has in the MAVLink spec,
+// derived the same way gomavlib derives it.
+func fieldName(field reflect.StructField) string {
+	if name := field.Tag.Get("mavname"); name != "" {
+		return name
+	}
+	name := upperCase.ReplaceAllString(field.Name, "_${1}")
+	return strings.ToLower(strings.TrimPrefix(name, "_"))
+}
+
+// influxDBValue converts the value of a field to a type InfluxDB stores natively.
+func influxDBValue(v reflect.Value, isEnum bool, enumNames bool) interface{} {
+	if isEnum {
+		if name, ok := influxDBEnumNames[v.Type()]; ok && enumNames {
+			return name(v.Uint())
+		}
+		switch v.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return int64(v.Uint())
+		default:
+			return v.Int()
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	default:
+		return v.Interface()
+	}
+}
+
+// messageSet returns a set of message IDs.
+func messageSet(ids []uint32) map[uint32]bool {
+	set := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
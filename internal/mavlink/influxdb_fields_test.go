@@ -0,0 +1,92 @@
+package mav
+
+import (
+	"testing"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageFields(t *testing.T) {
+	battery := &common.MessageBatteryStatus{
+		Id:               1,
+		BatteryFunction:  common.MAV_BATTERY_FUNCTION_ALL,
+		Type:             common.MAV_BATTERY_TYPE_LIPO,
+		CurrentBattery:   -1,
+		BatteryRemaining: 80,
+	}
+	battery.Voltages[0] = 4100
+	battery.VoltagesExt[3] = 3900
+
+	fields := messageFields(battery, true)
+	assert.Equal(t, uint64(4100), fields["voltage0"])
+	assert.Contains(t, fields, "voltage9")
+	assert.NotContains(t, fields, "voltage10")
+	assert.Equal(t, uint64(3900), fields["voltages_ext3"])
+	assert.Equal(t, uint64(1), fields["id"])
+	assert.Equal(t, int64(-1), fields["current_battery"])
+	assert.Equal(t, int64(80), fields["battery_remaining"])
+	// Hub doesn't know the names of battery types, so they stay numbers
+	assert.Equal(t, int64(common.MAV_BATTERY_TYPE_LIPO), fields["type"])
+
+	fields = messageFields(testHeartbeat, true)
+	assert.Equal(t, "FIXED_WING", fields["type"])
+	assert.Equal(t, "ACTIVE", fields["system_status"])
+	assert.Equal(t, int64(testHeartbeat.BaseMode), fields["base_mode"])
+	assert.Equal(t, uint64(10), fields["custom_mode"])
+
+	fields = messageFields(testHeartbeat, false)
+	assert.Equal(t, int64(common.MAV_TYPE_FIXED_WING), fields["type"])
+
+	fields = messageFields(&common.MessageGlobalPositionInt{TimeBootMs: 1000, Lat: 328801000}, false)
+	assert.Equal(t, uint64(1000), fields["time_boot_ms"])
+	assert.Equal(t, int64(328801000), fields["lat"])
+
+	fields = messageFields(&common.MessageAdsbVehicle{IcaoAddress: 42, Callsign: "TRITON"}, false)
+	assert.Equal(t, uint64(42), fields["ICAO_address"])
+	assert.Equal(t, "TRITON", fields["callsign"])
+
+	fields = messageFields(&common.MessageVfrHud{Airspeed: 18.5}, false)
+	assert.Equal(t, 18.5, fields["airspeed"])
+}
+
+func TestInfluxDBFields(t *testing.T) {
+	// the fields Hub stored before every message was stored keep their types
+	for _, enumNames := range []bool{true, false} {
+		fields := influxDBFields(testHeartbeat, enumNames)
+		assert.Equal(t, "MAV_TYPE_FIXED_WING", fields["type"])
+		assert.Equal(t, "MAV_AUTOPILOT_ARDUPILOTMEGA", fields["autopilot"])
+		assert.Equal(t, "MAV_STATE_ACTIVE", fields["system_status"])
+		assert.Equal(t, uint64(testHeartbeat.BaseMode), fields["base_mode"])
+		assert.Equal(t, uint64(10), fields["custom_mode"])
+		assert.Equal(t, "AUTO", fields["mode"])
+		assert.Equal(t, true, fields["armed"])
+
+		fields = influxDBFields(&common.MessageBatteryStatus{ChargeState: common.MAV_BATTERY_CHARGE_STATE_LOW}, enumNames)
+		assert.Equal(t, int64(common.MAV_BATTERY_CHARGE_STATE_LOW), fields["charge_state"])
+		assert.Equal(t, int64(0), fields["fault_bitmask"])
+	}
+}
+
+func TestSetInfluxDBMessages(t *testing.T) {
+	c := &Client{}
+	store, _ := c.storesInInfluxDB(0)
+	assert.True(t, store, "every message is stored by default")
+
+	require.NoError(t, c.SetInfluxDBMessages(InfluxDBMessages{
+		Include:   []string{"HEARTBEAT,BATTERY_STATUS"},
+		Exclude:   []string{"BATTERY_STATUS"},
+		EnumNames: true,
+	}))
+	store, enumNames := c.storesInInfluxDB((&common.MessageHeartbeat{}).GetID())
+	assert.True(t, store)
+	assert.True(t, enumNames)
+	store, _ = c.storesInInfluxDB((&common.MessageBatteryStatus{}).GetID())
+	assert.False(t, store)
+	store, _ = c.storesInInfluxDB((&common.MessageVfrHud{}).GetID())
+	assert.False(t, store)
+
+	assert.Error(t, c.SetInfluxDBMessages(InfluxDBMessages{Exclude: []string{"NOT_A_MESSAGE"}}))
+	assert.Equal(t, []string{"BATTERY_STATUS"}, c.GetInfluxDBMessages().Exclude)
+}
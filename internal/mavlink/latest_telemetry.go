@@ -0,0 +1,104 @@
+package mav
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/msg"
+)
+
+// ErrNoTelemetry is returned when asking for the latest message of a kind the plane
+// has not sent yet.
+var ErrNoTelemetry = errors.New("no telemetry of this message has been received from the plane")
+
+// ErrUnknownField is returned when asking for a field a message doesn't have.
+var ErrUnknownField = errors.New("unknown field of mavlink message")
+
+// latestMessage is the last message of a kind received from the plane. Protected by
+// latestMutex.
+type latestMessage struct {
+	message  msg.Message
+	systemID uint8
+	received time.Time
+}
+
+// GetLatestTelemetry returns the last message the plane sent with the given name or
+// ID, like it is streamed by SubscribeTelemetry. Only the given fields are returned,
+// or every field if none are given. Time is when the message was received, so its
+// age tells how stale it is.
+//
+// Returns ErrUnknownMessage if the message is not in the common dialect,
+// ErrUnknownField if it doesn't have one of the fields and ErrNoTelemetry if the
+// plane has not sent it yet.
+func (c *Client) GetLatestTelemetry(nameOrID string, fields ...string) (TelemetryUpdate, error) {
+	id, ok := MessageID(nameOrID)
+	known := telemetryFieldNames(id)
+	if !ok || known == nil {
+		return TelemetryUpdate{}, fmt.Errorf("%w %q", ErrUnknownMessage, nameOrID)
+	}
+	wanted := fieldSet(fields)
+	for field := range wanted {
+		if !known[field] {
+			return TelemetryUpdate{}, fmt.Errorf("%w %s: %q", ErrUnknownField, messageNames[id], field)
+		}
+	}
+
+	c.latestMutex.RLock()
+	latest, ok := c.latestMessages[id]
+	c.latestMutex.RUnlock()
+	if !ok {
+		return TelemetryUpdate{}, ErrNoTelemetry
+	}
+
+	update := TelemetryUpdate{
+		Message:  MessageName(latest.message),
+		ID:       id,
+		SystemID: latest.systemID,
+		Time:     latest.received,
+		Fields:   telemetryFields(latest.message, true),
+	}
+	if len(wanted) > 0 {
+		update.Fields = filterFields(update.Fields, wanted)
+	}
+	return update, nil
+}
+
+// storeLatestTelemetry keeps the last message of every kind in the common dialect
+// the plane sends for GetLatestTelemetry.
+func (c *Client) storeLatestTelemetry(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+	if !c.isFromPlane(evt) {
+		return
+	}
+	m := evt.Frame.GetMessage()
+	if _, unknown := m.(*msg.MessageRaw); unknown {
+		return
+	}
+
+	c.latestMutex.Lock()
+	defer c.latestMutex.Unlock()
+
+	c.latestMessages[m.GetID()] = latestMessage{message: m, systemID: evt.SystemID(), received: time.Now()}
+}
+
+// fieldSet returns a set of comma separated field names, lowercased.
+func fieldSet(fields []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, field := range SplitList(fields...) {
+		set[strings.ToLower(field)] = true
+	}
+	return set
+}
+
+// filterFields returns the fields of a message that are in a set made by fieldSet.
+func filterFields(fields map[string]interface{}, wanted map[string]bool) map[string]interface{} {
+	filtered := make(map[string]interface{}, len(wanted))
+	for name, value := range fields {
+		if wanted[strings.ToLower(name)] {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
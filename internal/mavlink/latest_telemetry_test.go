@@ -0,0 +1,46 @@
+package mav
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestTelemetry(t *testing.T) {
+	port := freeUDPPort(t)
+	newTestAutopilot(t, port)
+	c := newTestClient(t, port)
+
+	var update TelemetryUpdate
+	require.Eventually(t, func() bool {
+		var err error
+		update, err = c.GetLatestTelemetry("33", "lat,lon")
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "GLOBAL_POSITION_INT", update.Message)
+	assert.Len(t, update.Fields, 2)
+	assert.Less(t, time.Since(update.Time), time.Second)
+
+	// the store keeps up with the plane
+	require.Eventually(t, func() bool {
+		latest, err := c.GetLatestTelemetry("global_position_int")
+		return err == nil && latest.Time.After(update.Time) && latest.Fields["lat"] != update.Fields["lat"]
+	}, 5*time.Second, 20*time.Millisecond)
+
+	heartbeat, err := c.GetLatestTelemetry("HEARTBEAT")
+	require.NoError(t, err)
+	assert.Equal(t, "MANUAL", heartbeat.Fields["mode"])
+
+	_, err = c.GetLatestTelemetry("MISSION_ITEM_INT")
+	assert.ErrorIs(t, err, ErrNoTelemetry)
+	_, err = c.GetLatestTelemetry("NOT_A_MESSAGE")
+	assert.ErrorIs(t, err, ErrUnknownMessage)
+	_, err = c.GetLatestTelemetry("60000")
+	assert.ErrorIs(t, err, ErrUnknownMessage)
+	_, err = c.GetLatestTelemetry("MISSION_ITEM_INT", "seq,altitude")
+	assert.ErrorIs(t, err, ErrUnknownField)
+	_, err = c.GetLatestTelemetry("HEARTBEAT", "Mode,armed")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,249 @@
+package mav
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrInvalidLinkTimeouts is returned by SetLinkTimeouts when the timeouts don't make sense.
+var ErrInvalidLinkTimeouts = errors.New("link timeouts must be above 0 and the lost timeout must be longer than the degraded timeout")
+
+// linkCheckPeriod is how often the link monitor looks for systems whose heartbeats stopped.
+const linkCheckPeriod = 500 * time.Millisecond
+
+// mavTypeNames maps the MAV_TYPEs of the systems Hub is likely to hear from to their
+// names in the MAVLink spec. https://mavlink.io/en/messages/common.html#MAV_TYPE
+var mavTypeNames = map[common.MAV_TYPE]string{
+	common.MAV_TYPE_GENERIC:            "GENERIC",
+	common.MAV_TYPE_FIXED_WING:         "FIXED_WING",
+	common.MAV_TYPE_QUADROTOR:          "QUADROTOR",
+	common.MAV_TYPE_HEXAROTOR:          "HEXAROTOR",
+	common.MAV_TYPE_OCTOROTOR:          "OCTOROTOR",
+	common.MAV_TYPE_VTOL_TILTROTOR:     "VTOL_TILTROTOR",
+	common.MAV_TYPE_ANTENNA_TRACKER:    "ANTENNA_TRACKER",
+	common.MAV_TYPE_GCS:                "GCS",
+	common.MAV_TYPE_ONBOARD_CONTROLLER: "ONBOARD_CONTROLLER",
+	common.MAV_TYPE_GIMBAL:             "GIMBAL",
+	common.MAV_TYPE_ADSB:               "ADSB",
+	common.MAV_TYPE_CAMERA:             "CAMERA",
+}
+
+// LinkState is the health of the link to a system, judged by how long ago its last
+// HEARTBEAT arrived.
+type LinkState string
+
+// States of a link. Systems send a HEARTBEAT every second, so a link is degraded once
+// a few heartbeats in a row are missed and lost once they stop arriving altogether.
+const (
+	LinkConnected LinkState = "connected"
+	LinkDegraded  LinkState = "degraded"
+	LinkLost      LinkState = "lost"
+)
+
+// LinkTimeouts are how long after the last HEARTBEAT a link counts as degraded or lost.
+type LinkTimeouts struct {
+	Degraded time.Duration
+	Lost     time.Duration
+}
+
+// DefaultLinkTimeouts are used until SetLinkTimeouts is called.
+var DefaultLinkTimeouts = LinkTimeouts{Degraded: 3 * time.Second, Lost: 10 * time.Second}
+
+// SystemLink is the health of the link to a system that has sent a HEARTBEAT.
+type SystemLink struct {
+	SystemID    uint8 `json:"system_id"`
+	ComponentID uint8 `json:"component_id"`
+	// Type is the MAV_TYPE of the system, such as "FIXED_WING" or "GCS"
+	Type string `json:"type"`
+	// Plane is true for the system Hub talks to as the plane
+	Plane bool      `json:"plane"`
+	State LinkState `json:"state"`
+	// Channel is the channel the last HEARTBEAT arrived on
+	Channel               string    `json:"channel"`
+	LastHeartbeat         time.Time `json:"last_heartbeat"`
+	SecondsSinceHeartbeat float64   `json:"seconds_since_heartbeat"`
+}
+
+// systemLink is what the link monitor knows about a system. Protected by linkMutex.
+type systemLink struct {
+	componentID   uint8
+	mavType       common.MAV_TYPE
+	plane         bool
+	channel       string
+	lastHeartbeat time.Time
+	// state is the state that was last logged, which lags behind the actual state
+	// by up to linkCheckPeriod
+	state LinkState
+}
+
+// SetLinkTimeouts changes how long after the last HEARTBEAT links count as degraded or lost.
+func (c *Client) SetLinkTimeouts(timeouts LinkTimeouts) error {
+	if timeouts.Degraded <= 0 || timeouts.Lost <= timeouts.Degraded {
+		return ErrInvalidLinkTimeouts
+	}
+
+	c.linkMutex.Lock()
+	defer c.linkMutex.Unlock()
+
+	c.linkTimeouts = timeouts
+	return nil
+}
+
+// GetLinkTimeouts returns how long after the last HEARTBEAT links count as degraded or lost.
+func (c *Client) GetLinkTimeouts() LinkTimeouts {
+	c.linkMutex.Lock()
+	defer c.linkMutex.Unlock()
+
+	return c.linkTimeouts
+}
+
+// GetSystemLinks returns the link health of every system a HEARTBEAT has been
+// received from, sorted by system ID.
+func (c *Client) GetSystemLinks() []SystemLink {
+	return c.systemLinks(time.Now())
+}
+
+// GetPlaneLink returns the link health of the plane. The second return value is
+// false if no HEARTBEAT has been received from the plane yet.
+func (c *Client) GetPlaneLink() (SystemLink, bool) {
+	var planeLink SystemLink
+	found := false
+	for _, link := range c.systemLinks(time.Now()) {
+		if link.Plane && (!found || link.LastHeartbeat.After(planeLink.LastHeartbeat)) {
+			planeLink, found = link, true
+		}
+	}
+	return planeLink, found
+}
+
+// IsConnectedToPlane reports whether the plane's heartbeats are still arriving, even
+// if some are missed. It is false before the first HEARTBEAT from the plane and once
+// its link is lost.
+func (c *Client) IsConnectedToPlane() bool {
+	link, ok := c.GetPlaneLink()
+	return ok && link.State != LinkLost
+}
+
+// recordHeartbeat notes the time a system's HEARTBEAT arrived.
+func (c *Client) recordHeartbeat(evt *gomavlib.EventFrame, heartbeat *common.MessageHeartbeat, now time.Time) {
+	plane := c.isFromPlane(evt)
+
+	c.linkMutex.Lock()
+	defer c.linkMutex.Unlock()
+
+	link, ok := c.heartbeats[evt.SystemID()]
+	if !ok {
+		link = &systemLink{state: LinkLost}
+		c.heartbeats[evt.SystemID()] = link
+	}
+	link.componentID = evt.ComponentID()
+	link.mavType = heartbeat.Type
+	link.plane = link.plane || plane
+	link.channel = evt.Channel.String()
+	link.lastHeartbeat = now
+	if link.state != LinkConnected {
+		// the plane may have rebooted and forgotten its message rates. Finding it in
+		// the first place is handled by setPlaneChannel.
+		if ok && plane {
+			c.requestMessageRates()
+		}
+		logLinkState(evt.SystemID(), link, LinkConnected, 0)
+	}
+}
+
+// checkLinks logs every link whose state changed since the last check.
+func (c *Client) checkLinks(now time.Time) {
+	c.linkMutex.Lock()
+	defer c.linkMutex.Unlock()
+
+	for systemID, link := range c.heartbeats {
+		since := now.Sub(link.lastHeartbeat)
+		if state := c.linkState(since); state != link.state {
+			logLinkState(systemID, link, state, since)
+		}
+	}
+}
+
+// monitorLinks checks the state of every link every linkCheckPeriod until the client is closed.
+func (c *Client) monitorLinks() {
+	ticker := time.NewTicker(linkCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			c.checkLinks(now)
+		case <-c.handlersDone:
+			return
+		}
+	}
+}
+
+// systemLinks returns the links of every system as they are at the given time.
+func (c *Client) systemLinks(now time.Time) []SystemLink {
+	c.linkMutex.Lock()
+	defer c.linkMutex.Unlock()
+
+	links := make([]SystemLink, 0, len(c.heartbeats))
+	for systemID, link := range c.heartbeats {
+		since := now.Sub(link.lastHeartbeat)
+		links = append(links, SystemLink{
+			SystemID:              systemID,
+			ComponentID:           link.componentID,
+			Type:                  mavTypeName(link.mavType),
+			Plane:                 link.plane,
+			State:                 c.linkState(since),
+			Channel:               link.channel,
+			LastHeartbeat:         link.lastHeartbeat,
+			SecondsSinceHeartbeat: since.Seconds(),
+		})
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].SystemID < links[j].SystemID
+	})
+	return links
+}
+
+// linkState returns the state of a link whose last HEARTBEAT arrived a while ago.
+// Must be called with linkMutex locked.
+func (c *Client) linkState(sinceHeartbeat time.Duration) LinkState {
+	switch {
+	case sinceHeartbeat >= c.linkTimeouts.Lost:
+		return LinkLost
+	case sinceHeartbeat >= c.linkTimeouts.Degraded:
+		return LinkDegraded
+	default:
+		return LinkConnected
+	}
+}
+
+// mavTypeName returns the MAVLink name of a MAV_TYPE.
+func mavTypeName(mavType common.MAV_TYPE) string {
+	if name, ok := mavTypeNames[mavType]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// logLinkState records and logs a change in the state of a link.
+func logLinkState(systemID uint8, link *systemLink, state LinkState, sinceHeartbeat time.Duration) {
+	entry := Log.WithFields(logrus.Fields{
+		"event":     "link_state",
+		"system_id": systemID,
+		"plane":     link.plane,
+		"from":      link.state,
+		"to":        state,
+	})
+	switch state {
+	case LinkConnected:
+		entry.Infof("Receiving heartbeats from system %d on %s", systemID, link.channel)
+	default:
+		entry.Warnf("Link to system %d is %s. Last heartbeat was %.1f seconds ago", systemID, state, sinceHeartbeat.Seconds())
+	}
+	link.state = state
+}
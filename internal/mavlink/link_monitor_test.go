@@ -0,0 +1,57 @@
+package mav
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkMonitor(t *testing.T) {
+	c := &Client{linkTimeouts: DefaultLinkTimeouts, heartbeats: make(map[uint8]*systemLink)}
+	planeChannel, gcsChannel := &gomavlib.Channel{}, &gomavlib.Channel{}
+	c.setPlaneChannel(planeChannel, 1, 1)
+
+	_, ok := c.GetPlaneLink()
+	assert.False(t, ok)
+	assert.False(t, c.IsConnectedToPlane())
+
+	start := time.Now()
+	heartbeat := func(channel *gomavlib.Channel, systemID uint8, mavType common.MAV_TYPE, at time.Time) {
+		msg := &common.MessageHeartbeat{Type: mavType}
+		evt := &gomavlib.EventFrame{Frame: &frame.V2Frame{SystemID: systemID, ComponentID: 1, Message: msg}, Channel: channel}
+		c.recordHeartbeat(evt, msg, at)
+	}
+	heartbeat(planeChannel, 1, common.MAV_TYPE_FIXED_WING, start)
+	heartbeat(gcsChannel, 255, common.MAV_TYPE_GCS, start.Add(2*time.Second))
+
+	links := c.systemLinks(start.Add(time.Second))
+	require.Len(t, links, 2)
+	assert.Equal(t, uint8(1), links[0].SystemID)
+	assert.True(t, links[0].Plane)
+	assert.Equal(t, "FIXED_WING", links[0].Type)
+	assert.Equal(t, LinkConnected, links[0].State)
+	assert.False(t, links[1].Plane)
+
+	links = c.systemLinks(start.Add(4 * time.Second))
+	assert.Equal(t, LinkDegraded, links[0].State)
+	assert.Equal(t, 4.0, links[0].SecondsSinceHeartbeat)
+	assert.Equal(t, LinkConnected, links[1].State)
+
+	c.checkLinks(start.Add(11 * time.Second))
+	assert.Equal(t, LinkLost, c.heartbeats[1].state)
+	assert.Equal(t, LinkDegraded, c.heartbeats[255].state)
+
+	// heartbeats arriving again reconnect the link
+	heartbeat(planeChannel, 1, common.MAV_TYPE_FIXED_WING, start.Add(12*time.Second))
+	assert.Equal(t, LinkConnected, c.heartbeats[1].state)
+	assert.Equal(t, LinkConnected, c.systemLinks(start.Add(12 * time.Second))[0].State)
+
+	assert.ErrorIs(t, c.SetLinkTimeouts(LinkTimeouts{Degraded: 5 * time.Second, Lost: 5 * time.Second}), ErrInvalidLinkTimeouts)
+	require.NoError(t, c.SetLinkTimeouts(LinkTimeouts{Degraded: time.Second, Lost: 2 * time.Second}))
+	assert.Equal(t, LinkLost, c.systemLinks(start.Add(14 * time.Second))[0].State)
+}
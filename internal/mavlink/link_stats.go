@@ -0,0 +1,430 @@
+package mav
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/frame"
+	"github.com/aler9/gomavlib/pkg/msg"
+)
+
+// linkStatsWindow is how often the rates of every link are recalculated and written
+// to InfluxDB.
+const linkStatsWindow = 5 * time.Second
+
+// Sizes of everything in a frame other than its payload, in bytes.
+const (
+	v1FrameOverhead  = 8  // magic, length, sequence, system, component, message ID, checksum
+	v2FrameOverhead  = 12 // v1 plus incompatibility and compatibility flags and a 3 byte message ID
+	v2SignatureBytes = 13
+)
+
+// maxSequenceGap is the largest jump in sequence numbers that counts as lost frames.
+// Bigger jumps go backwards, so the frame arrived late.
+const maxSequenceGap = 128
+
+// radioStatusUnknown is the value a radio reports for an RSSI or noise level it doesn't know.
+const radioStatusUnknown = 255
+
+// LinkStats describes the traffic received on a channel. Rates are averaged over
+// the last few seconds, while counts are totals since the channel opened.
+type LinkStats struct {
+	Endpoint string `json:"endpoint"`
+	// Channel tells apart the channels of server endpoints, such as the address of a
+	// client connected to a tcpin endpoint
+	Channel string    `json:"channel"`
+	Opened  time.Time `json:"opened"`
+
+	Frames          uint64  `json:"frames"`
+	Bytes           uint64  `json:"bytes"`
+	FramesPerSecond float64 `json:"frames_per_second"`
+	BytesPerSecond  float64 `json:"bytes_per_second"`
+	// ParseErrors counts data on the link that could not be decoded into a frame,
+	// such as frames with bad checksums
+	ParseErrors    uint64 `json:"parse_errors"`
+	LastParseError string `json:"last_parse_error,omitempty"`
+
+	Messages []MessageStats    `json:"messages"`
+	Systems  []SystemLinkStats `json:"systems"`
+	// Radio is the latest RADIO_STATUS received on the link, if any
+	Radio *RadioStatus `json:"radio,omitempty"`
+}
+
+// MessageStats counts the frames of one message received on a link.
+type MessageStats struct {
+	ID uint32 `json:"id"`
+	// Name is empty for messages that are not in the common dialect
+	Name      string  `json:"name"`
+	Count     uint64  `json:"count"`
+	PerSecond float64 `json:"per_second"`
+}
+
+// SystemLinkStats estimates the packet loss between a system and Hub from gaps in
+// the sequence numbers of the frames it sends.
+type SystemLinkStats struct {
+	SystemID    uint8   `json:"system_id"`
+	ComponentID uint8   `json:"component_id"`
+	Received    uint64  `json:"received"`
+	Lost        uint64  `json:"lost"`
+	LossPercent float64 `json:"loss_percent"`
+}
+
+// RadioStatus is the signal quality reported by a telemetry radio in RADIO_STATUS.
+// RSSI and noise are in device dependent units, which are about 2x dB on SiK radios,
+// and are nil when the radio does not know them.
+type RadioStatus struct {
+	Rssi        *uint8    `json:"rssi"`
+	RemoteRssi  *uint8    `json:"remote_rssi"`
+	Noise       *uint8    `json:"noise"`
+	RemoteNoise *uint8    `json:"remote_noise"`
+	TxBuffer    uint8     `json:"tx_buffer"`
+	RxErrors    uint16    `json:"rx_errors"`
+	Fixed       uint16    `json:"fixed"`
+	Updated     time.Time `json:"updated"`
+}
+
+// linkStats is the traffic counted on one channel. Protected by linkStatsMutex.
+type linkStats struct {
+	endpoint string
+	channel  string
+	opened   time.Time
+
+	frames         uint64
+	bytes          uint64
+	parseErrors    uint64
+	lastParseError string
+	messages       map[uint32]*messageStats
+	sequences      map[systemComponent]*sequenceStats
+	radio          *RadioStatus
+
+	// counts since windowStart, which become the rates when the window ends
+	windowStart     time.Time
+	windowFrames    uint64
+	windowBytes     uint64
+	framesPerSecond float64
+	bytesPerSecond  float64
+}
+
+type messageStats struct {
+	name        string
+	count       uint64
+	windowCount uint64
+	perSecond   float64
+}
+
+type systemComponent struct {
+	systemID    uint8
+	componentID uint8
+}
+
+type sequenceStats struct {
+	last     uint8
+	received uint64
+	lost     uint64
+}
+
+// GetLinkStats returns the traffic statistics of every open channel, sorted by endpoint.
+func (c *Client) GetLinkStats() []LinkStats {
+	c.linkStatsMutex.Lock()
+	defer c.linkStatsMutex.Unlock()
+
+	stats := make([]LinkStats, 0, len(c.linkStats))
+	for _, ls := range c.linkStats {
+		stats = append(stats, ls.export())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Endpoint != stats[j].Endpoint {
+			return stats[i].Endpoint < stats[j].Endpoint
+		}
+		return stats[i].Channel < stats[j].Channel
+	})
+	return stats
+}
+
+// resetLinkStats forgets the statistics of every channel when a new node is created.
+func (c *Client) resetLinkStats() {
+	c.linkStatsMutex.Lock()
+	defer c.linkStatsMutex.Unlock()
+
+	c.linkStats = make(map[*gomavlib.Channel]*linkStats)
+}
+
+// openLinkStats starts counting the traffic of a channel that just opened.
+func (c *Client) openLinkStats(channel *gomavlib.Channel) {
+	endpoint, _ := StringifyEndpoint(channel.Endpoint().Conf()) //nolint: errcheck
+	now := time.Now()
+
+	c.linkStatsMutex.Lock()
+	defer c.linkStatsMutex.Unlock()
+
+	c.linkStats[channel] = &linkStats{
+		endpoint:    endpoint,
+		channel:     channel.String(),
+		opened:      now,
+		messages:    make(map[uint32]*messageStats),
+		sequences:   make(map[systemComponent]*sequenceStats),
+		windowStart: now,
+	}
+}
+
+// closeLinkStats stops counting the traffic of a channel that closed.
+func (c *Client) closeLinkStats(channel *gomavlib.Channel) {
+	c.linkStatsMutex.Lock()
+	defer c.linkStatsMutex.Unlock()
+
+	delete(c.linkStats, channel)
+}
+
+// recordParseError counts data on a channel that gomavlib could not decode.
+func (c *Client) recordParseError(channel *gomavlib.Channel, err error) {
+	c.linkStatsMutex.Lock()
+	defer c.linkStatsMutex.Unlock()
+
+	if ls, ok := c.linkStats[channel]; ok {
+		ls.parseErrors++
+		ls.lastParseError = err.Error()
+	}
+}
+
+// recordFrame counts a frame received on a channel. Frames from channels that have
+// already closed are ignored.
+func (c *Client) recordFrame(evt *gomavlib.EventFrame, now time.Time) {
+	size := frameSize(evt.Frame)
+
+	c.linkStatsMutex.Lock()
+	defer c.linkStatsMutex.Unlock()
+
+	ls, ok := c.linkStats[evt.Channel]
+	if !ok {
+		return
+	}
+	ls.frames++
+	ls.bytes += size
+	ls.windowFrames++
+	ls.windowBytes += size
+
+	m := evt.Frame.GetMessage()
+	ms, ok := ls.messages[m.GetID()]
+	if !ok {
+		ms = &messageStats{}
+		if _, unknown := m.(*msg.MessageRaw); !unknown {
+			ms.name = MessageName(m)
+		}
+		ls.messages[m.GetID()] = ms
+	}
+	ms.count++
+	ms.windowCount++
+
+	key := systemComponent{systemID: evt.SystemID(), componentID: evt.ComponentID()}
+	sequence := frameSequence(evt.Frame)
+	if ss, ok := ls.sequences[key]; ok {
+		// sequence numbers are a byte, so they wrap around from 255 to 0. A repeated
+		// sequence number is a duplicate rather than 255 lost frames, and a jump of
+		// more than half the range is a late frame rather than over 128 lost frames.
+		switch gap := sequence - ss.last; {
+		case gap == 0:
+		case gap > maxSequenceGap:
+			// the late frame was counted as lost when the frames after it arrived
+			if ss.lost > 0 {
+				ss.lost--
+			}
+		default:
+			ss.lost += uint64(gap - 1)
+			ss.last = sequence
+		}
+		ss.received++
+	} else {
+		ls.sequences[key] = &sequenceStats{last: sequence, received: 1}
+	}
+
+	if radio, ok := m.(*common.MessageRadioStatus); ok {
+		ls.radio = &RadioStatus{
+			Rssi:        radioLevel(radio.Rssi),
+			RemoteRssi:  radioLevel(radio.Remrssi),
+			Noise:       radioLevel(radio.Noise),
+			RemoteNoise: radioLevel(radio.Remnoise),
+			TxBuffer:    radio.Txbuf,
+			RxErrors:    radio.Rxerrors,
+			Fixed:       radio.Fixed,
+			Updated:     now,
+		}
+	}
+}
+
+// updateLinkRates ends the current window of every channel, turning the counts
+// since the window started into rates.
+func (c *Client) updateLinkRates(now time.Time) []LinkStats {
+	c.linkStatsMutex.Lock()
+	defer c.linkStatsMutex.Unlock()
+
+	stats := make([]LinkStats, 0, len(c.linkStats))
+	for _, ls := range c.linkStats {
+		elapsed := now.Sub(ls.windowStart).Seconds()
+		if elapsed <= 0 {
+			continue
+		}
+		ls.framesPerSecond = float64(ls.windowFrames) / elapsed
+		ls.bytesPerSecond = float64(ls.windowBytes) / elapsed
+		for _, ms := range ls.messages {
+			ms.perSecond = float64(ms.windowCount) / elapsed
+			ms.windowCount = 0
+		}
+		ls.windowFrames, ls.windowBytes = 0, 0
+		ls.windowStart = now
+		stats = append(stats, ls.export())
+	}
+	return stats
+}
+
+// monitorLinkStats updates the rates of every link and writes them to InfluxDB
+// every linkStatsWindow until the client is closed.
+func (c *Client) monitorLinkStats() {
+	ticker := time.NewTicker(linkStatsWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			stats := c.updateLinkRates(now)
+			if c.influxdbClient != nil && c.influxdbClient.IsConnected() {
+				for _, ls := range stats {
+					c.writeLinkStatsToInfluxDB(ls)
+				}
+			}
+		case <-c.handlersDone:
+			return
+		}
+	}
+}
+
+// writeLinkStatsToInfluxDB writes the stats of a link as a point of the mavlink_link
+// measurement, tagged with its endpoint and channel.
+func (c *Client) writeLinkStatsToInfluxDB(ls LinkStats) {
+	data := map[string]interface{}{
+		"frames":            ls.Frames,
+		"bytes":             ls.Bytes,
+		"frames_per_second": ls.FramesPerSecond,
+		"bytes_per_second":  ls.BytesPerSecond,
+		"parse_errors":      ls.ParseErrors,
+	}
+	var received, lost uint64
+	for _, s := range ls.Systems {
+		received += s.Received
+		lost += s.Lost
+	}
+	data["lost"] = lost
+	if received+lost > 0 {
+		data["loss_percent"] = lossPercent(received, lost)
+	}
+	if ls.Radio != nil {
+		for name, level := range map[string]*uint8{
+			"rssi":         ls.Radio.Rssi,
+			"remote_rssi":  ls.Radio.RemoteRssi,
+			"noise":        ls.Radio.Noise,
+			"remote_noise": ls.Radio.RemoteNoise,
+		} {
+			if level != nil {
+				data[name] = uint64(*level)
+			}
+		}
+		data["rx_errors"] = uint64(ls.Radio.RxErrors)
+		data["fixed"] = uint64(ls.Radio.Fixed)
+		data["tx_buffer"] = uint64(ls.Radio.TxBuffer)
+	}
+
+	tags := map[string]string{"endpoint": ls.Endpoint, "channel": ls.Channel}
+	if err := c.influxdbClient.WriteTagged("mavlink_link", tags, data); err != nil {
+		Log.Errorf("Cannot write link stats of %s to InfluxDB. Reason: %s", ls.Channel, err.Error())
+	}
+}
+
+// export copies the stats of a link. Must be called with linkStatsMutex locked.
+func (ls *linkStats) export() LinkStats {
+	stats := LinkStats{
+		Endpoint:        ls.endpoint,
+		Channel:         ls.channel,
+		Opened:          ls.opened,
+		Frames:          ls.frames,
+		Bytes:           ls.bytes,
+		FramesPerSecond: ls.framesPerSecond,
+		BytesPerSecond:  ls.bytesPerSecond,
+		ParseErrors:     ls.parseErrors,
+		LastParseError:  ls.lastParseError,
+		Messages:        make([]MessageStats, 0, len(ls.messages)),
+		Systems:         make([]SystemLinkStats, 0, len(ls.sequences)),
+	}
+	for id, ms := range ls.messages {
+		stats.Messages = append(stats.Messages, MessageStats{ID: id, Name: ms.name, Count: ms.count, PerSecond: ms.perSecond})
+	}
+	sort.Slice(stats.Messages, func(i, j int) bool {
+		return stats.Messages[i].ID < stats.Messages[j].ID
+	})
+	for key, ss := range ls.sequences {
+		stats.Systems = append(stats.Systems, SystemLinkStats{
+			SystemID:    key.systemID,
+			ComponentID: key.componentID,
+			Received:    ss.received,
+			Lost:        ss.lost,
+			LossPercent: lossPercent(ss.received, ss.lost),
+		})
+	}
+	sort.Slice(stats.Systems, func(i, j int) bool {
+		if stats.Systems[i].SystemID != stats.Systems[j].SystemID {
+			return stats.Systems[i].SystemID < stats.Systems[j].SystemID
+		}
+		return stats.Systems[i].ComponentID < stats.Systems[j].ComponentID
+	})
+	if ls.radio != nil {
+		radio := *ls.radio
+		stats.Radio = &radio
+	}
+	return stats
+}
+
+// lossPercent is the percentage of frames that were lost.
+func lossPercent(received uint64, lost uint64) float64 {
+	if received+lost == 0 {
+		return 0
+	}
+	return 100 * float64(lost) / float64(received+lost)
+}
+
+// radioLevel returns nil for RSSI and noise levels the radio doesn't know.
+func radioLevel(level uint8) *uint8 {
+	if level == radioStatusUnknown {
+		return nil
+	}
+	return &level
+}
+
+// frameSequence returns the sequence number of a frame.
+func frameSequence(f frame.Frame) uint8 {
+	switch f := f.(type) {
+	case *frame.V1Frame:
+		return f.SequenceID
+	case *frame.V2Frame:
+		return f.SequenceID
+	}
+	return 0
+}
+
+// frameSize returns how many bytes a frame took up on the link by encoding its
+// message again.
+func frameSize(f frame.Frame) uint64 {
+	v2, isV2 := f.(*frame.V2Frame)
+	overhead := uint64(v1FrameOverhead)
+	if isV2 {
+		overhead = v2FrameOverhead
+		if v2.IsSigned() {
+			overhead += v2SignatureBytes
+		}
+	}
+
+	payload, err := encodePayload(f)
+	if err != nil {
+		return overhead
+	}
+	return overhead + uint64(len(payload))
+}
@@ -0,0 +1,75 @@
+package mav
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkStats(t *testing.T) {
+	c := &Client{}
+	c.resetLinkStats()
+	channel := &gomavlib.Channel{}
+	start := time.Now()
+	c.linkStats[channel] = &linkStats{
+		messages:    make(map[uint32]*messageStats),
+		sequences:   make(map[systemComponent]*sequenceStats),
+		windowStart: start,
+	}
+
+	heartbeat := &common.MessageHeartbeat{MavlinkVersion: 3}
+	// sequence numbers 250 to 5, wrapping around, with 2 lost and 253 arriving late
+	for _, sequence := range []uint8{250, 251, 252, 254, 255, 0, 1, 3, 253, 4, 5} {
+		c.recordFrame(&gomavlib.EventFrame{
+			Frame:   &frame.V2Frame{SequenceID: sequence, SystemID: 1, ComponentID: 1, Message: heartbeat},
+			Channel: channel,
+		}, start)
+	}
+	c.recordFrame(&gomavlib.EventFrame{
+		Frame:   &frame.V2Frame{SystemID: 51, ComponentID: 68, Message: &common.MessageRadioStatus{Rssi: 180, Remrssi: 255, Noise: 40, Remnoise: 38, Rxerrors: 2}},
+		Channel: channel,
+	}, start)
+	c.recordParseError(channel, errors.New("wrong checksum"))
+	// frames from channels that closed are ignored
+	c.recordFrame(&gomavlib.EventFrame{Frame: &frame.V2Frame{Message: heartbeat}, Channel: &gomavlib.Channel{}}, start)
+
+	stats := c.updateLinkRates(start.Add(2 * time.Second))
+	require.Len(t, stats, 1)
+	ls := stats[0]
+	assert.Equal(t, uint64(12), ls.Frames)
+	assert.Equal(t, 6.0, ls.FramesPerSecond)
+	assert.Equal(t, uint64(1), ls.ParseErrors)
+	assert.Equal(t, "wrong checksum", ls.LastParseError)
+
+	require.Len(t, ls.Messages, 2)
+	assert.Equal(t, MessageStats{ID: 0, Name: "HEARTBEAT", Count: 11, PerSecond: 5.5}, ls.Messages[0])
+	assert.Equal(t, "RADIO_STATUS", ls.Messages[1].Name)
+
+	require.Len(t, ls.Systems, 2)
+	assert.Equal(t, SystemLinkStats{SystemID: 1, ComponentID: 1, Received: 11, Lost: 1, LossPercent: 100 * 1.0 / 12}, ls.Systems[0])
+
+	require.NotNil(t, ls.Radio)
+	assert.Equal(t, uint8(180), *ls.Radio.Rssi)
+	assert.Nil(t, ls.Radio.RemoteRssi)
+	assert.Equal(t, uint16(2), ls.Radio.RxErrors)
+
+	// the window restarts once rates are calculated
+	stats = c.updateLinkRates(start.Add(4 * time.Second))
+	assert.Equal(t, 0.0, stats[0].FramesPerSecond)
+	assert.Equal(t, uint64(12), stats[0].Frames)
+	assert.Equal(t, stats, c.GetLinkStats())
+}
+
+func TestFrameSize(t *testing.T) {
+	heartbeat := &common.MessageHeartbeat{MavlinkVersion: 3}
+	assert.Equal(t, uint64(12+9), frameSize(&frame.V2Frame{Message: heartbeat}))
+	assert.Equal(t, uint64(8+9), frameSize(&frame.V1Frame{Message: heartbeat}))
+	// mavlink 2 leaves out zeros at the end of the payload
+	assert.Equal(t, uint64(12+1), frameSize(&frame.V2Frame{Message: &common.MessageHeartbeat{}}))
+}
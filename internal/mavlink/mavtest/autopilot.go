@@ -0,0 +1,552 @@
+// Package mavtest provides a fake ArduPlane autopilot for testing Hub's mavlink
+// client and the routes built on it without a plane or SITL.
+package mavtest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/msg"
+)
+
+// ArduPlane custom modes the autopilot switches to on its own.
+const (
+	ModeManual uint32 = 0
+	ModeAuto   uint32 = 10
+	ModeRTL    uint32 = 11
+	ModeGuided uint32 = 15
+)
+
+const (
+	defaultHeartbeatPeriod = time.Second
+	defaultTelemetryPeriod = 100 * time.Millisecond
+)
+
+// AutopilotConf configures an Autopilot. Only Address is required.
+type AutopilotConf struct {
+	// Address is the UDP address the autopilot listens on, such as "127.0.0.1:14550".
+	// The client finds it with the endpoint "udp:127.0.0.1:14550".
+	Address string
+	// SystemID defaults to 1
+	SystemID uint8
+	// HeartbeatPeriod defaults to 1 second like ArduPlane. Tests that wait for the
+	// plane to be found can make it shorter.
+	HeartbeatPeriod time.Duration
+	// TelemetryPeriod is how often GLOBAL_POSITION_INT, ATTITUDE, VFR_HUD and
+	// BATTERY_STATUS are sent. Defaults to 100ms.
+	TelemetryPeriod time.Duration
+	// Trajectory is the path the plane flies. Defaults to DefaultTrajectory.
+	Trajectory Trajectory
+	// Battery is the battery the plane flies on. Defaults to DefaultBattery.
+	Battery *Battery
+}
+
+// Autopilot is a fake ArduPlane autopilot on a loopback UDP endpoint. It streams
+// telemetry along a scripted trajectory and answers the mission upload/download,
+// command and parameter protocols well enough for Hub's client to be tested end to
+// end. Its answers can be changed to test how the client handles failures.
+//
+// Every method is safe to call while the autopilot is running.
+type Autopilot struct {
+	conf      AutopilotConf
+	node      *gomavlib.Node
+	started   time.Time
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mutex      sync.Mutex
+	armed      bool
+	customMode uint32
+
+	items         []*common.MessageMissionItemInt
+	uploadCount   int
+	countsIgnored int
+	ignoreCounts  int
+	missionResult common.MAV_MISSION_RESULT
+	missionAcks   []common.MAV_MISSION_RESULT
+
+	commands        []*common.MessageCommandLong
+	commandInts     []*common.MessageCommandInt
+	commandsIgnored int
+	ignoreCommands  int
+	commandResult   common.MAV_RESULT
+	inProgressFirst bool
+	intervals       map[uint32]int32
+
+	params      []*common.MessageParamValue
+	dropIndices map[uint16]bool
+	paramMax    map[string]float32
+	paramReads  []int16
+
+	onFrame func(*gomavlib.EventFrame)
+}
+
+// NewAutopilot starts an autopilot that listens on conf.Address. It is disarmed in
+// MANUAL mode with no mission and no parameters. Call Close to stop it.
+func NewAutopilot(conf AutopilotConf) (*Autopilot, error) {
+	if conf.SystemID == 0 {
+		conf.SystemID = 1
+	}
+	if conf.HeartbeatPeriod <= 0 {
+		conf.HeartbeatPeriod = defaultHeartbeatPeriod
+	}
+	if conf.TelemetryPeriod <= 0 {
+		conf.TelemetryPeriod = defaultTelemetryPeriod
+	}
+	if conf.Trajectory == nil {
+		conf.Trajectory = DefaultTrajectory
+	}
+	if conf.Battery == nil {
+		battery := DefaultBattery
+		conf.Battery = &battery
+	}
+
+	node, err := gomavlib.NewNode(gomavlib.NodeConf{
+		Endpoints:        []gomavlib.EndpointConf{gomavlib.EndpointUDPServer{Address: conf.Address}},
+		Dialect:          common.Dialect,
+		OutVersion:       gomavlib.V2,
+		OutSystemID:      conf.SystemID,
+		HeartbeatDisable: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ap := &Autopilot{
+		conf:        conf,
+		node:        node,
+		started:     time.Now(),
+		done:        make(chan struct{}),
+		customMode:  ModeManual,
+		dropIndices: map[uint16]bool{},
+		paramMax:    map[string]float32{},
+		intervals:   map[uint32]int32{},
+	}
+	go ap.run()
+	go ap.stream()
+	return ap, nil
+}
+
+// FreeUDPAddress returns a loopback address with a UDP port that is free to listen on.
+func FreeUDPAddress() (string, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close() //nolint: errcheck
+	return conn.LocalAddr().String(), nil
+}
+
+// Endpoint returns the endpoint Hub connects to the autopilot with.
+func (ap *Autopilot) Endpoint() string {
+	return fmt.Sprintf("udp:%s", ap.conf.Address)
+}
+
+// Close stops the autopilot.
+func (ap *Autopilot) Close() {
+	ap.closeOnce.Do(func() {
+		close(ap.done)
+		ap.node.Close()
+	})
+}
+
+// Armed reports whether the autopilot has been armed.
+func (ap *Autopilot) Armed() bool {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	return ap.armed
+}
+
+// Mode returns the ArduPlane custom mode the autopilot is in.
+func (ap *Autopilot) Mode() uint32 {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	return ap.customMode
+}
+
+// SetParams replaces the parameters of the autopilot with the named parameters, all
+// of type REAL32 and indexed in the order given.
+func (ap *Autopilot) SetParams(names []string, values []float32) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	ap.params = nil
+	for i, name := range names {
+		ap.params = append(ap.params, &common.MessageParamValue{
+			ParamId: name, ParamValue: values[i], ParamType: common.MAV_PARAM_TYPE_REAL32,
+			ParamCount: uint16(len(names)), ParamIndex: uint16(i),
+		})
+	}
+}
+
+// Param returns the value of a parameter of the autopilot.
+func (ap *Autopilot) Param(name string) (float32, bool) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	for _, param := range ap.params {
+		if param.ParamId == name {
+			return param.ParamValue, true
+		}
+	}
+	return 0, false
+}
+
+// DropParams leaves the parameters at the given indices out of the reply to
+// PARAM_REQUEST_LIST, as if they were lost on the link. They can still be read
+// one at a time.
+func (ap *Autopilot) DropParams(indices ...uint16) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	for _, index := range indices {
+		ap.dropIndices[index] = true
+	}
+}
+
+// ClampParam makes PARAM_SET clamp a parameter to max, like ArduPilot does for
+// parameters with a range.
+func (ap *Autopilot) ClampParam(name string, max float32) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	ap.paramMax[name] = max
+}
+
+// ParamReads returns the indices requested with PARAM_REQUEST_READ, which are -1 for
+// parameters requested by name.
+func (ap *Autopilot) ParamReads() []int16 {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	return append([]int16{}, ap.paramReads...)
+}
+
+// SetMission replaces the mission on the autopilot.
+func (ap *Autopilot) SetMission(items []*common.MessageMissionItemInt) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	ap.items = append([]*common.MessageMissionItemInt{}, items...)
+}
+
+// Mission returns the mission on the autopilot.
+func (ap *Autopilot) Mission() []*common.MessageMissionItemInt {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	return append([]*common.MessageMissionItemInt{}, ap.items...)
+}
+
+// IgnoreMissionCounts makes the autopilot ignore the next n MISSION_COUNTs, so that
+// the uploader has to resend them.
+func (ap *Autopilot) IgnoreMissionCounts(n int) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	ap.ignoreCounts, ap.countsIgnored = n, 0
+}
+
+// SetMissionResult changes the MISSION_ACK sent at the end of an upload. Uploads are
+// accepted by default.
+func (ap *Autopilot) SetMissionResult(result common.MAV_MISSION_RESULT) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	ap.missionResult = result
+}
+
+// MissionAcks returns the results of the MISSION_ACKs received at the end of downloads.
+func (ap *Autopilot) MissionAcks() []common.MAV_MISSION_RESULT {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	return append([]common.MAV_MISSION_RESULT{}, ap.missionAcks...)
+}
+
+// IgnoreCommands makes the autopilot ignore the next n commands, so that the sender
+// has to resend them.
+func (ap *Autopilot) IgnoreCommands(n int) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	ap.ignoreCommands, ap.commandsIgnored = n, 0
+}
+
+// SetCommandResult changes the result of every COMMAND_ACK. Commands are accepted by
+// default, and only change the state of the autopilot when they are.
+func (ap *Autopilot) SetCommandResult(result common.MAV_RESULT) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	ap.commandResult = result
+}
+
+// SendInProgressFirst makes the autopilot send a MAV_RESULT_IN_PROGRESS COMMAND_ACK
+// before the final one, like ArduPilot does for slow commands.
+func (ap *Autopilot) SendInProgressFirst(inProgress bool) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	ap.inProgressFirst = inProgress
+}
+
+// Commands returns every COMMAND_LONG received, including the ignored ones but not
+// MAV_CMD_SET_MESSAGE_INTERVAL (see MessageIntervals).
+func (ap *Autopilot) Commands() []*common.MessageCommandLong {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	return append([]*common.MessageCommandLong{}, ap.commands...)
+}
+
+// CommandInts returns every COMMAND_INT received, including the ignored ones.
+func (ap *Autopilot) CommandInts() []*common.MessageCommandInt {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	return append([]*common.MessageCommandInt{}, ap.commandInts...)
+}
+
+// MessageIntervals returns the interval in microseconds of every message whose rate
+// was set with MAV_CMD_SET_MESSAGE_INTERVAL, keyed by message ID. -1 means the
+// message was stopped and 0 that it went back to its default rate.
+func (ap *Autopilot) MessageIntervals() map[uint32]int32 {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	intervals := make(map[uint32]int32, len(ap.intervals))
+	for id, interval := range ap.intervals {
+		intervals[id] = interval
+	}
+	return intervals
+}
+
+// OnFrame calls handler with every frame the autopilot receives, before the
+// autopilot answers it.
+func (ap *Autopilot) OnFrame(handler func(*gomavlib.EventFrame)) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	ap.onFrame = handler
+}
+
+// run answers the frames received by the autopilot until it is closed.
+func (ap *Autopilot) run() {
+	for e := range ap.node.Events() {
+		evt, ok := e.(*gomavlib.EventFrame)
+		if !ok {
+			continue
+		}
+
+		ap.mutex.Lock()
+		onFrame := ap.onFrame
+		ap.mutex.Unlock()
+		if onFrame != nil {
+			onFrame(evt)
+		}
+
+		ap.mutex.Lock()
+		for _, reply := range ap.handle(evt) {
+			ap.node.WriteMessageTo(evt.Channel, reply)
+		}
+		ap.mutex.Unlock()
+	}
+}
+
+// handle returns the replies to a frame. Replies are copies, since the node encodes
+// them after mutex is unlocked. Must be called with mutex locked.
+func (ap *Autopilot) handle(evt *gomavlib.EventFrame) []msg.Message {
+	sysID, compID := evt.SystemID(), evt.ComponentID()
+
+	switch m := evt.Frame.GetMessage().(type) {
+	case *common.MessageMissionCount:
+		if ap.countsIgnored < ap.ignoreCounts {
+			ap.countsIgnored++
+			return nil
+		}
+		ap.uploadCount = int(m.Count)
+		ap.items = nil
+		return []msg.Message{&common.MessageMissionRequestInt{TargetSystem: sysID, TargetComponent: compID, Seq: 0}}
+
+	case *common.MessageMissionItemInt:
+		if int(m.Seq) != len(ap.items) {
+			return nil
+		}
+		ap.items = append(ap.items, m)
+		if len(ap.items) < ap.uploadCount {
+			return []msg.Message{&common.MessageMissionRequestInt{TargetSystem: sysID, TargetComponent: compID, Seq: m.Seq + 1}}
+		}
+		return []msg.Message{&common.MessageMissionAck{TargetSystem: sysID, TargetComponent: compID, Type: ap.missionResult}}
+
+	case *common.MessageMissionRequestList:
+		return []msg.Message{&common.MessageMissionCount{TargetSystem: sysID, TargetComponent: compID, Count: uint16(len(ap.items))}}
+
+	case *common.MessageMissionRequestInt:
+		if int(m.Seq) >= len(ap.items) {
+			return nil
+		}
+		item := *ap.items[m.Seq]
+		item.TargetSystem, item.TargetComponent = sysID, compID
+		return []msg.Message{&item}
+
+	case *common.MessageMissionAck:
+		ap.missionAcks = append(ap.missionAcks, m.Type)
+
+	case *common.MessageCommandLong:
+		// Hub sets message rates on its own whenever it finds the plane, so they are
+		// always accepted and kept out of Commands
+		if m.Command == common.MAV_CMD_SET_MESSAGE_INTERVAL {
+			ap.intervals[uint32(m.Param1)] = int32(m.Param2)
+			return []msg.Message{&common.MessageCommandAck{
+				Command: m.Command, Result: common.MAV_RESULT_ACCEPTED, TargetSystem: sysID, TargetComponent: compID,
+			}}
+		}
+		ap.commands = append(ap.commands, m)
+		return ap.ackCommand(m.Command, [7]float32{m.Param1, m.Param2, m.Param3, m.Param4, m.Param5, m.Param6, m.Param7}, sysID, compID)
+
+	case *common.MessageCommandInt:
+		ap.commandInts = append(ap.commandInts, m)
+		return ap.ackCommand(m.Command, [7]float32{m.Param1, m.Param2, m.Param3, m.Param4}, sysID, compID)
+
+	case *common.MessageParamRequestList:
+		replies := []msg.Message{}
+		for _, param := range ap.params {
+			if !ap.dropIndices[param.ParamIndex] {
+				value := *param
+				replies = append(replies, &value)
+			}
+		}
+		return replies
+
+	case *common.MessageParamRequestRead:
+		ap.paramReads = append(ap.paramReads, m.ParamIndex)
+		for _, param := range ap.params {
+			if int16(param.ParamIndex) == m.ParamIndex || (m.ParamIndex == -1 && param.ParamId == m.ParamId) {
+				value := *param
+				return []msg.Message{&value}
+			}
+		}
+
+	case *common.MessageParamSet:
+		for _, param := range ap.params {
+			if param.ParamId != m.ParamId {
+				continue
+			}
+			param.ParamValue = m.ParamValue
+			if max, ok := ap.paramMax[m.ParamId]; ok && param.ParamValue > max {
+				param.ParamValue = max
+			}
+			echo := *param
+			return []msg.Message{&echo}
+		}
+	}
+	return nil
+}
+
+// ackCommand carries out a command and returns its COMMAND_ACKs. Must be called with
+// mutex locked.
+func (ap *Autopilot) ackCommand(command common.MAV_CMD, params [7]float32, sysID uint8, compID uint8) []msg.Message {
+	if ap.commandsIgnored < ap.ignoreCommands {
+		ap.commandsIgnored++
+		return nil
+	}
+
+	replies := []msg.Message{}
+	if ap.inProgressFirst {
+		replies = append(replies, &common.MessageCommandAck{
+			Command: command, Result: common.MAV_RESULT_IN_PROGRESS, TargetSystem: sysID, TargetComponent: compID,
+		})
+	}
+	if ap.commandResult == common.MAV_RESULT_ACCEPTED {
+		switch command {
+		case common.MAV_CMD_COMPONENT_ARM_DISARM:
+			ap.armed = params[0] == 1
+		case common.MAV_CMD_DO_SET_MODE:
+			ap.customMode = uint32(params[1])
+		case common.MAV_CMD_NAV_RETURN_TO_LAUNCH:
+			ap.customMode = ModeRTL
+		case common.MAV_CMD_DO_REPOSITION:
+			ap.customMode = ModeGuided
+		}
+	}
+	return append(replies, &common.MessageCommandAck{
+		Command: command, Result: ap.commandResult, TargetSystem: sysID, TargetComponent: compID,
+	})
+}
+
+// stream sends a HEARTBEAT every HeartbeatPeriod and the rest of the telemetry every
+// TelemetryPeriod until the autopilot is closed.
+func (ap *Autopilot) stream() {
+	heartbeats := time.NewTicker(ap.conf.HeartbeatPeriod)
+	defer heartbeats.Stop()
+	telemetry := time.NewTicker(ap.conf.TelemetryPeriod)
+	defer telemetry.Stop()
+
+	ap.node.WriteMessageAll(ap.heartbeat())
+	for {
+		select {
+		case <-heartbeats.C:
+			ap.node.WriteMessageAll(ap.heartbeat())
+		case now := <-telemetry.C:
+			for _, m := range ap.telemetry(now.Sub(ap.started)) {
+				ap.node.WriteMessageAll(m)
+			}
+		case <-ap.done:
+			return
+		}
+	}
+}
+
+// heartbeat returns a HEARTBEAT with the mode and arming state of the autopilot.
+func (ap *Autopilot) heartbeat() *common.MessageHeartbeat {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	heartbeat := &common.MessageHeartbeat{
+		Type:           common.MAV_TYPE_FIXED_WING,
+		Autopilot:      common.MAV_AUTOPILOT_ARDUPILOTMEGA,
+		BaseMode:       common.MAV_MODE_FLAG_CUSTOM_MODE_ENABLED | common.MAV_MODE_FLAG_STABILIZE_ENABLED,
+		CustomMode:     ap.customMode,
+		SystemStatus:   common.MAV_STATE_STANDBY,
+		MavlinkVersion: 3,
+	}
+	if ap.armed {
+		heartbeat.BaseMode |= common.MAV_MODE_FLAG_SAFETY_ARMED
+		heartbeat.SystemStatus = common.MAV_STATE_ACTIVE
+	}
+	if ap.customMode == ModeAuto || ap.customMode == ModeGuided || ap.customMode == ModeRTL {
+		heartbeat.BaseMode |= common.MAV_MODE_FLAG_GUIDED_ENABLED | common.MAV_MODE_FLAG_AUTO_ENABLED
+	}
+	return heartbeat
+}
+
+// telemetry returns the telemetry the plane sends at a time since it started,
+// leaving out the messages stopped with MAV_CMD_SET_MESSAGE_INTERVAL.
+func (ap *Autopilot) telemetry(elapsed time.Duration) []msg.Message {
+	pose := ap.conf.Trajectory(elapsed)
+	bootMs := uint32(elapsed.Milliseconds())
+	all := []msg.Message{
+		pose.globalPositionInt(bootMs),
+		pose.attitude(bootMs),
+		pose.vfrHud(),
+		ap.conf.Battery.status(elapsed),
+	}
+
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	messages := make([]msg.Message, 0, len(all))
+	for _, m := range all {
+		if ap.intervals[m.GetID()] != -1 {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
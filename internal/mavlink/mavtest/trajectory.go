@@ -0,0 +1,211 @@
+package mavtest
+
+import (
+	"math"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+)
+
+const (
+	// metersPerDegree is the length of a degree of latitude, which is close enough
+	// for the short distances the autopilot flies
+	metersPerDegree = 111320.0
+	gravity         = 9.81
+	// homeAltitude is the altitude above mean sea level of the point the plane took
+	// off from. Trajectories are flown relative to it.
+	homeAltitude = 100
+)
+
+// Pose is where the plane is and how it is flying at a point of its trajectory.
+type Pose struct {
+	// Latitude and Longitude are in degrees
+	Latitude  float64
+	Longitude float64
+	// Altitude is in meters above home
+	Altitude float32
+	// Heading is in degrees clockwise from north
+	Heading float64
+	// GroundSpeed and ClimbRate are in m/s
+	GroundSpeed float64
+	ClimbRate   float64
+	// Roll and Pitch are in radians
+	Roll  float64
+	Pitch float64
+}
+
+// Trajectory returns the pose of the plane a while after the autopilot started.
+type Trajectory func(elapsed time.Duration) Pose
+
+// Waypoint is a point of a Route. Altitude is in meters above home.
+type Waypoint struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float32
+}
+
+// DefaultTrajectory circles the first waypoint of the missions used in Hub's tests.
+var DefaultTrajectory = Orbit(Waypoint{Latitude: 32.8801, Longitude: -117.2340, Altitude: 75}, 150, 18)
+
+// Orbit returns a trajectory that circles center clockwise at a radius in meters and
+// a ground speed in m/s, starting north of center.
+func Orbit(center Waypoint, radius float64, speed float64) Trajectory {
+	bank := math.Atan(speed * speed / (radius * gravity))
+	return func(elapsed time.Duration) Pose {
+		angle := speed * elapsed.Seconds() / radius
+		latitude, longitude := offset(center, radius*math.Cos(angle), radius*math.Sin(angle))
+		return Pose{
+			Latitude:    latitude,
+			Longitude:   longitude,
+			Altitude:    center.Altitude,
+			Heading:     normalizeHeading(angle*180/math.Pi + 90),
+			GroundSpeed: speed,
+			Roll:        bank,
+		}
+	}
+}
+
+// Route returns a trajectory that flies straight from one waypoint to the next at a
+// ground speed in m/s, returning to the first waypoint after the last. It needs at
+// least two waypoints.
+func Route(speed float64, waypoints ...Waypoint) Trajectory {
+	legs := make([]float64, len(waypoints))
+	total := 0.0
+	for i, from := range waypoints {
+		north, east := distance(from, waypoints[(i+1)%len(waypoints)])
+		legs[i] = math.Hypot(north, east) / speed
+		total += legs[i]
+	}
+
+	return func(elapsed time.Duration) Pose {
+		t := math.Mod(elapsed.Seconds(), total)
+		i := 0
+		for t > legs[i] && i < len(legs)-1 {
+			t -= legs[i]
+			i++
+		}
+		from, to := waypoints[i], waypoints[(i+1)%len(waypoints)]
+		north, east := distance(from, to)
+		progress := t / legs[i]
+		climb := float64(to.Altitude-from.Altitude) / legs[i]
+
+		latitude, longitude := offset(from, north*progress, east*progress)
+		return Pose{
+			Latitude:    latitude,
+			Longitude:   longitude,
+			Altitude:    from.Altitude + float32(progress)*(to.Altitude-from.Altitude),
+			Heading:     normalizeHeading(math.Atan2(east, north) * 180 / math.Pi),
+			GroundSpeed: speed,
+			ClimbRate:   climb,
+			Pitch:       math.Atan2(climb, speed),
+		}
+	}
+}
+
+// Battery is a battery that drains at a constant current.
+type Battery struct {
+	// Cells is the number of cells in series, up to 14
+	Cells int
+	// FullCellVoltage and EmptyCellVoltage are in volts
+	FullCellVoltage  float64
+	EmptyCellVoltage float64
+	// Current is in amps
+	Current float64
+	// Capacity is in mAh
+	Capacity float64
+}
+
+// DefaultBattery is a 6 cell LiPo that lasts half an hour.
+var DefaultBattery = Battery{Cells: 6, FullCellVoltage: 4.2, EmptyCellVoltage: 3.5, Current: 20, Capacity: 10000}
+
+// status returns the BATTERY_STATUS of the battery a while after it was full.
+func (b Battery) status(elapsed time.Duration) *common.MessageBatteryStatus {
+	consumed := b.Current * elapsed.Hours() * 1000
+	remaining := math.Max(0, 1-consumed/b.Capacity)
+	cellMillivolts := uint16(1000 * (b.EmptyCellVoltage + remaining*(b.FullCellVoltage-b.EmptyCellVoltage)))
+
+	status := &common.MessageBatteryStatus{
+		BatteryFunction:  common.MAV_BATTERY_FUNCTION_ALL,
+		Type:             common.MAV_BATTERY_TYPE_LIPO,
+		Temperature:      2500,
+		CurrentBattery:   int16(b.Current * 100),
+		CurrentConsumed:  int32(consumed),
+		EnergyConsumed:   -1,
+		BatteryRemaining: int8(math.Round(remaining * 100)),
+	}
+	// unused cells are UINT16_MAX in voltages and 0 in voltages_ext
+	for i := range status.Voltages {
+		status.Voltages[i] = math.MaxUint16
+		if i < b.Cells {
+			status.Voltages[i] = cellMillivolts
+		}
+	}
+	for i := range status.VoltagesExt {
+		if len(status.Voltages)+i < b.Cells {
+			status.VoltagesExt[i] = cellMillivolts
+		}
+	}
+	return status
+}
+
+func (p Pose) globalPositionInt(bootMs uint32) *common.MessageGlobalPositionInt {
+	heading := p.Heading * math.Pi / 180
+	return &common.MessageGlobalPositionInt{
+		TimeBootMs:  bootMs,
+		Lat:         int32(math.Round(p.Latitude * 1e7)),
+		Lon:         int32(math.Round(p.Longitude * 1e7)),
+		Alt:         int32((homeAltitude + p.Altitude) * 1000),
+		RelativeAlt: int32(p.Altitude * 1000),
+		Vx:          int16(p.GroundSpeed * math.Cos(heading) * 100),
+		Vy:          int16(p.GroundSpeed * math.Sin(heading) * 100),
+		Vz:          int16(-p.ClimbRate * 100),
+		Hdg:         uint16(math.Round(p.Heading*100)) % 36000,
+	}
+}
+
+func (p Pose) attitude(bootMs uint32) *common.MessageAttitude {
+	yaw := p.Heading * math.Pi / 180
+	if yaw > math.Pi {
+		yaw -= 2 * math.Pi
+	}
+	return &common.MessageAttitude{
+		TimeBootMs: bootMs,
+		Roll:       float32(p.Roll),
+		Pitch:      float32(p.Pitch),
+		Yaw:        float32(yaw),
+	}
+}
+
+func (p Pose) vfrHud() *common.MessageVfrHud {
+	return &common.MessageVfrHud{
+		Airspeed:    float32(p.GroundSpeed),
+		Groundspeed: float32(p.GroundSpeed),
+		Heading:     int16(math.Round(p.Heading)) % 360,
+		Throttle:    60,
+		Alt:         homeAltitude + p.Altitude,
+		Climb:       float32(p.ClimbRate),
+	}
+}
+
+// offset returns the point north and east meters away from a waypoint.
+func offset(from Waypoint, north float64, east float64) (float64, float64) {
+	latitude := from.Latitude + north/metersPerDegree
+	longitude := from.Longitude + east/(metersPerDegree*math.Cos(from.Latitude*math.Pi/180))
+	return latitude, longitude
+}
+
+// distance returns how many meters north and east one waypoint is from another.
+func distance(from Waypoint, to Waypoint) (float64, float64) {
+	north := (to.Latitude - from.Latitude) * metersPerDegree
+	east := (to.Longitude - from.Longitude) * metersPerDegree * math.Cos(from.Latitude*math.Pi/180)
+	return north, east
+}
+
+// normalizeHeading wraps a heading in degrees to [0, 360).
+func normalizeHeading(heading float64) float64 {
+	heading = math.Mod(heading, 360)
+	if heading < 0 {
+		heading += 360
+	}
+	return heading
+}
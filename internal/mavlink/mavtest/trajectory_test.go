@@ -0,0 +1,64 @@
+package mavtest
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrbit(t *testing.T) {
+	center := Waypoint{Latitude: 32.88, Longitude: -117.23, Altitude: 75}
+	orbit := Orbit(center, 100, 20)
+
+	start := orbit(0)
+	north, east := distance(center, Waypoint{Latitude: start.Latitude, Longitude: start.Longitude})
+	assert.InDelta(t, 100, north, 0.01)
+	assert.InDelta(t, 0, east, 0.01)
+	assert.InDelta(t, 90, start.Heading, 1e-9)
+	assert.Equal(t, float32(75), start.Altitude)
+	assert.Greater(t, start.Roll, 0.0)
+
+	// a quarter of the way around
+	quarterTime := math.Pi / 2 * 100 / 20
+	quarter := orbit(time.Duration(quarterTime * float64(time.Second)))
+	north, east = distance(center, Waypoint{Latitude: quarter.Latitude, Longitude: quarter.Longitude})
+	assert.InDelta(t, 0, north, 0.01)
+	assert.InDelta(t, 100, east, 0.01)
+	assert.InDelta(t, 180, quarter.Heading, 1e-6)
+}
+
+func TestRoute(t *testing.T) {
+	home := Waypoint{Latitude: 32.88, Longitude: -117.23, Altitude: 30}
+	north, _ := offset(home, 200, 0)
+	route := Route(20, home, Waypoint{Latitude: north, Longitude: home.Longitude, Altitude: 80})
+
+	// halfway up the first leg, climbing north
+	pose := route(5 * time.Second)
+	assert.InDelta(t, (home.Latitude+north)/2, pose.Latitude, 1e-9)
+	assert.InDelta(t, 55, pose.Altitude, 1e-3)
+	assert.InDelta(t, 0, pose.Heading, 1e-6)
+	assert.InDelta(t, 5, pose.ClimbRate, 1e-9)
+
+	// heading back south on the second leg, then starting over
+	assert.InDelta(t, 180, route(15*time.Second).Heading, 1e-6)
+	assert.InDelta(t, home.Latitude, route(40*time.Second).Latitude, 1e-9)
+}
+
+func TestBatteryStatus(t *testing.T) {
+	battery := Battery{Cells: 12, FullCellVoltage: 4.2, EmptyCellVoltage: 3.6, Current: 20, Capacity: 10000}
+
+	status := battery.status(15 * time.Minute)
+	assert.Equal(t, int32(5000), status.CurrentConsumed)
+	assert.Equal(t, int8(50), status.BatteryRemaining)
+	assert.Equal(t, int16(2000), status.CurrentBattery)
+	assert.Equal(t, uint16(3900), status.Voltages[0])
+	assert.Equal(t, uint16(3900), status.Voltages[9])
+	assert.Equal(t, [4]uint16{3900, 3900, 0, 0}, status.VoltagesExt)
+
+	// a battery never goes below empty
+	status = battery.status(2 * time.Hour)
+	assert.Equal(t, int8(0), status.BatteryRemaining)
+	assert.Equal(t, uint16(3600), status.Voltages[0])
+}
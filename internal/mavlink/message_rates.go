@@ -0,0 +1,210 @@
+package mav
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+)
+
+// ErrInvalidMessageRate is returned when a message rate is negative or not a number.
+var ErrInvalidMessageRate = errors.New("message rates must be 0 Hz (stopped) or more")
+
+// DefaultMessageRates are the rates in Hz requested from the plane until
+// SetMessageRates is called. They cover the telemetry Hub stores and shows.
+var DefaultMessageRates = map[string]float64{
+	"ATTITUDE":            10,
+	"GLOBAL_POSITION_INT": 10,
+	"VFR_HUD":             4,
+	"SYS_STATUS":          1,
+	"BATTERY_STATUS":      1,
+	"MISSION_CURRENT":     1,
+}
+
+// MessageRate is the rate a message is requested at and how the plane answered.
+type MessageRate struct {
+	Message string  `json:"message"`
+	ID      uint32  `json:"id"`
+	Hz      float64 `json:"hz"`
+	// Result is the MAV_RESULT name of the plane's answer the last time the rate was
+	// requested, TIMEOUT/NOT_SENT if it never answered, or empty until the rate has
+	// been requested
+	Result   string `json:"result"`
+	Accepted bool   `json:"accepted"`
+}
+
+// messageRate is a rate requested from the plane. Protected by ratesMutex.
+type messageRate struct {
+	hz     float64
+	result CommandResult
+}
+
+// SetMessageRates replaces the rates in Hz that messages are requested from the plane
+// at, keyed by message name. A rate of 0 stops the plane from sending the message.
+// Messages that are no longer listed go back to the autopilot's default rate.
+//
+// The rates are requested in the background as soon as the plane has been found, and
+// again every time its link comes back. Returns the rates right away, before the
+// plane answers (see GetMessageRates), or an error without changing anything if a
+// message or rate is invalid.
+func (c *Client) SetMessageRates(rates map[string]float64) ([]MessageRate, error) {
+	ids, err := parseMessageRates(rates)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ratesMutex.Lock()
+	for id := range c.messageRates {
+		if _, ok := ids[id]; !ok {
+			c.ratesToReset[id] = true
+		}
+	}
+	c.messageRates = make(map[uint32]*messageRate, len(ids))
+	for id, hz := range ids {
+		delete(c.ratesToReset, id)
+		c.messageRates[id] = &messageRate{hz: hz}
+	}
+	c.ratesMutex.Unlock()
+
+	c.requestMessageRates()
+	return c.GetMessageRates(), nil
+}
+
+// GetMessageRates returns the rates messages are requested at, sorted by message name.
+func (c *Client) GetMessageRates() []MessageRate {
+	c.ratesMutex.Lock()
+	defer c.ratesMutex.Unlock()
+
+	rates := make([]MessageRate, 0, len(c.messageRates))
+	for id, rate := range c.messageRates {
+		rates = append(rates, MessageRate{
+			Message:  messageNames[id],
+			ID:       id,
+			Hz:       rate.hz,
+			Result:   rate.result.Result,
+			Accepted: rate.result.Accepted,
+		})
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].Message < rates[j].Message
+	})
+	return rates
+}
+
+// ParseMessageRates parses comma separated "message:rate" pairs, where rate is in Hz.
+// Example: "GLOBAL_POSITION_INT:10,BATTERY_STATUS:1"
+func ParseMessageRates(list string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, pair := range SplitList(list) {
+		name, rateStr, _ := strings.Cut(pair, ":")
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message rate %q. Expected message:rate with a rate in Hz", pair)
+		}
+		rates[name] = rate
+	}
+	return rates, nil
+}
+
+// requestMessageRates makes maintainMessageRates request every rate from the plane
+// again. It never blocks, so it is safe to call with any mutex locked.
+func (c *Client) requestMessageRates() {
+	select {
+	case c.ratesRequested <- struct{}{}:
+	default:
+		// the rates are already about to be requested
+	}
+}
+
+// maintainMessageRates requests the message rates from the plane whenever
+// requestMessageRates is called, until the client is closed.
+func (c *Client) maintainMessageRates() {
+	for {
+		select {
+		case <-c.ratesRequested:
+			c.applyMessageRates()
+		case <-c.handlersDone:
+			return
+		}
+	}
+}
+
+// applyMessageRates sends MAV_CMD_SET_MESSAGE_INTERVAL for every message rate and for
+// every message that should go back to its default rate. It stops early if the plane
+// can't be reached, since the rates are requested again once it is found.
+func (c *Client) applyMessageRates() {
+	// a recorded plane can't be asked for anything
+	if _, err := c.getReplay(); err == nil {
+		return
+	}
+
+	// commands are sent one at a time, since the plane can't tell apart two
+	// MAV_CMD_SET_MESSAGE_INTERVALs in flight (see ErrCommandInProgress)
+	c.ratesApplyMutex.Lock()
+	defer c.ratesApplyMutex.Unlock()
+
+	c.ratesMutex.Lock()
+	intervals := make(map[uint32]float32, len(c.messageRates)+len(c.ratesToReset))
+	for id, rate := range c.messageRates {
+		intervals[id] = messageInterval(rate.hz)
+	}
+	for id := range c.ratesToReset {
+		intervals[id] = 0 // the autopilot's default rate
+	}
+	c.ratesMutex.Unlock()
+
+	ids := make([]uint32, 0, len(intervals))
+	for id := range intervals {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		result, err := c.CommandLong(common.MAV_CMD_SET_MESSAGE_INTERVAL, [7]float32{float32(id), intervals[id]})
+		if !result.Accepted {
+			Log.Warnf("Plane did not accept the rate of %s. Result: %s", messageNames[id], result.Result)
+		}
+
+		c.ratesMutex.Lock()
+		if rate, ok := c.messageRates[id]; ok && messageInterval(rate.hz) == intervals[id] {
+			rate.result = result
+		} else if intervals[id] == 0 && result.Accepted {
+			delete(c.ratesToReset, id)
+		}
+		c.ratesMutex.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// messageInterval returns the interval in microseconds of MAV_CMD_SET_MESSAGE_INTERVAL
+// for a rate in Hz. -1 stops the message.
+func messageInterval(hz float64) float32 {
+	if hz == 0 {
+		return -1
+	}
+	return float32(math.Round(1e6 / hz))
+}
+
+// parseMessageRates checks the names and rates of messages and returns the rates by
+// message ID.
+func parseMessageRates(rates map[string]float64) (map[uint32]float64, error) {
+	ids := make(map[uint32]float64, len(rates))
+	for name, hz := range rates {
+		id, ok := MessageID(name)
+		if _, known := messageNames[id]; !ok || !known {
+			return nil, fmt.Errorf("%w %q", ErrUnknownMessage, name)
+		}
+		if hz < 0 || math.IsNaN(hz) || math.IsInf(hz, 0) {
+			return nil, fmt.Errorf("%w: %s at %g Hz", ErrInvalidMessageRate, name, hz)
+		}
+		ids[id] = hz
+	}
+	return ids, nil
+}
@@ -0,0 +1,95 @@
+package mav
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMessageRates(t *testing.T) {
+	rates, err := ParseMessageRates("GLOBAL_POSITION_INT:10, battery_status:0.5")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"GLOBAL_POSITION_INT": 10, "battery_status": 0.5}, rates)
+
+	_, err = ParseMessageRates("GLOBAL_POSITION_INT")
+	assert.Error(t, err)
+
+	ids, err := parseMessageRates(rates)
+	require.NoError(t, err)
+	assert.Equal(t, map[uint32]float64{33: 10, 147: 0.5}, ids)
+
+	_, err = parseMessageRates(map[string]float64{"NOT_A_MESSAGE": 1})
+	assert.Error(t, err)
+	_, err = parseMessageRates(map[string]float64{"65000": 1})
+	assert.Error(t, err)
+	_, err = parseMessageRates(map[string]float64{"ATTITUDE": -1})
+	assert.ErrorIs(t, err, ErrInvalidMessageRate)
+
+	assert.Equal(t, float32(100000), messageInterval(10))
+	assert.Equal(t, float32(-1), messageInterval(0))
+}
+
+func TestMessageRates(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	c := newTestClient(t, port)
+
+	// the default rates are requested as soon as the plane is found
+	require.Eventually(t, func() bool {
+		return len(ap.MessageIntervals()) == len(DefaultMessageRates)
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, int32(100000), ap.MessageIntervals()[33])
+	require.Eventually(t, func() bool {
+		for _, rate := range c.GetMessageRates() {
+			if !rate.Accepted {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// the rates are returned before the plane answers
+	rates, err := c.SetMessageRates(map[string]float64{"GLOBAL_POSITION_INT": 5, "BATTERY_STATUS": 0})
+	require.NoError(t, err)
+	require.Len(t, rates, 2)
+	assert.Equal(t, MessageRate{Message: "BATTERY_STATUS", ID: 147, Hz: 0}, rates[0])
+	assert.Equal(t, "GLOBAL_POSITION_INT", rates[1].Message)
+
+	require.Eventually(t, func() bool {
+		rates := c.GetMessageRates()
+		return rates[0].Accepted && rates[1].Accepted && ap.MessageIntervals()[30] == 0
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, MessageRate{Message: "BATTERY_STATUS", ID: 147, Hz: 0, Result: "MAV_RESULT_ACCEPTED", Accepted: true}, c.GetMessageRates()[0])
+	intervals := ap.MessageIntervals()
+	assert.Equal(t, int32(200000), intervals[33])
+	assert.Equal(t, int32(-1), intervals[147])
+	// messages that were dropped go back to their default rate
+	assert.Equal(t, int32(0), intervals[30])
+
+	_, err = c.SetMessageRates(map[string]float64{"ATTITUDE": -2})
+	assert.ErrorIs(t, err, ErrInvalidMessageRate)
+	assert.Len(t, c.GetMessageRates(), 2)
+}
+
+func TestMessageRatesAfterReconnect(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	c := newTestClient(t, port)
+	require.NoError(t, c.SetLinkTimeouts(LinkTimeouts{Degraded: 200 * time.Millisecond, Lost: 400 * time.Millisecond}))
+	require.Eventually(t, func() bool {
+		return len(ap.MessageIntervals()) == len(DefaultMessageRates)
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// a rebooted autopilot has forgotten the rates it was asked for
+	ap.Close()
+	require.Eventually(t, func() bool {
+		return !c.IsConnectedToPlane()
+	}, 5*time.Second, 20*time.Millisecond)
+	rebooted := newTestAutopilot(t, port)
+
+	require.Eventually(t, func() bool {
+		return len(rebooted.MessageIntervals()) == len(DefaultMessageRates)
+	}, 10*time.Second, 20*time.Millisecond, "rates were not requested again")
+}
@@ -0,0 +1,188 @@
+package mav
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/frame"
+	"github.com/aler9/gomavlib/pkg/msg"
+)
+
+// ErrUnknownMessage is returned when a message name or ID is not in the common dialect.
+var ErrUnknownMessage = errors.New("unknown mavlink message")
+
+// upperCase matches the start of every word in a gomavlib message type name.
+var upperCase = regexp.MustCompile("([A-Z])")
+
+// messageIDs maps the name of every message in the common dialect to its ID.
+var messageIDs = func() map[string]uint32 {
+	ids := make(map[string]uint32, len(common.Dialect.Messages))
+	for _, m := range common.Dialect.Messages {
+		ids[MessageName(m)] = m.GetID()
+	}
+	return ids
+}()
+
+// messageNames maps the ID of every message in the common dialect to its name.
+var messageNames = func() map[uint32]string {
+	names := make(map[uint32]string, len(messageIDs))
+	for name, id := range messageIDs {
+		names[id] = name
+	}
+	return names
+}()
+
+// MessageName returns the name a message has in the MAVLink spec, such as
+// GLOBAL_POSITION_INT for *common.MessageGlobalPositionInt. It is derived from the Go
+// type name the same way gomavlib derives it to compute message checksums.
+func MessageName(m msg.Message) string {
+	name := strings.TrimPrefix(reflect.TypeOf(m).Elem().Name(), "Message")
+	name = upperCase.ReplaceAllString(name, "_${1}")
+	return strings.ToUpper(strings.TrimPrefix(name, "_"))
+}
+
+// MessageID returns the ID of a message in the common dialect from either its name
+// (case insensitive) or its ID as a number.
+func MessageID(nameOrID string) (uint32, bool) {
+	if id, err := strconv.ParseUint(nameOrID, 10, 32); err == nil {
+		return uint32(id), true
+	}
+	id, ok := messageIDs[strings.ToUpper(nameOrID)]
+	return id, ok
+}
+
+// messageTargetFields caches the indices of the target system and component fields
+// of every message type that has been passed to messageTarget, or -1 if it has none.
+var messageTargetFields sync.Map // reflect.Type -> [2]int
+
+// messageTarget returns the system and component a message is addressed to. ok is
+// false for messages that are not addressed to anyone, such as telemetry. A target
+// system of 0 means the message is addressed to every system, and a target
+// component of 0 (or a message with no target component) means every component of
+// the target system.
+func messageTarget(m msg.Message) (system uint8, component uint8, ok bool) {
+	v := reflect.ValueOf(m).Elem()
+
+	var fields [2]int
+	if cached, found := messageTargetFields.Load(v.Type()); found {
+		fields = cached.([2]int)
+	} else {
+		fields = [2]int{targetFieldIndex(v.Type(), "TargetSystem", "Target"), targetFieldIndex(v.Type(), "TargetComponent")}
+		messageTargetFields.Store(v.Type(), fields)
+	}
+
+	if fields[0] < 0 {
+		return 0, 0, false
+	}
+	system = uint8(v.Field(fields[0]).Uint())
+	if fields[1] >= 0 {
+		component = uint8(v.Field(fields[1]).Uint())
+	}
+	return system, component, true
+}
+
+// targetFieldIndex returns the index of the first uint8 field of a message struct
+// with one of the given names, or -1. MANUAL_CONTROL calls its target system "target".
+func targetFieldIndex(t reflect.Type, names ...string) int {
+	for _, name := range names {
+		if field, ok := t.FieldByName(name); ok && field.Type.Kind() == reflect.Uint8 {
+			return field.Index[0]
+		}
+	}
+	return -1
+}
+
+// ErrPayloadMismatch is returned when the payload of a received frame can't be
+// encoded again the way it was sent.
+var ErrPayloadMismatch = errors.New("the payload of the frame does not match its checksum")
+
+// payloadEncoders caches a message encoder for every message ID seen by encodePayload.
+var payloadEncoders sync.Map // uint32 -> *msg.DecEncoder
+
+// encodePayload encodes the message of a received frame again, since gomavlib does
+// not keep the raw bytes of a frame. MAVLink 2 payloads are truncated like gomavlib
+// sends them, which may differ from how they were received (see receivedPayload).
+func encodePayload(f frame.Frame) ([]byte, error) {
+	m := f.GetMessage()
+	if raw, ok := m.(*msg.MessageRaw); ok {
+		return raw.Content, nil
+	}
+
+	encoder, err := payloadEncoder(m)
+	if err != nil {
+		return nil, err
+	}
+	_, isV2 := f.(*frame.V2Frame)
+	return encoder.Encode(m, isV2)
+}
+
+// receivedPayload returns the payload of a received frame as it was sent, checked
+// against the checksum of the frame. Senders that don't truncate the zeros at the end
+// of MAVLink 2 payloads are handled by adding zeros back until the checksum matches.
+// Returns ErrPayloadMismatch if it never does, for example if the sender encodes
+// extension fields differently.
+func receivedPayload(f frame.Frame) ([]byte, error) {
+	m := f.GetMessage()
+	if raw, ok := m.(*msg.MessageRaw); ok {
+		// unknown messages keep the payload they were received with
+		return raw.Content, nil
+	}
+
+	payload, err := encodePayload(f)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := payloadEncoder(m)
+	if err != nil {
+		return nil, err
+	}
+
+	maxLength := len(payload)
+	if _, isV2 := f.(*frame.V2Frame); isV2 {
+		maxLength = maxPayloadLength
+	}
+	for ; len(payload) <= maxLength; payload = append(payload, 0) {
+		if payloadChecksum(f, payload, encoder.CRCExtra()) == f.GetChecksum() {
+			return payload, nil
+		}
+	}
+	return nil, ErrPayloadMismatch
+}
+
+// maxPayloadLength is the length of the longest payload a frame can hold.
+const maxPayloadLength = 255
+
+// payloadEncoder returns the encoder of a message type.
+func payloadEncoder(m msg.Message) (*msg.DecEncoder, error) {
+	if cached, ok := payloadEncoders.Load(m.GetID()); ok {
+		return cached.(*msg.DecEncoder), nil
+	}
+	encoder, err := msg.NewDecEncoder(m)
+	if err != nil {
+		return nil, err
+	}
+	payloadEncoders.Store(m.GetID(), encoder)
+	return encoder, nil
+}
+
+// payloadChecksum returns the checksum a frame would have with the given payload.
+func payloadChecksum(f frame.Frame, payload []byte, crcExtra byte) uint16 {
+	raw := &msg.MessageRaw{ID: f.GetMessage().GetID(), Content: payload}
+	switch f := f.(type) {
+	case *frame.V1Frame:
+		withPayload := *f
+		withPayload.Message = raw
+		return withPayload.GenChecksum(crcExtra)
+	case *frame.V2Frame:
+		withPayload := *f
+		withPayload.Message = raw
+		return withPayload.GenChecksum(crcExtra)
+	default:
+		return 0
+	}
+}
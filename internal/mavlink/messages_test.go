@@ -0,0 +1,42 @@
+package mav
+
+import (
+	"testing"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageName(t *testing.T) {
+	assert.Equal(t, "GLOBAL_POSITION_INT", MessageName(&common.MessageGlobalPositionInt{}))
+	assert.Equal(t, "SCALED_IMU2", MessageName(&common.MessageScaledImu2{}))
+	assert.Equal(t, "HEARTBEAT", MessageName(&common.MessageHeartbeat{}))
+
+	id, ok := MessageID("attitude")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(30), id)
+	id, ok = MessageID("33")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(33), id)
+	_, ok = MessageID("NOT_A_MESSAGE")
+	assert.False(t, ok)
+}
+
+func TestMessageTarget(t *testing.T) {
+	system, component, ok := messageTarget(&common.MessageCommandLong{TargetSystem: 1, TargetComponent: 2})
+	assert.True(t, ok)
+	assert.Equal(t, uint8(1), system)
+	assert.Equal(t, uint8(2), component)
+
+	system, component, ok = messageTarget(&common.MessageSetMode{TargetSystem: 3})
+	assert.True(t, ok)
+	assert.Equal(t, uint8(3), system)
+	assert.Equal(t, uint8(0), component)
+
+	system, _, ok = messageTarget(&common.MessageManualControl{Target: 4})
+	assert.True(t, ok)
+	assert.Equal(t, uint8(4), system)
+
+	_, _, ok = messageTarget(&common.MessageGlobalPositionInt{})
+	assert.False(t, ok)
+}
@@ -0,0 +1,499 @@
+package mav
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/msg"
+)
+
+// ErrEmptyMission is returned when trying to upload a mission with no items.
+var ErrEmptyMission = errors.New("mission must contain at least one item")
+
+// ErrMissionTooLarge is returned when a mission has more items than MISSION_COUNT can describe.
+var ErrMissionTooLarge = errors.New("mission has too many items")
+
+// ErrMissionTransferInProgress is returned when a mission upload or download is
+// requested while another one has not finished yet.
+var ErrMissionTransferInProgress = errors.New("a mission transfer with the plane is already in progress")
+
+// missionTimeout is how long to wait for the plane to respond during a mission
+// transfer before resending the last message.
+const missionTimeout = 1500 * time.Millisecond
+
+// missionMaxRetries is how many times the last message of a mission transfer is
+// resent before giving up on the transfer.
+const missionMaxRetries = 5
+
+// Results reported when a mission transfer ends without a MISSION_ACK from the plane.
+const (
+	MissionResultTimeout = "TIMEOUT"
+	MissionResultNotSent = "NOT_SENT"
+)
+
+// missionResultNames maps MAV_MISSION_RESULT values to their names in the MAVLink spec.
+// https://mavlink.io/en/messages/common.html#MAV_MISSION_RESULT
+var missionResultNames = map[common.MAV_MISSION_RESULT]string{
+	common.MAV_MISSION_ACCEPTED:            "MAV_MISSION_ACCEPTED",
+	common.MAV_MISSION_ERROR:               "MAV_MISSION_ERROR",
+	common.MAV_MISSION_UNSUPPORTED_FRAME:   "MAV_MISSION_UNSUPPORTED_FRAME",
+	common.MAV_MISSION_UNSUPPORTED:         "MAV_MISSION_UNSUPPORTED",
+	common.MAV_MISSION_NO_SPACE:            "MAV_MISSION_NO_SPACE",
+	common.MAV_MISSION_INVALID:             "MAV_MISSION_INVALID",
+	common.MAV_MISSION_INVALID_PARAM1:      "MAV_MISSION_INVALID_PARAM1",
+	common.MAV_MISSION_INVALID_PARAM2:      "MAV_MISSION_INVALID_PARAM2",
+	common.MAV_MISSION_INVALID_PARAM3:      "MAV_MISSION_INVALID_PARAM3",
+	common.MAV_MISSION_INVALID_PARAM4:      "MAV_MISSION_INVALID_PARAM4",
+	common.MAV_MISSION_INVALID_PARAM5_X:    "MAV_MISSION_INVALID_PARAM5_X",
+	common.MAV_MISSION_INVALID_PARAM6_Y:    "MAV_MISSION_INVALID_PARAM6_Y",
+	common.MAV_MISSION_INVALID_PARAM7:      "MAV_MISSION_INVALID_PARAM7",
+	common.MAV_MISSION_INVALID_SEQUENCE:    "MAV_MISSION_INVALID_SEQUENCE",
+	common.MAV_MISSION_DENIED:              "MAV_MISSION_DENIED",
+	common.MAV_MISSION_OPERATION_CANCELLED: "MAV_MISSION_OPERATION_CANCELLED",
+}
+
+// MissionItem is a single waypoint or command of a mission. It mirrors the
+// MISSION_ITEM_INT message, except that latitude and longitude are in degrees.
+// https://mavlink.io/en/messages/common.html#MISSION_ITEM_INT
+//
+// Example JSON for a waypoint at 100m relative altitude:
+//
+//	{"frame": 3, "command": 16, "autocontinue": true, "lat": 32.88, "lon": -117.23, "alt": 100}
+type MissionItem struct {
+	Frame        uint8   `json:"frame"`
+	Command      uint16  `json:"command"`
+	Current      bool    `json:"current"`
+	Autocontinue bool    `json:"autocontinue"`
+	Param1       float32 `json:"param1"`
+	Param2       float32 `json:"param2"`
+	Param3       float32 `json:"param3"`
+	Param4       float32 `json:"param4"`
+	Latitude     float64 `json:"lat"`
+	Longitude    float64 `json:"lon"`
+	Altitude     float32 `json:"alt"`
+}
+
+// MissionUploadResult describes how a mission upload ended.
+type MissionUploadResult struct {
+	// Result is the MAV_MISSION_RESULT name from the plane's MISSION_ACK,
+	// or TIMEOUT/NOT_SENT if the plane never acknowledged the mission.
+	Result    string  `json:"result"`
+	Accepted  bool    `json:"accepted"`
+	ItemCount int     `json:"item_count"`
+	ItemsSent int     `json:"items_sent"`
+	Retries   int     `json:"retries"`
+	Seconds   float64 `json:"seconds"`
+}
+
+// MissionDownloadResult describes how a mission download ended.
+type MissionDownloadResult struct {
+	// Result is MAV_MISSION_ACCEPTED if every item was received, otherwise the
+	// MAV_MISSION_RESULT name from the plane's MISSION_ACK or TIMEOUT/NOT_SENT.
+	Result   string        `json:"result"`
+	Accepted bool          `json:"accepted"`
+	Items    []MissionItem `json:"items"`
+	Retries  int           `json:"retries"`
+	Seconds  float64       `json:"seconds"`
+}
+
+// PlaneMission is the last mission known to be loaded on the plane, either because
+// it was downloaded from the plane or because the plane accepted it in an upload.
+type PlaneMission struct {
+	Items   []MissionItem `json:"items"`
+	Updated time.Time     `json:"updated"`
+}
+
+// missionTransfer holds the state shared by mission uploads and downloads.
+type missionTransfer struct {
+	targetSystem    byte
+	targetComponent byte
+
+	// lastSent is resent whenever the plane does not respond in time
+	lastSent     msg.Message
+	retries      int // resends of lastSent
+	totalRetries int
+	timer        *time.Timer
+	started      time.Time
+}
+
+// missionUpload holds the state of a mission upload that is in progress.
+type missionUpload struct {
+	missionTransfer
+
+	items     []MissionItem
+	itemsSent int
+
+	done chan MissionUploadResult
+}
+
+// missionDownload holds the state of a mission download that is in progress.
+type missionDownload struct {
+	missionTransfer
+
+	// count is the number of items the plane reported in MISSION_COUNT, or -1 if
+	// MISSION_COUNT has not been received yet
+	count int
+	items []MissionItem
+
+	done chan MissionDownloadResult
+}
+
+// newMissionTransfer starts the transfer's timer, which calls onTimeout if the
+// plane does not respond to firstMsg within missionTimeout.
+func newMissionTransfer(targetSystem byte, targetComponent byte, firstMsg msg.Message, onTimeout func()) missionTransfer {
+	return missionTransfer{
+		targetSystem:    targetSystem,
+		targetComponent: targetComponent,
+		lastSent:        firstMsg,
+		timer:           time.AfterFunc(missionTimeout, onTimeout),
+		started:         time.Now(),
+	}
+}
+
+// sent records that a new message of the transfer was sent to the plane.
+func (t *missionTransfer) sent(m msg.Message) {
+	t.lastSent = m
+	t.retries = 0
+	t.timer.Reset(missionTimeout)
+}
+
+// retry records that lastSent is about to be resent. Returns false once all
+// missionMaxRetries have been used up, meaning the transfer should be abandoned.
+func (t *missionTransfer) retry() bool {
+	if t.retries >= missionMaxRetries {
+		return false
+	}
+	t.retries++
+	t.totalRetries++
+	t.timer.Reset(missionTimeout)
+	return true
+}
+
+// toMessageInt converts the item to a MISSION_ITEM_INT addressed to the given system.
+func (item MissionItem) toMessageInt(seq uint16, targetSystem byte, targetComponent byte) *common.MessageMissionItemInt {
+	return &common.MessageMissionItemInt{
+		TargetSystem:    targetSystem,
+		TargetComponent: targetComponent,
+		Seq:             seq,
+		Frame:           common.MAV_FRAME(item.Frame),
+		Command:         common.MAV_CMD(item.Command),
+		Current:         boolToUint8(item.Current),
+		Autocontinue:    boolToUint8(item.Autocontinue),
+		Param1:          item.Param1,
+		Param2:          item.Param2,
+		Param3:          item.Param3,
+		Param4:          item.Param4,
+		X:               int32(item.Latitude * 1e7),
+		Y:               int32(item.Longitude * 1e7),
+		Z:               item.Altitude,
+		MissionType:     common.MAV_MISSION_TYPE_MISSION,
+	}
+}
+
+// toMessage converts the item to the deprecated float MISSION_ITEM message,
+// which is only sent to autopilots that request items with MISSION_REQUEST.
+func (item MissionItem) toMessage(seq uint16, targetSystem byte, targetComponent byte) *common.MessageMissionItem {
+	return &common.MessageMissionItem{
+		TargetSystem:    targetSystem,
+		TargetComponent: targetComponent,
+		Seq:             seq,
+		Frame:           common.MAV_FRAME(item.Frame),
+		Command:         common.MAV_CMD(item.Command),
+		Current:         boolToUint8(item.Current),
+		Autocontinue:    boolToUint8(item.Autocontinue),
+		Param1:          item.Param1,
+		Param2:          item.Param2,
+		Param3:          item.Param3,
+		Param4:          item.Param4,
+		X:               float32(item.Latitude),
+		Y:               float32(item.Longitude),
+		Z:               item.Altitude,
+		MissionType:     common.MAV_MISSION_TYPE_MISSION,
+	}
+}
+
+// missionItemFromMessageInt converts a MISSION_ITEM_INT received from the plane.
+func missionItemFromMessageInt(m *common.MessageMissionItemInt) MissionItem {
+	return MissionItem{
+		Frame:        uint8(m.Frame),
+		Command:      uint16(m.Command),
+		Current:      m.Current != 0,
+		Autocontinue: m.Autocontinue != 0,
+		Param1:       m.Param1,
+		Param2:       m.Param2,
+		Param3:       m.Param3,
+		Param4:       m.Param4,
+		Latitude:     float64(m.X) / 1e7,
+		Longitude:    float64(m.Y) / 1e7,
+		Altitude:     m.Z,
+	}
+}
+
+// missionItemFromMessage converts a deprecated MISSION_ITEM received from the plane.
+func missionItemFromMessage(m *common.MessageMissionItem) MissionItem {
+	return MissionItem{
+		Frame:        uint8(m.Frame),
+		Command:      uint16(m.Command),
+		Current:      m.Current != 0,
+		Autocontinue: m.Autocontinue != 0,
+		Param1:       m.Param1,
+		Param2:       m.Param2,
+		Param3:       m.Param3,
+		Param4:       m.Param4,
+		Latitude:     float64(m.X),
+		Longitude:    float64(m.Y),
+		Altitude:     m.Z,
+	}
+}
+
+func boolToUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sendMissionUploadItem responds to the plane's request for the item at seq from the
+// Listen loop. useInt signifies whether the plane asked with MISSION_REQUEST_INT (true)
+// or the deprecated MISSION_REQUEST (false).
+func (c *Client) sendMissionUploadItem(node *gomavlib.Node, seq uint16, useInt bool) {
+	c.missionMutex.Lock()
+	upload := c.missionUpload
+	if upload == nil {
+		c.missionMutex.Unlock()
+		return
+	}
+	if int(seq) >= len(upload.items) {
+		c.missionMutex.Unlock()
+		Log.Warnf("Plane requested mission item %d but the mission only has %d items", seq, len(upload.items))
+		return
+	}
+
+	item := upload.items[seq]
+	var toSend msg.Message
+	if useInt {
+		toSend = item.toMessageInt(seq, upload.targetSystem, upload.targetComponent)
+	} else {
+		toSend = item.toMessage(seq, upload.targetSystem, upload.targetComponent)
+	}
+	upload.sent(toSend)
+	if int(seq)+1 > upload.itemsSent {
+		upload.itemsSent = int(seq) + 1
+	}
+	c.missionMutex.Unlock()
+
+	if err := c.writeToPlane(node, toSend); err != nil {
+		Log.Errorf("Could not send mission item %d to plane. Reason: %s", seq, err.Error())
+	}
+}
+
+// onMissionUploadTimeout resends the last message of the current upload, or ends
+// the upload once missionMaxRetries has been reached.
+func (c *Client) onMissionUploadTimeout() {
+	c.missionMutex.Lock()
+	upload := c.missionUpload
+	if upload == nil {
+		c.missionMutex.Unlock()
+		return
+	}
+	if !upload.retry() {
+		c.missionMutex.Unlock()
+		Log.Errorf("Mission upload timed out after %d retries", missionMaxRetries)
+		c.finishMissionUpload(upload, MissionResultTimeout)
+		return
+	}
+	toSend, retries := upload.lastSent, upload.retries
+	c.missionMutex.Unlock()
+
+	c.resendMissionMessage("upload", toSend, retries)
+}
+
+// finishMissionUpload reports the result of the upload and frees up the client
+// for the next mission transfer. Does nothing if the upload already finished.
+func (c *Client) finishMissionUpload(upload *missionUpload, result string) {
+	c.missionMutex.Lock()
+	defer c.missionMutex.Unlock()
+
+	if c.missionUpload != upload {
+		return
+	}
+	c.missionUpload = nil
+	upload.timer.Stop()
+
+	accepted := result == missionResultName(common.MAV_MISSION_ACCEPTED)
+	if accepted {
+		c.planeMission = &PlaneMission{Items: upload.items, Updated: time.Now()}
+	}
+
+	upload.done <- MissionUploadResult{
+		Result:    result,
+		Accepted:  accepted,
+		ItemCount: len(upload.items),
+		ItemsSent: upload.itemsSent,
+		Retries:   upload.totalRetries,
+		Seconds:   time.Since(upload.started).Seconds(),
+	}
+	close(upload.done)
+}
+
+// currentMissionUpload returns the upload in progress, or nil if there is none.
+func (c *Client) currentMissionUpload() *missionUpload {
+	c.missionMutex.Lock()
+	defer c.missionMutex.Unlock()
+
+	return c.missionUpload
+}
+
+// handleMissionDownloadCount requests the first item once the plane reports how
+// many items its mission has. An empty mission finishes the download right away.
+func (c *Client) handleMissionDownloadCount(node *gomavlib.Node, count uint16) {
+	c.missionMutex.Lock()
+	download := c.missionDownload
+	if download == nil || download.count >= 0 {
+		c.missionMutex.Unlock()
+		return
+	}
+	download.count = int(count)
+	c.missionMutex.Unlock()
+
+	if count == 0 {
+		c.completeMissionDownload(node, download)
+		return
+	}
+	c.requestMissionDownloadItem(node, download, 0)
+}
+
+// handleMissionDownloadItem stores an item sent by the plane and requests the
+// next one, or acknowledges the mission once every item has been received.
+// Items that arrive out of order are dropped; the timeout will request them again.
+func (c *Client) handleMissionDownloadItem(node *gomavlib.Node, seq uint16, item MissionItem) {
+	c.missionMutex.Lock()
+	download := c.missionDownload
+	if download == nil || download.count < 0 || int(seq) != len(download.items) {
+		c.missionMutex.Unlock()
+		return
+	}
+	download.items = append(download.items, item)
+	complete := len(download.items) == download.count
+	c.missionMutex.Unlock()
+
+	if complete {
+		c.completeMissionDownload(node, download)
+		return
+	}
+	c.requestMissionDownloadItem(node, download, seq+1)
+}
+
+// requestMissionDownloadItem asks the plane for the item at seq with MISSION_REQUEST_INT
+// from the Listen loop.
+func (c *Client) requestMissionDownloadItem(node *gomavlib.Node, download *missionDownload, seq uint16) {
+	request := &common.MessageMissionRequestInt{
+		TargetSystem:    download.targetSystem,
+		TargetComponent: download.targetComponent,
+		Seq:             seq,
+		MissionType:     common.MAV_MISSION_TYPE_MISSION,
+	}
+
+	c.missionMutex.Lock()
+	if c.missionDownload != download {
+		c.missionMutex.Unlock()
+		return
+	}
+	download.sent(request)
+	c.missionMutex.Unlock()
+
+	if err := c.writeToPlane(node, request); err != nil {
+		Log.Errorf("Could not request mission item %d from plane. Reason: %s", seq, err.Error())
+	}
+}
+
+// completeMissionDownload sends the final MISSION_ACK to the plane from the Listen loop
+// and reports the downloaded mission.
+func (c *Client) completeMissionDownload(node *gomavlib.Node, download *missionDownload) {
+	ack := &common.MessageMissionAck{
+		TargetSystem:    download.targetSystem,
+		TargetComponent: download.targetComponent,
+		Type:            common.MAV_MISSION_ACCEPTED,
+		MissionType:     common.MAV_MISSION_TYPE_MISSION,
+	}
+	if err := c.writeToPlane(node, ack); err != nil {
+		Log.Errorf("Could not acknowledge downloaded mission. Reason: %s", err.Error())
+	}
+	c.finishMissionDownload(download, missionResultName(common.MAV_MISSION_ACCEPTED))
+}
+
+// onMissionDownloadTimeout resends the last message of the current download, or ends
+// the download once missionMaxRetries has been reached.
+func (c *Client) onMissionDownloadTimeout() {
+	c.missionMutex.Lock()
+	download := c.missionDownload
+	if download == nil {
+		c.missionMutex.Unlock()
+		return
+	}
+	if !download.retry() {
+		c.missionMutex.Unlock()
+		Log.Errorf("Mission download timed out after %d retries", missionMaxRetries)
+		c.finishMissionDownload(download, MissionResultTimeout)
+		return
+	}
+	toSend, retries := download.lastSent, download.retries
+	c.missionMutex.Unlock()
+
+	c.resendMissionMessage("download", toSend, retries)
+}
+
+// finishMissionDownload reports the result of the download and frees up the client
+// for the next mission transfer. A complete download replaces the cached PlaneMission.
+// Does nothing if the download already finished.
+func (c *Client) finishMissionDownload(download *missionDownload, result string) {
+	c.missionMutex.Lock()
+	defer c.missionMutex.Unlock()
+
+	if c.missionDownload != download {
+		return
+	}
+	c.missionDownload = nil
+	download.timer.Stop()
+
+	accepted := result == missionResultName(common.MAV_MISSION_ACCEPTED)
+	if accepted {
+		c.planeMission = &PlaneMission{Items: download.items, Updated: time.Now()}
+	}
+
+	download.done <- MissionDownloadResult{
+		Result:   result,
+		Accepted: accepted,
+		Items:    download.items,
+		Retries:  download.totalRetries,
+		Seconds:  time.Since(download.started).Seconds(),
+	}
+	close(download.done)
+}
+
+// currentMissionDownload returns the download in progress, or nil if there is none.
+func (c *Client) currentMissionDownload() *missionDownload {
+	c.missionMutex.Lock()
+	defer c.missionMutex.Unlock()
+
+	return c.missionDownload
+}
+
+// resendMissionMessage sends the last message of a mission transfer again after
+// the plane did not respond to it.
+func (c *Client) resendMissionMessage(transfer string, m msg.Message, retries int) {
+	Log.Warnf("No response from plane during mission %s. Resending message %d (retry %d/%d)", transfer, m.GetID(), retries, missionMaxRetries)
+	if err := c.SendToPlane(m); err != nil {
+		Log.Errorf("Could not resend mission %s message to plane. Reason: %s", transfer, err.Error())
+	}
+}
+
+// missionResultName returns the MAVLink name of a MAV_MISSION_RESULT.
+func missionResultName(result common.MAV_MISSION_RESULT) string {
+	if name, ok := missionResultNames[result]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,174 @@
+package mav
+
+import (
+	"math"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+)
+
+// missionProgressMeasurement is the InfluxDB measurement that mission progress is stored under
+const missionProgressMeasurement = "MISSION_PROGRESS"
+
+// minETAGroundSpeed is the ground speed (m/s) below which no ETA is computed,
+// since the plane is not really moving towards the waypoint.
+const minETAGroundSpeed = 1.0
+
+// earthRadius is the mean radius of the earth in meters
+const earthRadius = 6371000.0
+
+// ReachedMissionItem records when the plane reached an item of its mission.
+type ReachedMissionItem struct {
+	Seq  uint16    `json:"seq"`
+	Time time.Time `json:"time"`
+}
+
+// MissionProgress describes how far along the plane is in its mission.
+type MissionProgress struct {
+	// CurrentSeq is the item the plane is flying to, or -1 if MISSION_CURRENT
+	// has not been received yet.
+	CurrentSeq     int                  `json:"current_seq"`
+	CurrentChanged time.Time            `json:"current_changed"`
+	Reached        []ReachedMissionItem `json:"reached"`
+
+	// GroundSpeed is in m/s and is computed from GLOBAL_POSITION_INT
+	GroundSpeed float64 `json:"ground_speed"`
+	// DistanceToNext (meters) and ETASeconds are nil if the location of the current
+	// item is unknown, for example because the mission has not been downloaded yet.
+	DistanceToNext *float64 `json:"distance_to_next"`
+	ETASeconds     *float64 `json:"eta_seconds"`
+
+	position     *common.MessageGlobalPositionInt
+	positionTime time.Time
+}
+
+// GetMissionProgress returns a snapshot of the plane's progress through its mission.
+func (c *Client) GetMissionProgress() MissionProgress {
+	mission := c.GetPlaneMission()
+
+	c.progressMutex.Lock()
+	defer c.progressMutex.Unlock()
+
+	progress := c.missionProgress
+	progress.Reached = append([]ReachedMissionItem{}, c.missionProgress.Reached...)
+	progress.DistanceToNext, progress.ETASeconds = progress.estimateNext(mission)
+	return progress
+}
+
+// updateMissionCurrent records the item the plane is currently flying to. If the
+// plane went back to an earlier item, the items after it are no longer reached.
+func (c *Client) updateMissionCurrent(seq uint16) {
+	c.progressMutex.Lock()
+	defer c.progressMutex.Unlock()
+
+	if c.missionProgress.CurrentSeq == int(seq) {
+		return
+	}
+
+	Log.Infof("Plane is now flying to mission item %d", seq)
+	if int(seq) < c.missionProgress.CurrentSeq {
+		reached := []ReachedMissionItem{}
+		for _, item := range c.missionProgress.Reached {
+			if item.Seq < seq {
+				reached = append(reached, item)
+			}
+		}
+		c.missionProgress.Reached = reached
+	}
+	c.missionProgress.CurrentSeq = int(seq)
+	c.missionProgress.CurrentChanged = time.Now()
+}
+
+// updateMissionItemReached records when the plane reached an item. Only the first
+// MISSION_ITEM_REACHED for an item is kept since the autopilot may repeat it.
+func (c *Client) updateMissionItemReached(seq uint16) {
+	c.progressMutex.Lock()
+	defer c.progressMutex.Unlock()
+
+	for _, item := range c.missionProgress.Reached {
+		if item.Seq == seq {
+			return
+		}
+	}
+
+	Log.Infof("Plane reached mission item %d", seq)
+	c.missionProgress.Reached = append(c.missionProgress.Reached, ReachedMissionItem{Seq: seq, Time: time.Now()})
+}
+
+// updateMissionPosition stores the plane's latest position for ETA calculations.
+func (c *Client) updateMissionPosition(msg *common.MessageGlobalPositionInt) {
+	c.progressMutex.Lock()
+	defer c.progressMutex.Unlock()
+
+	c.missionProgress.position = msg
+	c.missionProgress.positionTime = time.Now()
+	// vx and vy are in cm/s
+	c.missionProgress.GroundSpeed = math.Hypot(float64(msg.Vx), float64(msg.Vy)) / 100
+}
+
+// writeMissionProgressToInfluxDB stores the current progress as its own measurement.
+func (c *Client) writeMissionProgressToInfluxDB() {
+	if c.influxdbClient == nil || !c.influxdbClient.IsConnected() {
+		return
+	}
+
+	tags, data := c.missionProgressPoint()
+	err := c.influxdbClient.WriteTagged(missionProgressMeasurement, tags, data)
+	if err != nil {
+		Log.Errorf("Cannot write mission progress to InfluxDB. Reason: %s", err.Error())
+	}
+}
+
+// missionProgressPoint returns the tags and fields of the current progress as a point
+// of the MISSION_PROGRESS measurement. It isn't tagged with the ID of the message that
+// changed the progress, so history lookups of that message don't return it.
+func (c *Client) missionProgressPoint() (map[string]string, map[string]interface{}) {
+	progress := c.GetMissionProgress()
+	data := make(map[string]interface{})
+	data["current_seq"] = int64(progress.CurrentSeq)
+	data["reached_count"] = int64(len(progress.Reached))
+	data["ground_speed"] = progress.GroundSpeed
+	if len(progress.Reached) > 0 {
+		data["last_reached_seq"] = int64(progress.Reached[len(progress.Reached)-1].Seq)
+	}
+	if progress.DistanceToNext != nil {
+		data["distance_to_next"] = *progress.DistanceToNext
+	}
+	if progress.ETASeconds != nil {
+		data["eta_seconds"] = *progress.ETASeconds
+	}
+	return map[string]string{}, data
+}
+
+// estimateNext returns the distance (meters) and ETA (seconds) to the current item.
+// Either can be nil if it cannot be estimated.
+func (p *MissionProgress) estimateNext(mission *PlaneMission) (*float64, *float64) {
+	if mission == nil || p.position == nil || p.CurrentSeq < 0 || p.CurrentSeq >= len(mission.Items) {
+		return nil, nil
+	}
+
+	next := mission.Items[p.CurrentSeq]
+	if next.Latitude == 0 && next.Longitude == 0 {
+		// not a navigation command (e.g. DO_CHANGE_SPEED) so there's nowhere to fly to
+		return nil, nil
+	}
+
+	distance := haversineDistance(float64(p.position.Lat)/1e7, float64(p.position.Lon)/1e7, next.Latitude, next.Longitude)
+	if p.GroundSpeed < minETAGroundSpeed {
+		return &distance, nil
+	}
+	eta := distance / p.GroundSpeed
+	return &distance, &eta
+}
+
+// haversineDistance returns the great-circle distance in meters between two points
+// given in degrees.
+func haversineDistance(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,70 @@
+package mav
+
+import (
+	"testing"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHaversineDistance(t *testing.T) {
+	// one degree of latitude is ~111.2km everywhere
+	assert.InDelta(t, 111195, haversineDistance(32, -117, 33, -117), 10)
+	assert.InDelta(t, 0, haversineDistance(32.88, -117.23, 32.88, -117.23), 1e-9)
+}
+
+func TestMissionProgress(t *testing.T) {
+	c := &Client{missionProgress: MissionProgress{CurrentSeq: -1}}
+	c.planeMission = &PlaneMission{Items: testMission}
+
+	progress := c.GetMissionProgress()
+	assert.Equal(t, -1, progress.CurrentSeq)
+	assert.Nil(t, progress.ETASeconds)
+
+	c.updateMissionItemReached(0)
+	c.updateMissionItemReached(0)
+	c.updateMissionCurrent(1)
+	c.updateMissionItemReached(1)
+	c.updateMissionCurrent(2)
+
+	// 100 m south of item 2 flying north at 20 m/s
+	c.updateMissionPosition(&common.MessageGlobalPositionInt{
+		Lat: int32((testMission[2].Latitude - 100/111195.0) * 1e7),
+		Lon: int32(testMission[2].Longitude * 1e7),
+		Vx:  2000,
+	})
+
+	progress = c.GetMissionProgress()
+	assert.Equal(t, 2, progress.CurrentSeq)
+	assert.Len(t, progress.Reached, 2)
+	assert.InDelta(t, 20, progress.GroundSpeed, 1e-9)
+	require.NotNil(t, progress.DistanceToNext)
+	require.NotNil(t, progress.ETASeconds)
+	assert.InDelta(t, 100, *progress.DistanceToNext, 1)
+	assert.InDelta(t, 5, *progress.ETASeconds, 0.1)
+
+	// restarting the mission forgets the items after the new current item
+	c.updateMissionCurrent(1)
+	progress = c.GetMissionProgress()
+	require.Len(t, progress.Reached, 1)
+	assert.Equal(t, uint16(0), progress.Reached[0].Seq)
+
+	// item 3 is RTL and has no location
+	c.updateMissionCurrent(3)
+	progress = c.GetMissionProgress()
+	assert.Nil(t, progress.DistanceToNext)
+}
+
+func TestMissionProgressPoint(t *testing.T) {
+	c := &Client{missionProgress: MissionProgress{CurrentSeq: -1}}
+	c.updateMissionCurrent(2)
+	c.updateMissionItemReached(1)
+
+	// MISSION_CURRENT and MISSION_ITEM_REACHED are stored with their ID, which the
+	// progress must not share
+	tags, data := c.missionProgressPoint()
+	assert.NotContains(t, tags, "ID")
+	assert.Equal(t, int64(2), data["current_seq"])
+	assert.Equal(t, int64(1), data["last_reached_seq"])
+}
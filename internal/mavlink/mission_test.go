@@ -0,0 +1,165 @@
+package mav
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tritonuas/gcs/internal/mavlink/mavtest"
+)
+
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// newTestAutopilot starts a fake autopilot on the given port that sends heartbeats
+// often, so that tests find it quickly.
+func newTestAutopilot(t *testing.T, port int) *mavtest.Autopilot {
+	t.Helper()
+	ap, err := mavtest.NewAutopilot(mavtest.AutopilotConf{
+		Address:         fmt.Sprintf("127.0.0.1:%d", port),
+		HeartbeatPeriod: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(ap.Close)
+	return ap
+}
+
+// newTestClient starts a mavlink client that listens to the autopilot on the given
+// port and waits until it has found the plane.
+func newTestClient(t *testing.T, port int) *Client {
+	t.Helper()
+	c := New(nil, "127.0.0.1", "1", fmt.Sprintf("udp:127.0.0.1:%d", port))
+	go c.Listen()
+	t.Cleanup(c.Kill)
+
+	require.Eventually(t, func() bool {
+		_, _, _, err := c.getPlaneChannel()
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond, "plane was never found")
+	return c
+}
+
+var testMission = []MissionItem{
+	{Frame: 3, Command: 22, Autocontinue: true, Latitude: 32.8801, Longitude: -117.2340, Altitude: 30},
+	{Frame: 3, Command: 16, Autocontinue: true, Latitude: 32.8812, Longitude: -117.2355, Altitude: 75},
+	{Frame: 3, Command: 16, Autocontinue: true, Latitude: 32.8825, Longitude: -117.2361, Altitude: 75, Param2: 10},
+	{Frame: 3, Command: 20},
+}
+
+func TestMissionUpload(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	c := newTestClient(t, port)
+
+	resultChan, err := c.StartMissionUpload(testMission)
+	require.NoError(t, err)
+
+	_, err = c.StartMissionUpload(testMission)
+	assert.ErrorIs(t, err, ErrMissionTransferInProgress)
+
+	result := <-resultChan
+	assert.True(t, result.Accepted)
+	assert.Equal(t, "MAV_MISSION_ACCEPTED", result.Result)
+	assert.Equal(t, len(testMission), result.ItemsSent)
+
+	items := ap.Mission()
+	require.Len(t, items, len(testMission))
+	for i, item := range items {
+		assert.Equal(t, uint16(i), item.Seq)
+		assert.Equal(t, common.MAV_CMD(testMission[i].Command), item.Command)
+		assert.Equal(t, int32(testMission[i].Latitude*1e7), item.X)
+		assert.Equal(t, int32(testMission[i].Longitude*1e7), item.Y)
+		assert.Equal(t, testMission[i].Altitude, item.Z)
+	}
+}
+
+func TestMissionUploadRetriesCount(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	ap.IgnoreMissionCounts(1)
+	c := newTestClient(t, port)
+
+	resultChan, err := c.StartMissionUpload(testMission)
+	require.NoError(t, err)
+
+	result := <-resultChan
+	assert.True(t, result.Accepted)
+	assert.Equal(t, 1, result.Retries)
+}
+
+func TestMissionUploadRejected(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	ap.SetMissionResult(common.MAV_MISSION_NO_SPACE)
+	c := newTestClient(t, port)
+
+	resultChan, err := c.StartMissionUpload(testMission)
+	require.NoError(t, err)
+
+	result := <-resultChan
+	assert.False(t, result.Accepted)
+	assert.Equal(t, "MAV_MISSION_NO_SPACE", result.Result)
+}
+
+func TestMissionUploadEmpty(t *testing.T) {
+	c := &Client{}
+	_, err := c.StartMissionUpload(nil)
+	assert.ErrorIs(t, err, ErrEmptyMission)
+}
+
+func TestMissionDownload(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	items := []*common.MessageMissionItemInt{}
+	for i, item := range testMission {
+		items = append(items, item.toMessageInt(uint16(i), 0, 0))
+	}
+	ap.SetMission(items)
+	c := newTestClient(t, port)
+
+	assert.Nil(t, c.GetPlaneMission())
+
+	resultChan, err := c.StartMissionDownload()
+	require.NoError(t, err)
+
+	result := <-resultChan
+	assert.True(t, result.Accepted)
+	require.Len(t, result.Items, len(testMission))
+	for i, item := range result.Items {
+		assert.Equal(t, testMission[i].Command, item.Command)
+		assert.InDelta(t, testMission[i].Latitude, item.Latitude, 1e-7)
+		assert.InDelta(t, testMission[i].Longitude, item.Longitude, 1e-7)
+		assert.Equal(t, testMission[i].Altitude, item.Altitude)
+	}
+
+	mission := c.GetPlaneMission()
+	require.NotNil(t, mission)
+	assert.Equal(t, result.Items, mission.Items)
+
+	assert.Eventually(t, func() bool {
+		acks := ap.MissionAcks()
+		return len(acks) == 1 && acks[0] == common.MAV_MISSION_ACCEPTED
+	}, time.Second, 10*time.Millisecond, "plane never received the final MISSION_ACK")
+}
+
+func TestMissionDownloadEmpty(t *testing.T) {
+	port := freeUDPPort(t)
+	newTestAutopilot(t, port)
+	c := newTestClient(t, port)
+
+	resultChan, err := c.StartMissionDownload()
+	require.NoError(t, err)
+
+	result := <-resultChan
+	assert.True(t, result.Accepted)
+	assert.Empty(t, result.Items)
+}
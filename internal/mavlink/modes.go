@@ -0,0 +1,54 @@
+package mav
+
+import "strings"
+
+// arduPlaneModes maps ArduPlane's custom_mode numbers to the names used by
+// Mission Planner and QGC.
+// https://ardupilot.org/plane/docs/parameters.html#fltmode1
+var arduPlaneModes = map[uint32]string{
+	0:  "MANUAL",
+	1:  "CIRCLE",
+	2:  "STABILIZE",
+	3:  "TRAINING",
+	4:  "ACRO",
+	5:  "FBWA",
+	6:  "FBWB",
+	7:  "CRUISE",
+	8:  "AUTOTUNE",
+	10: "AUTO",
+	11: "RTL",
+	12: "LOITER",
+	13: "TAKEOFF",
+	14: "AVOID_ADSB",
+	15: "GUIDED",
+	17: "QSTABILIZE",
+	18: "QHOVER",
+	19: "QLOITER",
+	20: "QLAND",
+	21: "QRTL",
+	22: "QAUTOTUNE",
+	23: "QACRO",
+	24: "THERMAL",
+	25: "LOITER_ALT_QLAND",
+}
+
+// arduPlaneModeName returns the name of an ArduPlane custom mode, or UNKNOWN
+// if the mode number is not recognized.
+func arduPlaneModeName(customMode uint32) string {
+	if name, ok := arduPlaneModes[customMode]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// arduPlaneModeNumber returns the custom mode number of an ArduPlane mode name.
+// The name is case insensitive.
+func arduPlaneModeNumber(name string) (uint32, bool) {
+	name = strings.ToUpper(name)
+	for number, modeName := range arduPlaneModes {
+		if modeName == name {
+			return number, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,439 @@
+package mav
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/msg"
+)
+
+// ErrParamNotFound is returned when the plane does not have a parameter with the requested name.
+var ErrParamNotFound = errors.New("parameter not found on the plane")
+
+// ErrParamInProgress is returned when a parameter is read or set while another read
+// or set of the same parameter is still waiting for the plane's PARAM_VALUE.
+var ErrParamInProgress = errors.New("the same parameter is already waiting for a response from the plane")
+
+// ErrParamNameTooLong is returned for parameter names that do not fit in a PARAM_SET.
+var ErrParamNameTooLong = errors.New("parameter names can be at most 16 characters long")
+
+// paramTimeout is how long to wait for PARAM_VALUE before re-requesting parameters.
+// During a full download it is the longest allowed gap between two PARAM_VALUEs.
+const paramTimeout = 1 * time.Second
+
+// paramMaxRetries is how many times a parameter request is resent before giving up.
+// During a full download it is how many rounds of re-requesting missing parameters
+// may go by without receiving any of them.
+const paramMaxRetries = 3
+
+// paramRequestBatch is the most missing parameters re-requested in one round, so that
+// re-requests do not flood a slow telemetry radio.
+const paramRequestBatch = 50
+
+// paramNameLength is the size of the param_id field of the parameter messages.
+const paramNameLength = 16
+
+// Results reported when setting a parameter.
+const (
+	ParamResultVerified = "VERIFIED"
+	ParamResultMismatch = "MISMATCH"
+	ParamResultTimeout  = "TIMEOUT"
+	ParamResultNotSent  = "NOT_SENT"
+)
+
+// paramTypeNames maps MAV_PARAM_TYPE values to their names in the MAVLink spec.
+// https://mavlink.io/en/messages/common.html#MAV_PARAM_TYPE
+var paramTypeNames = map[common.MAV_PARAM_TYPE]string{
+	common.MAV_PARAM_TYPE_UINT8:  "UINT8",
+	common.MAV_PARAM_TYPE_INT8:   "INT8",
+	common.MAV_PARAM_TYPE_UINT16: "UINT16",
+	common.MAV_PARAM_TYPE_INT16:  "INT16",
+	common.MAV_PARAM_TYPE_UINT32: "UINT32",
+	common.MAV_PARAM_TYPE_INT32:  "INT32",
+	common.MAV_PARAM_TYPE_UINT64: "UINT64",
+	common.MAV_PARAM_TYPE_INT64:  "INT64",
+	common.MAV_PARAM_TYPE_REAL32: "REAL32",
+	common.MAV_PARAM_TYPE_REAL64: "REAL64",
+}
+
+// Param is an onboard parameter of the autopilot.
+//
+// ArduPilot encodes integer parameters by casting them to a float, so Value is
+// exact for every type except large INT32s.
+type Param struct {
+	Name  string  `json:"name"`
+	Value float32 `json:"value"`
+	// Type is the MAV_PARAM_TYPE name without its prefix, such as REAL32 or INT8
+	Type    string    `json:"type"`
+	Index   uint16    `json:"index"`
+	Updated time.Time `json:"updated"`
+
+	paramType common.MAV_PARAM_TYPE
+}
+
+// ParamProgress describes how much of the plane's parameter list has been downloaded.
+type ParamProgress struct {
+	// Total is the number of parameters reported by the plane, or -1 if no PARAM_VALUE
+	// has been received yet
+	Total    int  `json:"total"`
+	Received int  `json:"received"`
+	Complete bool `json:"complete"`
+	Fetching bool `json:"fetching"`
+	// Retries is the number of rounds of re-requesting parameters in the current or last download
+	Retries int       `json:"retries"`
+	Updated time.Time `json:"updated"`
+}
+
+// ParamSetResult describes how the plane responded to setting a parameter.
+type ParamSetResult struct {
+	Name      string  `json:"name"`
+	Requested float32 `json:"requested"`
+	// Value is the value the plane reported after the set, which differs from
+	// Requested if the autopilot rejected or clamped it
+	Value float32 `json:"value"`
+	// Result is VERIFIED if the plane reported back the requested value,
+	// otherwise MISMATCH, TIMEOUT or NOT_SENT
+	Result   string  `json:"result"`
+	Verified bool    `json:"verified"`
+	Attempts int     `json:"attempts"`
+	Seconds  float64 `json:"seconds"`
+	// Error is why the parameter could not be set when it is part of ApplyParams
+	Error string `json:"error,omitempty"`
+}
+
+// paramFetch holds the state of a full parameter download that is in progress.
+type paramFetch struct {
+	targetSystem    byte
+	targetComponent byte
+
+	// retries counts rounds of re-requests since the last PARAM_VALUE was received
+	retries      int
+	totalRetries int
+	timer        *time.Timer
+}
+
+// StartParamFetch sends PARAM_REQUEST_LIST to the plane to download every parameter
+// into the cache returned by GetParams. Parameters that never arrive are re-requested
+// by index once the plane stops sending them. Download progress is reported by
+// GetParamProgress. Starting a fetch while one is in progress does nothing.
+//
+// See https://mavlink.io/en/services/parameter.html#read_all for details on the
+// parameter download process.
+func (c *Client) StartParamFetch() error {
+	_, targetSystem, targetComponent, err := c.getPlaneChannel()
+	if err != nil {
+		return err
+	}
+
+	c.paramMutex.Lock()
+	if c.paramFetch != nil {
+		c.paramMutex.Unlock()
+		return nil
+	}
+	c.paramFetch = &paramFetch{
+		targetSystem:    targetSystem,
+		targetComponent: targetComponent,
+		timer:           time.AfterFunc(paramTimeout, c.onParamFetchTimeout),
+	}
+	// cached values stay available while the download refreshes them
+	c.paramCount = -1
+	c.paramIndices = make(map[uint16]bool)
+	c.paramMutex.Unlock()
+
+	Log.Infof("Starting parameter download from system %d", targetSystem)
+	return c.sendParamRequestList(targetSystem, targetComponent)
+}
+
+// GetParams returns every cached parameter sorted by name, and how much of the
+// plane's parameter list has been downloaded.
+func (c *Client) GetParams() ([]Param, ParamProgress) {
+	c.paramMutex.Lock()
+	defer c.paramMutex.Unlock()
+
+	params := make([]Param, 0, len(c.params))
+	for _, param := range c.params {
+		params = append(params, param)
+	}
+	sort.Slice(params, func(i, j int) bool {
+		return params[i].Name < params[j].Name
+	})
+	return params, c.paramProgressLocked()
+}
+
+// GetParamProgress returns how much of the plane's parameter list has been downloaded.
+func (c *Client) GetParamProgress() ParamProgress {
+	c.paramMutex.Lock()
+	defer c.paramMutex.Unlock()
+
+	return c.paramProgressLocked()
+}
+
+// GetParam returns the cached value of a parameter. The second return value is
+// false if the parameter has not been received from the plane.
+func (c *Client) GetParam(name string) (Param, bool) {
+	c.paramMutex.Lock()
+	defer c.paramMutex.Unlock()
+
+	param, ok := c.params[name]
+	return param, ok
+}
+
+// ReadParam requests a single parameter from the plane with PARAM_REQUEST_READ and
+// waits for its PARAM_VALUE, which also updates the cache. Returns ErrParamNotFound
+// if the plane never responds, since autopilots ignore requests for unknown names.
+func (c *Client) ReadParam(name string) (Param, error) {
+	if len(name) > paramNameLength {
+		return Param{}, ErrParamNameTooLong
+	}
+	targetSystem, targetComponent, err := c.GetPlaneIDs()
+	if err != nil {
+		return Param{}, err
+	}
+
+	param, _, err := c.waitForParam(name, func(int) msg.Message {
+		return &common.MessageParamRequestRead{
+			TargetSystem:    targetSystem,
+			TargetComponent: targetComponent,
+			ParamId:         name,
+			ParamIndex:      -1,
+		}
+	})
+	if errors.Is(err, errParamTimeout) {
+		return Param{}, ErrParamNotFound
+	}
+	return param, err
+}
+
+// SetParam sets a parameter on the plane with PARAM_SET and verifies the value the
+// plane reports back in PARAM_VALUE. The parameter is read from the plane first if it
+// is not cached, since PARAM_SET has to carry the parameter's type.
+//
+// An error is only returned if the parameter could not be set at all. Whether the
+// plane kept the requested value is reported in the ParamSetResult.
+func (c *Client) SetParam(name string, value float32) (ParamSetResult, error) {
+	result := ParamSetResult{Name: name, Requested: value, Result: ParamResultNotSent}
+
+	param, ok := c.GetParam(name)
+	if !ok {
+		var err error
+		if param, err = c.ReadParam(name); err != nil {
+			return result, err
+		}
+	}
+	targetSystem, targetComponent, err := c.GetPlaneIDs()
+	if err != nil {
+		return result, err
+	}
+
+	started := time.Now()
+	reported, attempts, err := c.waitForParam(name, func(int) msg.Message {
+		return &common.MessageParamSet{
+			TargetSystem:    targetSystem,
+			TargetComponent: targetComponent,
+			ParamId:         name,
+			ParamValue:      value,
+			ParamType:       param.paramType,
+		}
+	})
+	result.Attempts = attempts
+	result.Seconds = time.Since(started).Seconds()
+	switch {
+	case errors.Is(err, errParamTimeout):
+		result.Result = ParamResultTimeout
+		return result, nil
+	case err != nil:
+		return result, err
+	}
+
+	result.Value = reported.Value
+	result.Verified = paramValuesEqual(reported.Value, value)
+	if result.Verified {
+		result.Result = ParamResultVerified
+		Log.Infof("Set parameter %s to %v", name, value)
+	} else {
+		result.Result = ParamResultMismatch
+		Log.Warnf("Plane reported %s = %v after setting it to %v", name, reported.Value, value)
+	}
+	return result, nil
+}
+
+// errParamTimeout is returned by waitForParam when the plane never sent the parameter.
+var errParamTimeout = errors.New("timed out waiting for PARAM_VALUE")
+
+// waitForParam sends the message built by buildMsg and waits for a PARAM_VALUE with
+// the given name, resending up to paramMaxRetries times. attempt starts at 0 for the
+// first transmission. Returns the number of transmissions along with the parameter.
+func (c *Client) waitForParam(name string, buildMsg func(attempt int) msg.Message) (Param, int, error) {
+	values := make(chan Param, 1)
+	c.paramMutex.Lock()
+	if _, ok := c.pendingParams[name]; ok {
+		c.paramMutex.Unlock()
+		return Param{}, 0, ErrParamInProgress
+	}
+	c.pendingParams[name] = values
+	c.paramMutex.Unlock()
+
+	defer func() {
+		c.paramMutex.Lock()
+		delete(c.pendingParams, name)
+		c.paramMutex.Unlock()
+	}()
+
+	for attempt := 0; attempt <= paramMaxRetries; attempt++ {
+		if attempt > 0 {
+			Log.Warnf("No PARAM_VALUE for %s. Resending (retry %d/%d)", name, attempt, paramMaxRetries)
+		}
+		if err := c.SendToPlane(buildMsg(attempt)); err != nil {
+			return Param{}, attempt, err
+		}
+
+		select {
+		case param := <-values:
+			return param, attempt + 1, nil
+		case <-time.After(paramTimeout):
+		}
+	}
+	return Param{}, paramMaxRetries + 1, errParamTimeout
+}
+
+// updateParam stores a PARAM_VALUE from the plane in the cache, hands it to a read or
+// set waiting for it, and finishes the current download once every index has arrived.
+func (c *Client) updateParam(m *common.MessageParamValue) {
+	param := Param{
+		Name:      m.ParamId,
+		Value:     m.ParamValue,
+		Type:      paramTypeName(m.ParamType),
+		Index:     m.ParamIndex,
+		Updated:   time.Now(),
+		paramType: m.ParamType,
+	}
+
+	c.paramMutex.Lock()
+	defer c.paramMutex.Unlock()
+
+	c.params[param.Name] = param
+	c.paramCount = int(m.ParamCount)
+	// index 65535 is used for values sent outside of a download, like PARAM_SET echoes
+	if m.ParamIndex != math.MaxUint16 {
+		c.paramIndices[m.ParamIndex] = true
+	}
+	c.paramsUpdated = param.Updated
+
+	if values, ok := c.pendingParams[param.Name]; ok {
+		select {
+		case values <- param:
+		default:
+		}
+	}
+
+	if fetch := c.paramFetch; fetch != nil {
+		fetch.retries = 0
+		if len(c.paramIndices) >= c.paramCount {
+			c.finishParamFetchLocked()
+			Log.Infof("Downloaded all %d parameters", c.paramCount)
+		} else {
+			fetch.timer.Reset(paramTimeout)
+		}
+	}
+}
+
+// onParamFetchTimeout re-requests the parameters that are still missing once the plane
+// stops sending them, or gives up after paramMaxRetries rounds without progress.
+func (c *Client) onParamFetchTimeout() {
+	c.paramMutex.Lock()
+	fetch := c.paramFetch
+	if fetch == nil {
+		c.paramMutex.Unlock()
+		return
+	}
+	if fetch.retries >= paramMaxRetries {
+		received, total := len(c.paramIndices), c.paramCount
+		c.finishParamFetchLocked()
+		c.paramMutex.Unlock()
+		Log.Errorf("Parameter download timed out with %d of %d parameters received", received, total)
+		return
+	}
+	fetch.retries++
+	fetch.totalRetries++
+	fetch.timer.Reset(paramTimeout)
+	// handleParamValue resets retries once the mutex is released
+	retries := fetch.retries
+
+	// nothing has arrived yet, so the PARAM_REQUEST_LIST itself was probably lost
+	if c.paramCount < 0 {
+		c.paramMutex.Unlock()
+		Log.Warnf("No PARAM_VALUE received. Resending PARAM_REQUEST_LIST (retry %d/%d)", retries, paramMaxRetries)
+		if err := c.sendParamRequestList(fetch.targetSystem, fetch.targetComponent); err != nil {
+			Log.Errorf("Could not resend PARAM_REQUEST_LIST to plane. Reason: %s", err.Error())
+		}
+		return
+	}
+
+	missing := []uint16{}
+	for index := 0; index < c.paramCount && len(missing) < paramRequestBatch; index++ {
+		if !c.paramIndices[uint16(index)] {
+			missing = append(missing, uint16(index))
+		}
+	}
+	c.paramMutex.Unlock()
+
+	Log.Warnf("Re-requesting %d missing parameters (retry %d/%d)", len(missing), retries, paramMaxRetries)
+	for _, index := range missing {
+		err := c.SendToPlane(&common.MessageParamRequestRead{
+			TargetSystem:    fetch.targetSystem,
+			TargetComponent: fetch.targetComponent,
+			ParamIndex:      int16(index),
+		})
+		if err != nil {
+			Log.Errorf("Could not re-request parameter %d from plane. Reason: %s", index, err.Error())
+			return
+		}
+	}
+}
+
+// finishParamFetchLocked ends the current download. paramMutex must be held.
+func (c *Client) finishParamFetchLocked() {
+	c.paramFetch.timer.Stop()
+	c.paramFetchRetries = c.paramFetch.totalRetries
+	c.paramFetch = nil
+}
+
+// paramProgressLocked returns the download progress. paramMutex must be held.
+func (c *Client) paramProgressLocked() ParamProgress {
+	progress := ParamProgress{
+		Total:    c.paramCount,
+		Received: len(c.paramIndices),
+		Fetching: c.paramFetch != nil,
+		Retries:  c.paramFetchRetries,
+		Updated:  c.paramsUpdated,
+	}
+	if c.paramFetch != nil {
+		progress.Retries = c.paramFetch.totalRetries
+	}
+	progress.Complete = progress.Total >= 0 && progress.Received >= progress.Total
+	return progress
+}
+
+func (c *Client) sendParamRequestList(targetSystem byte, targetComponent byte) error {
+	return c.SendToPlane(&common.MessageParamRequestList{
+		TargetSystem:    targetSystem,
+		TargetComponent: targetComponent,
+	})
+}
+
+// paramValuesEqual compares parameter values, allowing for the rounding of autopilots
+// that store parameters at a lower precision than they receive them.
+func paramValuesEqual(a float32, b float32) bool {
+	return paramValuesClose(a, b, 1e-6)
+}
+
+// paramTypeName returns the name of a MAV_PARAM_TYPE without its prefix.
+func paramTypeName(paramType common.MAV_PARAM_TYPE) string {
+	if name, ok := paramTypeNames[paramType]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
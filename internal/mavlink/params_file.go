@@ -0,0 +1,163 @@
+package mav
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrParamsIncomplete is returned when comparing against the plane's parameters
+// before all of them have been downloaded (see StartParamFetch).
+var ErrParamsIncomplete = errors.New("the plane's parameters have not been fully downloaded")
+
+// DefaultParamDiffTolerance is the relative difference below which a live value is
+// considered equal to the value in a parameter file. Parameter files store values in
+// decimal with limited precision, while the plane stores them as float32.
+const DefaultParamDiffTolerance = 1e-5
+
+// ParamFileEntry is a single parameter of a parameter file.
+type ParamFileEntry struct {
+	Name  string  `json:"name"`
+	Value float32 `json:"value"`
+}
+
+// ParamChange is a parameter whose value on the plane differs from the parameter file.
+type ParamChange struct {
+	Name string  `json:"name"`
+	File float32 `json:"file"`
+	Live float32 `json:"live"`
+}
+
+// ParamDiff compares a parameter file against the plane's live parameters.
+type ParamDiff struct {
+	// Added holds parameters that are on the plane but not in the file
+	Added []Param `json:"added"`
+	// Changed holds parameters whose values differ between the file and the plane
+	Changed []ParamChange `json:"changed"`
+	// Missing holds parameters that are in the file but not on the plane
+	Missing   []ParamFileEntry `json:"missing"`
+	Unchanged int              `json:"unchanged"`
+}
+
+// ParseParamFile reads a Mission Planner style parameter file, where each line holds
+// a parameter name and value separated by a comma, tab or spaces:
+//
+//	# comments start with #
+//	ARSPD_FBW_MAX,22
+//	RTL_ALTITUDE,100
+//
+// QGroundControl files, whose lines start with the system and component IDs
+// ("1	1	RTL_ALTITUDE	100	9"), are also accepted.
+func ParseParamFile(r io.Reader) ([]ParamFileEntry, error) {
+	entries := []ParamFileEntry{}
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == '\t' || r == ' '
+		})
+		// QGroundControl: sysid, compid, name, value, type
+		if len(fields) == 5 {
+			fields = fields[2:4]
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a parameter name and value, got %q", lineNumber, line)
+		}
+
+		name := fields[0]
+		if len(name) > paramNameLength {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, ErrParamNameTooLong)
+		}
+		value, err := strconv.ParseFloat(fields[1], 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value for %s: %w", lineNumber, name, err)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("line %d: %s appears more than once", lineNumber, name)
+		}
+		seen[name] = true
+
+		entries = append(entries, ParamFileEntry{Name: name, Value: float32(value)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// DiffParams compares the entries of a parameter file against the cached parameters
+// of the plane. Values within tolerance (relative to the larger value) are considered
+// equal. Returns ErrParamsIncomplete unless every parameter has been downloaded, since
+// parameters that have not arrived yet would show up as missing.
+func (c *Client) DiffParams(entries []ParamFileEntry, tolerance float64) (ParamDiff, error) {
+	params, progress := c.GetParams()
+	if !progress.Complete {
+		return ParamDiff{}, ErrParamsIncomplete
+	}
+
+	live := make(map[string]Param, len(params))
+	for _, param := range params {
+		live[param.Name] = param
+	}
+
+	diff := ParamDiff{Added: []Param{}, Changed: []ParamChange{}, Missing: []ParamFileEntry{}}
+	inFile := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		inFile[entry.Name] = true
+		param, ok := live[entry.Name]
+		switch {
+		case !ok:
+			diff.Missing = append(diff.Missing, entry)
+		case !paramValuesClose(param.Value, entry.Value, tolerance):
+			diff.Changed = append(diff.Changed, ParamChange{Name: entry.Name, File: entry.Value, Live: param.Value})
+		default:
+			diff.Unchanged++
+		}
+	}
+	for _, param := range params {
+		if !inFile[param.Name] {
+			diff.Added = append(diff.Added, param)
+		}
+	}
+
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Name < diff.Changed[j].Name
+	})
+	sort.Slice(diff.Missing, func(i, j int) bool {
+		return diff.Missing[i].Name < diff.Missing[j].Name
+	})
+	return diff, nil
+}
+
+// ApplyParams sets each parameter on the plane one at a time, verifying each one like
+// SetParam. A parameter that fails does not stop the rest from being applied; its
+// result has Result NOT_SENT and the reason in Error.
+func (c *Client) ApplyParams(entries []ParamFileEntry) []ParamSetResult {
+	results := make([]ParamSetResult, 0, len(entries))
+	for _, entry := range entries {
+		result, err := c.SetParam(entry.Name, entry.Value)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// paramValuesClose reports whether two parameter values differ by at most tolerance
+// relative to the larger of the two.
+func paramValuesClose(a float32, b float32, tolerance float64) bool {
+	diff := math.Abs(float64(a) - float64(b))
+	return diff <= tolerance*math.Max(math.Abs(float64(a)), math.Abs(float64(b))) || diff < 1e-9
+}
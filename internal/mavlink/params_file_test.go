@@ -0,0 +1,57 @@
+package mav
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseParamFile(t *testing.T) {
+	entries, err := ParseParamFile(strings.NewReader(`# saved by Mission Planner
+ARSPD_FBW_MAX,22
+
+RTL_ALTITUDE 100.5
+1	1	TRIM_THROTTLE	45	9
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []ParamFileEntry{
+		{Name: "ARSPD_FBW_MAX", Value: 22},
+		{Name: "RTL_ALTITUDE", Value: 100.5},
+		{Name: "TRIM_THROTTLE", Value: 45},
+	}, entries)
+
+	_, err = ParseParamFile(strings.NewReader("ARSPD_FBW_MAX,fast"))
+	assert.ErrorContains(t, err, "line 1")
+	_, err = ParseParamFile(strings.NewReader("RTL_ALTITUDE,1\nRTL_ALTITUDE,2"))
+	assert.ErrorContains(t, err, "more than once")
+}
+
+func TestDiffParams(t *testing.T) {
+	c := &Client{
+		params: map[string]Param{
+			"ARSPD_FBW_MAX": {Name: "ARSPD_FBW_MAX", Value: 22},
+			"RTL_ALTITUDE":  {Name: "RTL_ALTITUDE", Value: 120},
+			"TECS_SINK_MAX": {Name: "TECS_SINK_MAX", Value: 0.1},
+		},
+		paramCount:   1,
+		paramIndices: map[uint16]bool{},
+	}
+	_, err := c.DiffParams(nil, DefaultParamDiffTolerance)
+	assert.ErrorIs(t, err, ErrParamsIncomplete)
+
+	c.paramCount = 3
+	c.paramIndices = map[uint16]bool{0: true, 1: true, 2: true}
+	diff, err := c.DiffParams([]ParamFileEntry{
+		{Name: "RTL_ALTITUDE", Value: 100},
+		{Name: "TECS_SINK_MAX", Value: 0.100001},
+		{Name: "Q_ENABLE", Value: 1},
+	}, DefaultParamDiffTolerance)
+	require.NoError(t, err)
+	assert.Equal(t, []ParamChange{{Name: "RTL_ALTITUDE", File: 100, Live: 120}}, diff.Changed)
+	assert.Equal(t, []ParamFileEntry{{Name: "Q_ENABLE", Value: 1}}, diff.Missing)
+	require.Len(t, diff.Added, 1)
+	assert.Equal(t, "ARSPD_FBW_MAX", diff.Added[0].Name)
+	assert.Equal(t, 1, diff.Unchanged)
+}
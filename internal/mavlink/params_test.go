@@ -0,0 +1,68 @@
+package mav
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParamFetch(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	ap.SetParams([]string{"ARSPD_FBW_MAX", "ARSPD_FBW_MIN", "RTL_ALTITUDE"}, []float32{22, 9, 100})
+	ap.DropParams(1)
+	c := newTestClient(t, port)
+
+	require.NoError(t, c.StartParamFetch())
+	require.Eventually(t, func() bool {
+		return c.GetParamProgress().Complete
+	}, 5*time.Second, 20*time.Millisecond)
+
+	params, progress := c.GetParams()
+	assert.Equal(t, 3, progress.Total)
+	assert.Equal(t, 3, progress.Received)
+	assert.False(t, progress.Fetching)
+	assert.Equal(t, 1, progress.Retries)
+	require.Len(t, params, 3)
+	assert.Equal(t, "ARSPD_FBW_MIN", params[1].Name)
+	assert.Equal(t, float32(9), params[1].Value)
+	assert.Equal(t, "REAL32", params[1].Type)
+
+	assert.Equal(t, []int16{1}, ap.ParamReads())
+}
+
+func TestSetParam(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	ap.SetParams([]string{"ARSPD_FBW_MAX", "RTL_ALTITUDE"}, []float32{22, 100})
+	ap.ClampParam("ARSPD_FBW_MAX", 30)
+	c := newTestClient(t, port)
+
+	// the parameter is not cached, so it is read before it is set
+	result, err := c.SetParam("RTL_ALTITUDE", 120.5)
+	require.NoError(t, err)
+	assert.True(t, result.Verified)
+	assert.Equal(t, ParamResultVerified, result.Result)
+	assert.Equal(t, float32(120.5), result.Value)
+	param, ok := c.GetParam("RTL_ALTITUDE")
+	require.True(t, ok)
+	assert.Equal(t, float32(120.5), param.Value)
+
+	result, err = c.SetParam("ARSPD_FBW_MAX", 35)
+	require.NoError(t, err)
+	assert.False(t, result.Verified)
+	assert.Equal(t, ParamResultMismatch, result.Result)
+	assert.Equal(t, float32(30), result.Value)
+
+	_, err = c.SetParam("A_VERY_LONG_PARAMETER_NAME", 1)
+	assert.ErrorIs(t, err, ErrParamNameTooLong)
+}
+
+func TestParamValuesEqual(t *testing.T) {
+	assert.True(t, paramValuesEqual(0, 0))
+	assert.True(t, paramValuesEqual(0.1, 0.1))
+	assert.True(t, paramValuesEqual(100000, 100000.01))
+	assert.False(t, paramValuesEqual(1, 1.001))
+}
@@ -1,93 +1,293 @@
 package mav
 
 import (
-	"net"
-	"strings"
-	"time"
+	"errors"
+	"math"
 
-	"github.com/goburrow/serial"
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/msg"
 )
 
+// ErrPlaneNotFound is returned when a message needs to be sent to the plane
+// but no HEARTBEAT from an autopilot has been received yet.
+var ErrPlaneNotFound = errors.New("no heartbeat has been received from the plane yet")
+
 // StartMissionUpload will send MISSION_COUNT to the plane
-// and startup the mission uploading sequence.
+// and startup the mission uploading sequence. The remaining steps are driven by
+// handleMissionUpload as the plane requests each item.
+//
+// The returned channel receives exactly one MissionUploadResult once the plane
+// acknowledges the mission or the transfer times out. Only one mission transfer
+// can be in progress at a time.
 //
 // See https://mavlink.io/en/services/mission.html#uploading_mission for details
 // on the entire mission uploading process.
-func (c *Client) StartMissionUpload() {
-	// TODO: place waypoints in a channel to be read
-	// by handleMissionUpload later
-
-	// c.mavlinkNode.WriteMessageAll()
-	// OR
-	// c.mavlinkNode.WriteMessageTo() need plane channel somehow
-	// maybe can store plane channel in EventChannelOpen if the systemID matches the plane's
+func (c *Client) StartMissionUpload(items []MissionItem) (<-chan MissionUploadResult, error) {
+	if len(items) == 0 {
+		return nil, ErrEmptyMission
+	}
+	if len(items) > math.MaxUint16 {
+		return nil, ErrMissionTooLarge
+	}
+
+	_, targetSystem, targetComponent, err := c.getPlaneChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	countMsg := &common.MessageMissionCount{
+		TargetSystem:    targetSystem,
+		TargetComponent: targetComponent,
+		Count:           uint16(len(items)),
+		MissionType:     common.MAV_MISSION_TYPE_MISSION,
+	}
+
+	c.missionMutex.Lock()
+	if c.missionUpload != nil || c.missionDownload != nil {
+		c.missionMutex.Unlock()
+		return nil, ErrMissionTransferInProgress
+	}
+
+	upload := &missionUpload{
+		missionTransfer: newMissionTransfer(targetSystem, targetComponent, countMsg, c.onMissionUploadTimeout),
+		items:           items,
+		done:            make(chan MissionUploadResult, 1),
+	}
+	c.missionUpload = upload
+	c.missionMutex.Unlock()
+
+	Log.Infof("Starting mission upload of %d items to system %d", len(items), targetSystem)
+	if err := c.SendToPlane(countMsg); err != nil {
+		c.finishMissionUpload(upload, MissionResultNotSent)
+	}
+
+	return upload.done, nil
 }
 
-// StartMissionDownload will send MISSION_REQUEST_INT to the plane
-// and startup the mission downloading sequence.
+// StartMissionDownload will send MISSION_REQUEST_LIST to the plane
+// and startup the mission downloading sequence. The remaining steps are driven by
+// handleMissionDownload as the plane sends MISSION_COUNT and each item.
+//
+// The returned channel receives exactly one MissionDownloadResult once every item
+// has been received or the transfer fails. A complete download also replaces the
+// mission returned by GetPlaneMission. Only one mission transfer can be in progress at a time.
 //
 // See https://mavlink.io/en/services/mission.html#download_mission for details
 // on the entire mission downloading process.
-func (c *Client) StartMissionDownload() {
-	// send a MISSION_REQUEST_INT to the plane
+func (c *Client) StartMissionDownload() (<-chan MissionDownloadResult, error) {
+	_, targetSystem, targetComponent, err := c.getPlaneChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	requestList := &common.MessageMissionRequestList{
+		TargetSystem:    targetSystem,
+		TargetComponent: targetComponent,
+		MissionType:     common.MAV_MISSION_TYPE_MISSION,
+	}
 
-	// c.mavlinkNode.WriteMessageAll()
-	// OR
-	// c.mavlinkNode.WriteMessageTo() need plane channel somehow
-	// maybe can store plane channel in EventChannelOpen if the systemID matches the plane's
+	c.missionMutex.Lock()
+	if c.missionUpload != nil || c.missionDownload != nil {
+		c.missionMutex.Unlock()
+		return nil, ErrMissionTransferInProgress
+	}
+
+	download := &missionDownload{
+		missionTransfer: newMissionTransfer(targetSystem, targetComponent, requestList, c.onMissionDownloadTimeout),
+		count:           -1,
+		done:            make(chan MissionDownloadResult, 1),
+	}
+	c.missionDownload = download
+	c.missionMutex.Unlock()
+
+	Log.Infof("Starting mission download from system %d", targetSystem)
+	if err := c.SendToPlane(requestList); err != nil {
+		c.finishMissionDownload(download, MissionResultNotSent)
+	}
 
+	return download.done, nil
 }
 
-// GetPlaneEndpoint will return a string represnetation of the plane's
-// mavlink endpoint. Example: "tcp:localhost:5760" or "serial:/dev/ttyUSB0"
-func (c *Client) GetPlaneEndpoint() (string, error) {
-	// TODO remove error type
-	return c.endpointConnInfo.Plane, nil
+// GetPlaneMission returns the last mission known to be on the plane, or nil if no
+// mission has been downloaded from (or accepted by) the plane yet.
+func (c *Client) GetPlaneMission() *PlaneMission {
+	c.missionMutex.Lock()
+	defer c.missionMutex.Unlock()
+
+	return c.planeMission
 }
 
-// verifyPlaneConnection will attempt to make a connection with the plane.
-// This function will hang until a connection is established.
-func (c *Client) verifyPlaneConnection() {
-	planeConnSplit := strings.Split(c.endpointConnInfo.Plane, ":")
-
-	planeConnType := planeConnSplit[0]
-	planeAddress := strings.Join(planeConnSplit[1:], ":")
-
-	switch planeConnType {
-	case "serial":
-		for {
-			_, err := serial.Open(&serial.Config{Address: planeAddress})
-			if err == nil {
-				c.connectedToPlane = true
-				Log.Infof("Successfully connected to plane at %s:%s", planeConnType, planeAddress)
-				return
-			}
-			c.connectedToPlane = false
-			Log.Warnf("Connection to plane failed at serial port %s. Trying to establish connection again in %d seconds...", planeAddress, planeConnRefreshTimer)
-			time.Sleep(time.Duration(planeConnRefreshTimer) * time.Second)
-		}
-	case "tcp":
-		fallthrough
-	case "udp":
-		for {
-			_, err := net.Dial(planeConnType, planeAddress)
-			if err == nil {
-				c.connectedToPlane = true
-				Log.Infof("Successfully connected to plane at %s:%s", planeConnType, planeAddress)
-				return
-			}
-			c.connectedToPlane = false
-			Log.Warnf("Connection to plane failed at %s:%s. Trying to establish connection again in %d seconds...", planeConnType, planeAddress, planeConnRefreshTimer)
-			time.Sleep(time.Duration(planeConnRefreshTimer) * time.Second)
+// outgoingMessage is a message waiting for Listen to write it to the plane's channel.
+type outgoingMessage struct {
+	message msg.Message
+	channel *gomavlib.Channel
+}
+
+// setMavlinkNode stores the node that Listen is currently reading from, along with
+// the configuration of the plane's endpoint, so that messages can be sent outside
+// of the Listen loop. Passing nil clears the node along with the plane's channel
+// since channels die with their node, and makes SendToPlane stop waiting for the
+// node's Listen loop.
+func (c *Client) setMavlinkNode(node *gomavlib.Node, planeEndpoint gomavlib.EndpointConf) {
+	c.planeMutex.Lock()
+	defer c.planeMutex.Unlock()
+
+	c.mavlinkNode = node
+	c.planeEndpointConf = planeEndpoint
+	c.planeEndpointChannel = nil
+	if node == nil {
+		c.planeChannel = nil
+		if c.listenDone != nil {
+			close(c.listenDone)
+			c.listenDone = nil
 		}
+	} else {
+		c.listenDone = make(chan struct{})
+	}
+}
+
+// trackOpenedChannel remembers the channel if it belongs to the plane's endpoint.
+// The plane itself is only considered found once it sends a HEARTBEAT (see setPlaneChannel).
+// Must be called after openRouterChannel, which finds out which endpoint the channel
+// belongs to.
+func (c *Client) trackOpenedChannel(channel *gomavlib.Channel) {
+	c.planeMutex.Lock()
+	defer c.planeMutex.Unlock()
+
+	if c.isPlaneEndpointChannel(channel) {
+		c.planeEndpointChannel = channel
+	}
+}
+
+// setPlaneChannel records which channel the plane's frames arrive on, and the
+// system/component IDs the plane uses.
+//
+// An autopilot heard on the plane's endpoint always wins. One heard on a router
+// endpoint (for example a SITL instance behind QGC) is only used while nothing
+// has been heard on the plane's endpoint.
+func (c *Client) setPlaneChannel(channel *gomavlib.Channel, sysID byte, compID byte) {
+	c.planeMutex.Lock()
+	defer c.planeMutex.Unlock()
+
+	onPlaneEndpoint := channel == c.planeEndpointChannel
+	if !onPlaneEndpoint && c.planeChannel != nil && c.planeChannel == c.planeEndpointChannel {
+		return
+	}
+
+	if c.planeChannel != channel || c.planeSystemID != sysID {
+		Log.Infof("Found plane (system %d, component %d) on channel %s", sysID, compID, channel)
+		c.requestMessageRates()
+	}
+	c.planeChannel = channel
+	c.planeSystemID = sysID
+	c.planeComponentID = compID
+}
+
+// forgetPlaneChannel clears the plane's channel if it matches the given channel.
+// Should be called when a channel closes so nothing gets written to a dead channel.
+func (c *Client) forgetPlaneChannel(channel *gomavlib.Channel) {
+	c.planeMutex.Lock()
+	defer c.planeMutex.Unlock()
+
+	if c.planeEndpointChannel == channel {
+		c.planeEndpointChannel = nil
+	}
+	if c.planeChannel == channel {
+		Log.Warnf("Lost the channel to the plane (system %d)", c.planeSystemID)
+		c.planeChannel = nil
+	}
+}
+
+// getPlaneChannel returns the plane's channel along with its system and component IDs.
+// Returns ErrPlaneNotFound if the plane has not been seen on any open channel.
+func (c *Client) getPlaneChannel() (*gomavlib.Channel, byte, byte, error) {
+	c.planeMutex.RLock()
+	defer c.planeMutex.RUnlock()
+
+	if c.mavlinkNode == nil || c.planeChannel == nil {
+		return nil, 0, 0, ErrPlaneNotFound
+	}
+	return c.planeChannel, c.planeSystemID, c.planeComponentID, nil
+}
+
+// isFromPlane reports whether a frame was sent by the plane.
+func (c *Client) isFromPlane(evt *gomavlib.EventFrame) bool {
+	c.planeMutex.RLock()
+	defer c.planeMutex.RUnlock()
+
+	return c.planeChannel == evt.Channel && c.planeSystemID == evt.SystemID()
+}
+
+// SendToPlane sends a message only to the channel the plane is connected on.
+// It is safe to call from any goroutine, including queued EventFrameHandlers and HTTP
+// handlers, but not from handlers that run on the Listen loop (see RegisterHandler).
+// Messages that need a target should use GetPlaneIDs to fill in the target system/component.
+//
+// Returns ErrPlaneNotFound if no HEARTBEAT has been received from the plane on an open channel.
+func (c *Client) SendToPlane(m msg.Message) error {
+	c.planeMutex.RLock()
+	if c.mavlinkNode == nil || c.planeChannel == nil {
+		c.planeMutex.RUnlock()
+		return ErrPlaneNotFound
+	}
+	if c.channelOptions(c.planeChannel).ReadOnly {
+		c.planeMutex.RUnlock()
+		return ErrEndpointReadOnly
+	}
+	out := outgoingMessage{message: m, channel: c.planeChannel}
+	listenDone := c.listenDone
+	c.planeMutex.RUnlock()
 
-	default:
-		c.connectedToPlane = false
-		Log.Errorf(`Invalid Mavlink plane connection type "%s" provided. Change the connection type to "udp", "tcp", or "serial"`, planeConnType)
-		// try again in a few seconds in the chance that the plane connection info has been updatd by the SetPlaneEndpoint method
-		time.Sleep(time.Duration(planeConnRefreshTimer) * time.Second)
-		c.verifyPlaneConnection()
+	// gomavlib's node stops running if it is asked to write to a channel it already
+	// removed, which it does concurrently with telling Listen the channel closed. So
+	// only Listen writes, since it knows which channels are still open.
+	select {
+	case c.outgoing <- out:
+		return nil
+	case <-listenDone:
+		return ErrPlaneNotFound
+	}
+}
+
+// writeOutgoing writes a message from SendToPlane on the Listen loop, unless the
+// plane's channel closed or changed since it was sent.
+func (c *Client) writeOutgoing(node *gomavlib.Node, out outgoingMessage) {
+	c.planeMutex.RLock()
+	open := c.planeChannel == out.channel
+	c.planeMutex.RUnlock()
 
+	if !open {
+		Log.Warnf("Dropped %s to the plane since its channel closed", MessageName(out.message))
+		return
 	}
+	node.WriteMessageTo(out.channel, out.message)
+}
 
+// writeToPlane writes a message to the plane's channel from the Listen loop, for
+// EventFrameHandlers that run on it and so can't wait for it in SendToPlane.
+func (c *Client) writeToPlane(node *gomavlib.Node, m msg.Message) error {
+	channel, _, _, err := c.getPlaneChannel()
+	if err != nil {
+		return err
+	}
+	if c.channelOptions(channel).ReadOnly {
+		return ErrEndpointReadOnly
+	}
+	c.writeOutgoing(node, outgoingMessage{message: m, channel: channel})
+	return nil
+}
+
+// GetPlaneIDs returns the system and component IDs of the plane.
+// Returns ErrPlaneNotFound if no HEARTBEAT has been received from the plane on an open channel.
+func (c *Client) GetPlaneIDs() (byte, byte, error) {
+	_, sysID, compID, err := c.getPlaneChannel()
+	return sysID, compID, err
+}
+
+// GetPlaneEndpoint will return a string represnetation of the plane's
+// mavlink endpoint. Example: "tcp:localhost:5760" or "serial:/dev/ttyUSB0"
+func (c *Client) GetPlaneEndpoint() (string, error) {
+	// TODO remove error type
+	return c.getEndpointConnInfo().Plane, nil
 }
@@ -0,0 +1,144 @@
+package mav
+
+import (
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/sirupsen/logrus"
+)
+
+// maxStateChanges is how many mode/arming changes are kept in PlaneState.RecentChanges
+const maxStateChanges = 50
+
+// systemStatusNames maps MAV_STATE values to their names in the MAVLink spec.
+// https://mavlink.io/en/messages/common.html#MAV_STATE
+var systemStatusNames = map[common.MAV_STATE]string{
+	common.MAV_STATE_UNINIT:             "UNINIT",
+	common.MAV_STATE_BOOT:               "BOOT",
+	common.MAV_STATE_CALIBRATING:        "CALIBRATING",
+	common.MAV_STATE_STANDBY:            "STANDBY",
+	common.MAV_STATE_ACTIVE:             "ACTIVE",
+	common.MAV_STATE_CRITICAL:           "CRITICAL",
+	common.MAV_STATE_EMERGENCY:          "EMERGENCY",
+	common.MAV_STATE_POWEROFF:           "POWEROFF",
+	common.MAV_STATE_FLIGHT_TERMINATION: "FLIGHT_TERMINATION",
+}
+
+// modeFlagNames maps each MAV_MODE_FLAG bit to its name in the MAVLink spec.
+// https://mavlink.io/en/messages/common.html#MAV_MODE_FLAG
+var modeFlagNames = []struct {
+	flag common.MAV_MODE_FLAG
+	name string
+}{
+	{common.MAV_MODE_FLAG_SAFETY_ARMED, "SAFETY_ARMED"},
+	{common.MAV_MODE_FLAG_MANUAL_INPUT_ENABLED, "MANUAL_INPUT_ENABLED"},
+	{common.MAV_MODE_FLAG_HIL_ENABLED, "HIL_ENABLED"},
+	{common.MAV_MODE_FLAG_STABILIZE_ENABLED, "STABILIZE_ENABLED"},
+	{common.MAV_MODE_FLAG_GUIDED_ENABLED, "GUIDED_ENABLED"},
+	{common.MAV_MODE_FLAG_AUTO_ENABLED, "AUTO_ENABLED"},
+	{common.MAV_MODE_FLAG_TEST_ENABLED, "TEST_ENABLED"},
+	{common.MAV_MODE_FLAG_CUSTOM_MODE_ENABLED, "CUSTOM_MODE_ENABLED"},
+}
+
+// PlaneState is the flight mode and arming state of the plane, decoded from its HEARTBEAT.
+type PlaneState struct {
+	// Mode is the ArduPlane flight mode name, such as "AUTO" or "RTL"
+	Mode         string   `json:"mode"`
+	CustomMode   uint32   `json:"custom_mode"`
+	Armed        bool     `json:"armed"`
+	Guided       bool     `json:"guided"`
+	ModeFlags    []string `json:"mode_flags"`
+	SystemStatus string   `json:"system_status"`
+
+	LastHeartbeat time.Time          `json:"last_heartbeat"`
+	RecentChanges []PlaneStateChange `json:"recent_changes"`
+}
+
+// PlaneStateChange records a change of flight mode or arming state.
+type PlaneStateChange struct {
+	Time      time.Time `json:"time"`
+	FromMode  string    `json:"from_mode"`
+	ToMode    string    `json:"to_mode"`
+	FromArmed bool      `json:"from_armed"`
+	ToArmed   bool      `json:"to_armed"`
+}
+
+// GetPlaneState returns the plane's latest flight mode and arming state.
+// The second return value is false if no HEARTBEAT has been received from the plane yet.
+func (c *Client) GetPlaneState() (PlaneState, bool) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if c.planeState == nil {
+		return PlaneState{}, false
+	}
+	state := *c.planeState
+	state.ModeFlags = append([]string{}, c.planeState.ModeFlags...)
+	state.RecentChanges = append([]PlaneStateChange{}, c.planeState.RecentChanges...)
+	return state, true
+}
+
+// updatePlaneState decodes a HEARTBEAT from the plane and logs an event whenever the
+// flight mode or arming state changes.
+func (c *Client) updatePlaneState(msg *common.MessageHeartbeat) {
+	mode := "UNKNOWN"
+	if msg.Autopilot == common.MAV_AUTOPILOT_ARDUPILOTMEGA {
+		mode = arduPlaneModeName(msg.CustomMode)
+	}
+	armed := msg.BaseMode&common.MAV_MODE_FLAG_SAFETY_ARMED != 0
+
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if c.planeState == nil {
+		c.planeState = &PlaneState{RecentChanges: []PlaneStateChange{}}
+		Log.WithFields(logrus.Fields{"event": "plane_state", "mode": mode, "armed": armed}).
+			Infof("Plane is in %s mode", mode)
+	} else if c.planeState.Mode != mode || c.planeState.Armed != armed {
+		change := PlaneStateChange{
+			Time:      time.Now(),
+			FromMode:  c.planeState.Mode,
+			ToMode:    mode,
+			FromArmed: c.planeState.Armed,
+			ToArmed:   armed,
+		}
+		c.planeState.RecentChanges = append(c.planeState.RecentChanges, change)
+		if len(c.planeState.RecentChanges) > maxStateChanges {
+			c.planeState.RecentChanges = c.planeState.RecentChanges[1:]
+		}
+		Log.WithFields(logrus.Fields{
+			"event":      "mode_change",
+			"from_mode":  change.FromMode,
+			"to_mode":    change.ToMode,
+			"from_armed": change.FromArmed,
+			"to_armed":   change.ToArmed,
+		}).Infof("Plane changed from %s to %s mode (armed: %t)", change.FromMode, change.ToMode, armed)
+	}
+
+	c.planeState.Mode = mode
+	c.planeState.CustomMode = msg.CustomMode
+	c.planeState.Armed = armed
+	c.planeState.Guided = msg.BaseMode&common.MAV_MODE_FLAG_GUIDED_ENABLED != 0
+	c.planeState.ModeFlags = decodeModeFlags(msg.BaseMode)
+	c.planeState.SystemStatus = systemStatusName(msg.SystemStatus)
+	c.planeState.LastHeartbeat = time.Now()
+}
+
+// decodeModeFlags returns the names of the MAV_MODE_FLAG bits that are set.
+func decodeModeFlags(baseMode common.MAV_MODE_FLAG) []string {
+	flags := []string{}
+	for _, f := range modeFlagNames {
+		if baseMode&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
+
+// systemStatusName returns the MAVLink name of a MAV_STATE.
+func systemStatusName(status common.MAV_STATE) string {
+	if name, ok := systemStatusNames[status]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
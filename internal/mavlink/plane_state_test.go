@@ -0,0 +1,79 @@
+package mav
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlaneState(t *testing.T) {
+	c := &Client{}
+	_, ok := c.GetPlaneState()
+	assert.False(t, ok)
+
+	heartbeat := &common.MessageHeartbeat{
+		Type:         common.MAV_TYPE_FIXED_WING,
+		Autopilot:    common.MAV_AUTOPILOT_ARDUPILOTMEGA,
+		BaseMode:     common.MAV_MODE_FLAG_CUSTOM_MODE_ENABLED | common.MAV_MODE_FLAG_STABILIZE_ENABLED,
+		CustomMode:   5,
+		SystemStatus: common.MAV_STATE_STANDBY,
+	}
+	c.updatePlaneState(heartbeat)
+	c.updatePlaneState(heartbeat)
+
+	state, ok := c.GetPlaneState()
+	require.True(t, ok)
+	assert.Equal(t, "FBWA", state.Mode)
+	assert.False(t, state.Armed)
+	assert.False(t, state.Guided)
+	assert.Equal(t, "STANDBY", state.SystemStatus)
+	assert.Equal(t, []string{"STABILIZE_ENABLED", "CUSTOM_MODE_ENABLED"}, state.ModeFlags)
+	assert.Empty(t, state.RecentChanges)
+
+	heartbeat.BaseMode |= common.MAV_MODE_FLAG_SAFETY_ARMED | common.MAV_MODE_FLAG_GUIDED_ENABLED | common.MAV_MODE_FLAG_AUTO_ENABLED
+	heartbeat.CustomMode = 10
+	heartbeat.SystemStatus = common.MAV_STATE_ACTIVE
+	c.updatePlaneState(heartbeat)
+
+	state, _ = c.GetPlaneState()
+	assert.Equal(t, "AUTO", state.Mode)
+	assert.True(t, state.Armed)
+	assert.True(t, state.Guided)
+	assert.Equal(t, "ACTIVE", state.SystemStatus)
+	require.Len(t, state.RecentChanges, 1)
+	assert.Equal(t, PlaneStateChange{
+		Time:      state.RecentChanges[0].Time,
+		FromMode:  "FBWA",
+		ToMode:    "AUTO",
+		FromArmed: false,
+		ToArmed:   true,
+	}, state.RecentChanges[0])
+}
+
+func TestPlaneStateFromAutopilot(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	c := newTestClient(t, port)
+
+	result, err := c.Arm(false)
+	require.NoError(t, err)
+	require.True(t, result.Accepted)
+	result, err = c.SetMode("AUTO")
+	require.NoError(t, err)
+	require.True(t, result.Accepted)
+	assert.True(t, ap.Armed())
+
+	require.Eventually(t, func() bool {
+		state, ok := c.GetPlaneState()
+		return ok && state.Armed && state.Mode == "AUTO"
+	}, 5*time.Second, 20*time.Millisecond, "plane state never followed the autopilot")
+
+	// the autopilot's default trajectory circles at 18 m/s
+	require.Eventually(t, func() bool {
+		return math.Abs(c.GetMissionProgress().GroundSpeed-18) < 0.1
+	}, 5*time.Second, 20*time.Millisecond, "no position received from the autopilot")
+}
@@ -0,0 +1,60 @@
+package mav
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetPlaneChannelPrefersPlaneEndpoint(t *testing.T) {
+	c := &Client{}
+	routerChannel := &gomavlib.Channel{}
+	planeChannel := &gomavlib.Channel{}
+	c.mavlinkNode = &gomavlib.Node{}
+	c.planeEndpointChannel = planeChannel
+
+	// an autopilot behind a router endpoint is used until the plane is heard
+	c.setPlaneChannel(routerChannel, 2, 1)
+	channel, sysID, _, err := c.getPlaneChannel()
+	assert.NoError(t, err)
+	assert.Same(t, routerChannel, channel)
+	assert.Equal(t, byte(2), sysID)
+
+	c.setPlaneChannel(planeChannel, 1, 1)
+	c.setPlaneChannel(routerChannel, 2, 1)
+	channel, sysID, _, err = c.getPlaneChannel()
+	assert.NoError(t, err)
+	assert.Same(t, planeChannel, channel)
+	assert.Equal(t, byte(1), sysID)
+
+	c.forgetPlaneChannel(planeChannel)
+	_, _, _, err = c.getPlaneChannel()
+	assert.ErrorIs(t, err, ErrPlaneNotFound)
+	assert.ErrorIs(t, c.SendToPlane(&common.MessageHeartbeat{}), ErrPlaneNotFound)
+
+	// a message for a channel that closed before Listen got to it is dropped instead
+	// of being written by the node
+	c.writeOutgoing(nil, outgoingMessage{message: &common.MessageHeartbeat{}, channel: planeChannel})
+}
+
+func TestSendToPlaneAfterListenStops(t *testing.T) {
+	port := freeUDPPort(t)
+	ap := newTestAutopilot(t, port)
+	c := New(nil, "127.0.0.1", "1", fmt.Sprintf("udp:127.0.0.1:%d", port))
+	go c.Listen()
+	require.Eventually(t, c.IsConnectedToPlane, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, c.SendToPlane(&common.MessageHeartbeat{}))
+
+	// SendToPlane never waits for a Listen loop that stopped
+	c.Kill()
+	ap.Close()
+	assert.Eventually(t, func() bool {
+		return errors.Is(c.SendToPlane(&common.MessageHeartbeat{}), ErrPlaneNotFound)
+	}, 5*time.Second, 20*time.Millisecond)
+}
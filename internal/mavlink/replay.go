@@ -0,0 +1,410 @@
+package mav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/frame"
+)
+
+// ErrNoReplay is returned when controlling a replay while the plane endpoint isn't one.
+var ErrNoReplay = errors.New("the plane endpoint is not a tlog replay")
+
+// ErrInvalidTlog is returned for tlog files that can not be replayed.
+var ErrInvalidTlog = errors.New("invalid tlog")
+
+// ErrInvalidReplaySpeed is returned when setting a replay speed below 0.
+var ErrInvalidReplaySpeed = errors.New("the replay speed can not be negative")
+
+// ReplayStatus describes a tlog replay. Times are relative to the first frame of the tlog.
+type ReplayStatus struct {
+	File string `json:"file"`
+	// Speed is how many times faster than real time the tlog is played, or 0 if
+	// frames are played as fast as Hub can handle them
+	Speed           float64 `json:"speed"`
+	Paused          bool    `json:"paused"`
+	Finished        bool    `json:"finished"`
+	PositionSeconds float64 `json:"position_seconds"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// Frame is the number of frames played so far
+	Frame  int `json:"frame"`
+	Frames int `json:"frames"`
+	// Error is why the tlog could not be loaded, if it couldn't
+	Error string `json:"error,omitempty"`
+}
+
+// tlogRecord is a frame of a tlog and the time it was received.
+type tlogRecord struct {
+	received time.Time
+	frame    []byte
+}
+
+// tlogReplay plays the frames of a tlog as if they were arriving on a link. It is
+// used as the ReadWriteCloser of a gomavlib.EndpointCustom, so the node parses the
+// frames like any other endpoint's. Messages written to it are discarded.
+//
+// Playback is paced by the timestamps of the tlog. The replay pauses at the end of
+// the tlog rather than closing, so that it can still be seeked back.
+type tlogReplay struct {
+	path string
+	// configuredSpeed is the speed the endpoint was configured with. It never changes,
+	// unlike speed, so it can be read without the mutex.
+	configuredSpeed float64
+
+	loadOnce sync.Once
+	records  []tlogRecord
+	loadErr  error
+
+	mutex  sync.Mutex
+	speed  float64
+	paused bool
+	// position is the index of the next record to play
+	position int
+	// pending is the part of the current frame that has not been read yet
+	pending []byte
+	// the playback time of the tlog was anchorTlog at anchorWall
+	anchorWall time.Time
+	anchorTlog time.Time
+	// changed is closed and replaced whenever playback is changed, to wake up Read
+	changed chan struct{}
+	closed  bool
+	started bool
+}
+
+func newTlogReplay(path string, speed float64) *tlogReplay {
+	return &tlogReplay{path: path, configuredSpeed: speed, speed: speed, changed: make(chan struct{})}
+}
+
+// GetReplayStatus returns the status of the tlog replay of the plane endpoint.
+// Returns ErrNoReplay if the plane endpoint isn't a replay.
+func (c *Client) GetReplayStatus() (ReplayStatus, error) {
+	replay, err := c.getReplay()
+	if err != nil {
+		return ReplayStatus{}, err
+	}
+	return replay.status(), nil
+}
+
+// PauseReplay pauses the tlog replay of the plane endpoint.
+func (c *Client) PauseReplay() (ReplayStatus, error) {
+	return c.controlReplay(func(r *tlogReplay) error {
+		r.setPaused(true)
+		return nil
+	})
+}
+
+// ResumeReplay resumes the tlog replay of the plane endpoint.
+func (c *Client) ResumeReplay() (ReplayStatus, error) {
+	return c.controlReplay(func(r *tlogReplay) error {
+		r.setPaused(false)
+		return nil
+	})
+}
+
+// SeekReplay continues the tlog replay of the plane endpoint from the first frame
+// at or after position, relative to the start of the tlog.
+func (c *Client) SeekReplay(position time.Duration) (ReplayStatus, error) {
+	return c.controlReplay(func(r *tlogReplay) error {
+		return r.seek(position)
+	})
+}
+
+// SetReplaySpeed changes how many times faster than real time the tlog replay of the
+// plane endpoint plays. A speed of 0 plays frames as fast as Hub can handle them.
+func (c *Client) SetReplaySpeed(speed float64) (ReplayStatus, error) {
+	return c.controlReplay(func(r *tlogReplay) error {
+		return r.setSpeed(speed)
+	})
+}
+
+// controlReplay changes the replay of the plane endpoint and returns its new status.
+func (c *Client) controlReplay(control func(*tlogReplay) error) (ReplayStatus, error) {
+	replay, err := c.getReplay()
+	if err != nil {
+		return ReplayStatus{}, err
+	}
+	if err := control(replay); err != nil {
+		return replay.status(), err
+	}
+	return replay.status(), nil
+}
+
+// getReplay returns the replay of the plane endpoint.
+func (c *Client) getReplay() (*tlogReplay, error) {
+	c.planeMutex.RLock()
+	defer c.planeMutex.RUnlock()
+
+	if custom, ok := c.planeEndpointConf.(gomavlib.EndpointCustom); ok {
+		if replay, ok := custom.ReadWriteCloser.(*tlogReplay); ok {
+			return replay, nil
+		}
+	}
+	return nil, ErrNoReplay
+}
+
+// Read blocks until the next frame is due and returns it.
+func (r *tlogReplay) Read(p []byte) (int, error) {
+	if err := r.load(); err != nil {
+		return 0, err
+	}
+
+	r.mutex.Lock()
+	if !r.started {
+		// the tlog plays from the first time the node reads it
+		r.started = true
+		r.restartClockLocked()
+	}
+	r.mutex.Unlock()
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		r.mutex.Lock()
+		if r.closed {
+			r.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if len(r.pending) > 0 {
+			n := copy(p, r.pending)
+			r.pending = r.pending[n:]
+			r.mutex.Unlock()
+			return n, nil
+		}
+
+		changed := r.changed
+		var wait time.Duration
+		idle := r.paused || r.position >= len(r.records)
+		if !idle {
+			if r.speed > 0 {
+				wait = time.Until(r.dueLocked(r.position))
+			}
+			if wait <= 0 {
+				r.pending = r.records[r.position].frame
+				r.position++
+				r.mutex.Unlock()
+				continue
+			}
+		}
+		r.mutex.Unlock()
+
+		if idle {
+			<-changed
+			continue
+		}
+		if timer == nil {
+			timer = time.NewTimer(wait)
+		} else {
+			timer.Reset(wait)
+		}
+		select {
+		case <-changed:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// String describes the replay in logs the way it is written as an endpoint.
+func (r *tlogReplay) String() string {
+	return "replay:" + r.path
+}
+
+// Write discards messages sent to the replay.
+func (r *tlogReplay) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Close stops the replay.
+func (r *tlogReplay) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.closed {
+		r.closed = true
+		close(r.changed)
+	}
+	return nil
+}
+
+// load reads the tlog the first time it is needed.
+func (r *tlogReplay) load() error {
+	r.loadOnce.Do(func() {
+		// #nosec G304 – replaying any tlog Hub can read is the point
+		file, err := os.Open(r.path)
+		if err != nil {
+			r.loadErr = err
+			return
+		}
+		defer file.Close() //nolint: errcheck
+
+		records, err := readTlog(file)
+		if err != nil {
+			r.loadErr = fmt.Errorf("%s: %w", r.path, err)
+			Log.Errorf("Cannot replay tlog. Reason: %s", r.loadErr.Error())
+			return
+		}
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.records = records
+		r.restartClockLocked()
+		Log.Infof("Replaying %d frames from %s", len(records), r.path)
+	})
+	return r.loadErr
+}
+
+func (r *tlogReplay) setPaused(paused bool) {
+	r.load() //nolint: errcheck
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.paused == paused {
+		return
+	}
+	r.paused = paused
+	r.restartClockLocked()
+	r.wakeLocked()
+}
+
+func (r *tlogReplay) seek(position time.Duration) error {
+	if err := r.load(); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.records) == 0 {
+		return nil
+	}
+	target := r.records[0].received.Add(position)
+	r.position = sort.Search(len(r.records), func(i int) bool {
+		return !r.records[i].received.Before(target)
+	})
+	r.restartClockLocked()
+	r.wakeLocked()
+	return nil
+}
+
+func (r *tlogReplay) setSpeed(speed float64) error {
+	if speed < 0 {
+		return ErrInvalidReplaySpeed
+	}
+	r.load() //nolint: errcheck
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.speed = speed
+	r.restartClockLocked()
+	r.wakeLocked()
+	return nil
+}
+
+func (r *tlogReplay) status() ReplayStatus {
+	err := r.load()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := ReplayStatus{
+		File:     r.path,
+		Speed:    r.speed,
+		Paused:   r.paused,
+		Finished: r.position >= len(r.records),
+		Frame:    r.position,
+		Frames:   len(r.records),
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if len(r.records) > 0 {
+		start := r.records[0].received
+		status.DurationSeconds = r.records[len(r.records)-1].received.Sub(start).Seconds()
+		if r.position > 0 {
+			status.PositionSeconds = r.records[r.position-1].received.Sub(start).Seconds()
+		}
+	}
+	return status
+}
+
+// restartClockLocked makes the next frame due now, so that playback continues from
+// it after a pause, seek or change of speed. Must be called with mutex locked.
+func (r *tlogReplay) restartClockLocked() {
+	r.anchorWall = time.Now()
+	if r.position < len(r.records) {
+		r.anchorTlog = r.records[r.position].received
+	}
+}
+
+// dueLocked returns the time a record should be played at. Must be called with mutex
+// locked and a speed above 0.
+func (r *tlogReplay) dueLocked(index int) time.Time {
+	sinceAnchor := r.records[index].received.Sub(r.anchorTlog)
+	return r.anchorWall.Add(time.Duration(float64(sinceAnchor) / r.speed))
+}
+
+// wakeLocked wakes up Read after playback changed. Must be called with mutex locked.
+func (r *tlogReplay) wakeLocked() {
+	if !r.closed {
+		close(r.changed)
+		r.changed = make(chan struct{})
+	}
+}
+
+// readTlog reads every frame of a tlog, in the format written by StartTlog. A frame
+// cut off at the end of the file, as left by a recording that was interrupted, is
+// ignored.
+func readTlog(reader io.Reader) ([]tlogRecord, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []tlogRecord{}
+	for offset := 0; offset+8 < len(data); {
+		received := time.UnixMicro(int64(binary.BigEndian.Uint64(data[offset:])))
+		start := offset + 8
+
+		var length int
+		switch data[start] {
+		case frame.V2MagicByte:
+			if start+3 > len(data) {
+				return records, nil
+			}
+			length = v2FrameOverhead + int(data[start+1])
+			if data[start+2]&frame.V2FlagSigned != 0 {
+				length += v2SignatureBytes
+			}
+		case frame.V1MagicByte:
+			if start+2 > len(data) {
+				return records, nil
+			}
+			length = v1FrameOverhead + int(data[start+1])
+		default:
+			return records, fmt.Errorf("%w: no mavlink frame at byte %d", ErrInvalidTlog, start)
+		}
+		if start+length > len(data) {
+			return records, nil
+		}
+
+		records = append(records, tlogRecord{received: received, frame: data[start : start+length]})
+		offset = start + length
+	}
+	return records, nil
+}
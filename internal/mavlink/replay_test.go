@@ -0,0 +1,214 @@
+package mav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialect"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/msg"
+	"github.com/aler9/gomavlib/pkg/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTlogStart is when the frames of test tlogs were received.
+var testTlogStart = time.UnixMicro(1680350400000000)
+
+// testTlogRecord is a message of a test tlog and when it was received relative to testTlogStart.
+type testTlogRecord struct {
+	offset  time.Duration
+	message msg.Message
+}
+
+// writeTestTlog writes messages sent by system 1 to a tlog and returns its path.
+func writeTestTlog(t *testing.T, records []testTlogRecord) string {
+	t.Helper()
+	de, err := dialect.NewDecEncoder(common.Dialect)
+	require.NoError(t, err)
+
+	var encoded bytes.Buffer
+	writer, err := parser.NewWriter(parser.WriterConf{
+		Writer:      &encoded,
+		DialectDE:   de,
+		OutVersion:  parser.V2,
+		OutSystemID: 1,
+	})
+	require.NoError(t, err)
+
+	var data []byte
+	for _, record := range records {
+		encoded.Reset()
+		require.NoError(t, writer.WriteMessage(record.message))
+		data = binary.BigEndian.AppendUint64(data, uint64(testTlogStart.Add(record.offset).UnixMicro()))
+		data = append(data, encoded.Bytes()...)
+	}
+
+	path := filepath.Join(t.TempDir(), "flight.tlog")
+	require.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+var testHeartbeat = &common.MessageHeartbeat{
+	Type:         common.MAV_TYPE_FIXED_WING,
+	Autopilot:    common.MAV_AUTOPILOT_ARDUPILOTMEGA,
+	BaseMode:     common.MAV_MODE_FLAG_CUSTOM_MODE_ENABLED | common.MAV_MODE_FLAG_SAFETY_ARMED,
+	CustomMode:   10,
+	SystemStatus: common.MAV_STATE_ACTIVE,
+}
+
+func TestReadTlog(t *testing.T) {
+	path := writeTestTlog(t, []testTlogRecord{
+		{0, testHeartbeat},
+		{time.Second, &common.MessageMissionCurrent{Seq: 2}},
+		{1500 * time.Millisecond, testHeartbeat},
+	})
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	records, err := readTlog(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.True(t, testTlogStart.Add(time.Second).Equal(records[1].received))
+	assert.Equal(t, 8+len(records[0].frame)+8+len(records[1].frame)+8+len(records[2].frame), len(data))
+
+	// a recording that was cut off mid-frame keeps its complete frames
+	records, err = readTlog(bytes.NewReader(data[:len(data)-5]))
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	_, err = readTlog(bytes.NewReader(append(data, make([]byte, 12)...)))
+	assert.ErrorIs(t, err, ErrInvalidTlog)
+}
+
+func TestTlogReplayControls(t *testing.T) {
+	path := writeTestTlog(t, []testTlogRecord{
+		{0, testHeartbeat},
+		{time.Second, testHeartbeat},
+		{2 * time.Second, testHeartbeat},
+	})
+	replay := newTlogReplay(path, 0)
+	buf := make([]byte, 512)
+
+	for i := 0; i < 3; i++ {
+		_, err := replay.Read(buf)
+		require.NoError(t, err)
+	}
+	status := replay.status()
+	assert.True(t, status.Finished)
+	assert.Equal(t, 3, status.Frame)
+	assert.Equal(t, 2.0, status.DurationSeconds)
+	assert.Equal(t, 2.0, status.PositionSeconds)
+
+	require.NoError(t, replay.seek(500*time.Millisecond))
+	status = replay.status()
+	assert.False(t, status.Finished)
+	assert.Equal(t, 1, status.Frame)
+
+	// a paused replay doesn't play frames until it is resumed
+	replay.setPaused(true)
+	read := make(chan error)
+	go func() {
+		_, err := replay.Read(buf)
+		read <- err
+	}()
+	select {
+	case <-read:
+		t.Fatal("frame was played while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	replay.setPaused(false)
+	assert.NoError(t, <-read)
+	assert.Equal(t, 2, replay.status().Frame)
+
+	assert.ErrorIs(t, replay.setSpeed(-1), ErrInvalidReplaySpeed)
+
+	// closing stops a Read waiting at the end of the tlog
+	_, err := replay.Read(buf)
+	require.NoError(t, err)
+	go func() {
+		_, err := replay.Read(buf)
+		read <- err
+	}()
+	require.NoError(t, replay.Close())
+	assert.ErrorIs(t, <-read, io.EOF)
+}
+
+func TestTlogReplayPacing(t *testing.T) {
+	path := writeTestTlog(t, []testTlogRecord{
+		{0, testHeartbeat},
+		{time.Second, testHeartbeat},
+		{2 * time.Second, testHeartbeat},
+	})
+	replay := newTlogReplay(path, 10)
+	buf := make([]byte, 512)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := replay.Read(buf)
+		require.NoError(t, err)
+	}
+	// 2 seconds of tlog at 10 times real time
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 190*time.Millisecond)
+	assert.Less(t, elapsed, time.Second)
+}
+
+func TestReplayEndpoint(t *testing.T) {
+	path := writeTestTlog(t, []testTlogRecord{
+		{0, testHeartbeat},
+		{100 * time.Millisecond, &common.MessageParamValue{ParamId: "WP_RADIUS", ParamValue: 30, ParamType: common.MAV_PARAM_TYPE_REAL32, ParamCount: 1, ParamIndex: 0}},
+		{200 * time.Millisecond, &common.MessageMissionCurrent{Seq: 3}},
+		{time.Second, testHeartbeat},
+	})
+
+	_, err := (&Client{}).GetReplayStatus()
+	assert.ErrorIs(t, err, ErrNoReplay)
+
+	c := New(nil, "127.0.0.1", "1", fmt.Sprintf("replay:%s?speed=max", path))
+	go c.Listen()
+	t.Cleanup(c.Kill)
+
+	require.Eventually(t, func() bool {
+		status, err := c.GetReplayStatus()
+		return err == nil && status.Finished
+	}, 5*time.Second, 20*time.Millisecond, "replay never finished")
+
+	// the frames went through the handlers as if a plane had sent them
+	require.Eventually(t, func() bool {
+		_, ok := c.GetParam("WP_RADIUS")
+		return ok && c.GetMissionProgress().CurrentSeq == 3
+	}, 5*time.Second, 20*time.Millisecond)
+	state, ok := c.GetPlaneState()
+	require.True(t, ok)
+	assert.Equal(t, "AUTO", state.Mode)
+	assert.True(t, state.Armed)
+	assert.True(t, c.IsConnectedToPlane())
+
+	endpoint, err := c.GetPlaneEndpoint()
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("replay:%s?speed=max", path), endpoint)
+
+	// seeking back plays the rest of the tlog again
+	status, err := c.PauseReplay()
+	require.NoError(t, err)
+	assert.True(t, status.Paused)
+	status, err = c.SeekReplay(150 * time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, 2, status.Frame)
+	_, err = c.ResumeReplay()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		status, err := c.GetReplayStatus()
+		return err == nil && status.Finished
+	}, 5*time.Second, 20*time.Millisecond)
+
+	_, err = c.SetReplaySpeed(-2)
+	assert.ErrorIs(t, err, ErrInvalidReplaySpeed)
+}
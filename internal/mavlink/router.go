@@ -0,0 +1,341 @@
+package mav
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/aler9/gomavlib"
+)
+
+// ErrEndpointReadOnly is returned when sending a message to a channel whose endpoint
+// has the readonly option.
+var ErrEndpointReadOnly = errors.New("the mavlink endpoint is read-only")
+
+// rateLimitTolerance lets frames through slightly before their rate limit allows, so
+// that jitter on a link does not cause a message sent at exactly the limit to be dropped.
+const rateLimitTolerance = 0.9
+
+// Route is a system and component that frames have been received from, along with
+// the channel they were received on. Frames addressed to that system are only routed
+// to the channels it has been heard on.
+type Route struct {
+	SystemID    uint8  `json:"system_id"`
+	ComponentID uint8  `json:"component_id"`
+	Endpoint    string `json:"endpoint"`
+	// Channel tells apart the channels of server endpoints, such as the address of a
+	// client connected to a tcpin endpoint
+	Channel  string    `json:"channel"`
+	Frames   uint64    `json:"frames"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// routeKey identifies a system and component behind a channel.
+type routeKey struct {
+	channel     *gomavlib.Channel
+	systemID    uint8
+	componentID uint8
+}
+
+// routerChannel is an open channel of the mavlink node along with the options of the
+// endpoint it was opened by.
+type routerChannel struct {
+	options  EndpointOptions
+	endpoint string
+	// plane is true if the channel belongs to the plane's endpoint
+	plane bool
+
+	// filtered is true if any frames might not be forwarded to this channel
+	filtered      bool
+	allowMessages map[uint32]bool
+	denyMessages  map[uint32]bool
+	allowSystems  map[uint8]bool
+	denySystems   map[uint8]bool
+	minIntervals  map[uint32]time.Duration
+
+	// lastForwarded is when each rate limited message was last forwarded to this
+	// channel from each system and component. Only used by the Listen loop.
+	lastForwarded map[rateLimitKey]time.Time
+}
+
+// rateLimitKey identifies a stream of messages that is rate limited on its own.
+type rateLimitKey struct {
+	messageID   uint32
+	systemID    uint8
+	componentID uint8
+}
+
+func newRouterChannel(options EndpointOptions) *routerChannel {
+	rc := &routerChannel{
+		options:       options,
+		allowMessages: make(map[uint32]bool),
+		denyMessages:  make(map[uint32]bool),
+		allowSystems:  make(map[uint8]bool),
+		denySystems:   make(map[uint8]bool),
+		minIntervals:  make(map[uint32]time.Duration),
+		lastForwarded: make(map[rateLimitKey]time.Time),
+	}
+	for _, id := range options.AllowMessages {
+		rc.allowMessages[id] = true
+	}
+	for _, id := range options.DenyMessages {
+		rc.denyMessages[id] = true
+	}
+	for _, id := range options.AllowSystems {
+		rc.allowSystems[id] = true
+	}
+	for _, id := range options.DenySystems {
+		rc.denySystems[id] = true
+	}
+	for id, rate := range options.RateLimits {
+		rc.minIntervals[id] = time.Duration(float64(time.Second) / rate)
+	}
+
+	rc.filtered = options.ReadOnly || len(rc.allowMessages) > 0 || len(rc.denyMessages) > 0 ||
+		len(rc.allowSystems) > 0 || len(rc.denySystems) > 0 || len(rc.minIntervals) > 0
+	return rc
+}
+
+// accepts reports whether a frame should be forwarded to the channel, and records it
+// for rate limiting if so.
+func (rc *routerChannel) accepts(evt *gomavlib.EventFrame, now time.Time) bool {
+	if rc.options.ReadOnly {
+		return false
+	}
+
+	messageID := evt.Frame.GetMessage().GetID()
+	if (len(rc.allowMessages) > 0 && !rc.allowMessages[messageID]) || rc.denyMessages[messageID] {
+		return false
+	}
+	systemID := evt.SystemID()
+	if (len(rc.allowSystems) > 0 && !rc.allowSystems[systemID]) || rc.denySystems[systemID] {
+		return false
+	}
+
+	minInterval, limited := rc.minIntervals[messageID]
+	if !limited {
+		return true
+	}
+	key := rateLimitKey{messageID: messageID, systemID: systemID, componentID: evt.ComponentID()}
+	if last, ok := rc.lastForwarded[key]; ok && now.Sub(last) < time.Duration(float64(minInterval)*rateLimitTolerance) {
+		return false
+	}
+	rc.lastForwarded[key] = now
+	return true
+}
+
+// endpointConfig is an endpoint the node is created with, along with its options.
+// The options are kept next to the conf rather than keyed by it, since the plane and
+// a router endpoint may have identical confs with different options.
+type endpointConfig struct {
+	conf    gomavlib.EndpointConf
+	options EndpointOptions
+	plane   bool
+	// endpoint is the endpoint the node created from conf, once it opened a channel
+	endpoint gomavlib.Endpoint
+}
+
+// setEndpointConfigs replaces the configuration of every endpoint before a new node
+// is created, and forgets the channels of the previous node.
+func (c *Client) setEndpointConfigs(configs []*endpointConfig) {
+	c.routerMutex.Lock()
+	defer c.routerMutex.Unlock()
+
+	c.endpointConfigs = configs
+	c.routerChannels = make(map[*gomavlib.Channel]*routerChannel)
+	c.routes = make(map[routeKey]*Route)
+	c.hasFilteredChannels = false
+}
+
+// openRouterChannel starts routing frames to and from a channel that just opened.
+func (c *Client) openRouterChannel(channel *gomavlib.Channel) {
+	c.routerMutex.Lock()
+	defer c.routerMutex.Unlock()
+
+	conf := channel.Endpoint().Conf()
+	var rc *routerChannel
+	if config := c.endpointConfigLocked(channel.Endpoint()); config != nil {
+		rc = newRouterChannel(config.options)
+		rc.plane = config.plane
+	} else {
+		rc = newRouterChannel(EndpointOptions{})
+	}
+	rc.endpoint, _ = StringifyEndpoint(conf) //nolint: errcheck
+	c.routerChannels[channel] = rc
+	if rc.filtered {
+		c.hasFilteredChannels = true
+	}
+}
+
+// endpointConfigLocked returns the configuration an endpoint of the node was created
+// from, or nil if there is none. The node does not say which of its confs an endpoint
+// came from, so the first config with an equal conf that isn't taken by another
+// endpoint yet is taken by this one. routerMutex must be held for writing.
+func (c *Client) endpointConfigLocked(endpoint gomavlib.Endpoint) *endpointConfig {
+	for _, config := range c.endpointConfigs {
+		if config.endpoint == endpoint {
+			return config
+		}
+	}
+	// compared with reflect.DeepEqual since custom endpoints may not be comparable
+	for _, config := range c.endpointConfigs {
+		if config.endpoint == nil && reflect.DeepEqual(config.conf, endpoint.Conf()) {
+			config.endpoint = endpoint
+			return config
+		}
+	}
+	return nil
+}
+
+// isPlaneEndpointChannel reports whether a channel belongs to the plane's endpoint.
+func (c *Client) isPlaneEndpointChannel(channel *gomavlib.Channel) bool {
+	c.routerMutex.RLock()
+	defer c.routerMutex.RUnlock()
+
+	rc, ok := c.routerChannels[channel]
+	return ok && rc.plane
+}
+
+// closeRouterChannel stops routing frames to a channel that closed and forgets the
+// routes through it.
+//
+// This has to run on the Listen loop before any more frames are routed: gomavlib's
+// node stops running if it is asked to write to a channel it already removed, and it
+// only removes a channel after the Listen loop has received its EventChannelClose.
+func (c *Client) closeRouterChannel(channel *gomavlib.Channel) {
+	c.routerMutex.Lock()
+	defer c.routerMutex.Unlock()
+
+	delete(c.routerChannels, channel)
+	for key := range c.routes {
+		if key.channel == channel {
+			delete(c.routes, key)
+		}
+	}
+	c.hasFilteredChannels = false
+	for _, rc := range c.routerChannels {
+		if rc.filtered {
+			c.hasFilteredChannels = true
+		}
+	}
+}
+
+// channelOptions returns the options of the endpoint a channel belongs to.
+func (c *Client) channelOptions(channel *gomavlib.Channel) EndpointOptions {
+	c.routerMutex.RLock()
+	defer c.routerMutex.RUnlock()
+
+	if rc, ok := c.routerChannels[channel]; ok {
+		return rc.options
+	}
+	return EndpointOptions{}
+}
+
+// GetRoutes returns every system and component that has been heard on an open
+// channel, sorted by system and component.
+func (c *Client) GetRoutes() []Route {
+	c.routerMutex.RLock()
+	defer c.routerMutex.RUnlock()
+
+	routes := make([]Route, 0, len(c.routes))
+	for _, route := range c.routes {
+		routes = append(routes, *route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].SystemID != routes[j].SystemID {
+			return routes[i].SystemID < routes[j].SystemID
+		}
+		if routes[i].ComponentID != routes[j].ComponentID {
+			return routes[i].ComponentID < routes[j].ComponentID
+		}
+		return routes[i].Channel < routes[j].Channel
+	})
+	return routes
+}
+
+// routeFrame learns the route to the sender of a frame and forwards the frame like a
+// MAVLink router: messages addressed to a system (see messageTarget) only go to the
+// channels that system has been heard on, and everything else goes to every channel
+// except the one it came from. The options of every channel's endpoint are followed
+// too: frames from no-forward channels are not forwarded at all, and read-only
+// channels or the allow/deny lists and rate limits of a channel can keep a frame from
+// it. Must only be called on the Listen loop (see closeRouterChannel).
+func (c *Client) routeFrame(evt *gomavlib.EventFrame, node *gomavlib.Node) {
+	c.routerMutex.Lock()
+	defer c.routerMutex.Unlock()
+
+	now := time.Now()
+	c.learnRoute(evt, now)
+
+	if source, ok := c.routerChannels[evt.Channel]; ok && source.options.NoForward {
+		return
+	}
+	if targetSystem, _, targeted := messageTarget(evt.Frame.GetMessage()); (!targeted || targetSystem == 0) && !c.hasFilteredChannels {
+		node.WriteFrameExcept(evt.Channel, evt.Frame)
+		return
+	}
+	for _, channel := range c.frameDestinations(evt, now) {
+		node.WriteFrameTo(channel, evt.Frame)
+	}
+}
+
+// learnRoute records that the sender of a frame can be reached through the channel
+// the frame came from. Must be called with routerMutex locked.
+func (c *Client) learnRoute(evt *gomavlib.EventFrame, now time.Time) {
+	rc, ok := c.routerChannels[evt.Channel]
+	if !ok {
+		return
+	}
+
+	key := routeKey{channel: evt.Channel, systemID: evt.SystemID(), componentID: evt.ComponentID()}
+	route, ok := c.routes[key]
+	if !ok {
+		route = &Route{
+			SystemID:    key.systemID,
+			ComponentID: key.componentID,
+			Endpoint:    rc.endpoint,
+			Channel:     evt.Channel.String(),
+		}
+		c.routes[key] = route
+		Log.Infof("Learned route to system %d component %d through %s", key.systemID, key.componentID, route.Channel)
+	}
+	route.Frames++
+	route.LastSeen = now
+}
+
+// frameDestinations returns the channels a frame should be forwarded to. A frame
+// addressed to a component goes to the channels that component has been heard on,
+// or to the channels of its system if the component has not been heard from yet.
+// Frames addressed to a system that has not been heard from are not forwarded at all.
+// Must be called with routerMutex locked.
+func (c *Client) frameDestinations(evt *gomavlib.EventFrame, now time.Time) []*gomavlib.Channel {
+	targets := make(map[*gomavlib.Channel]bool)
+	if targetSystem, targetComponent, targeted := messageTarget(evt.Frame.GetMessage()); targeted && targetSystem != 0 {
+		systemChannels := make(map[*gomavlib.Channel]bool)
+		for key := range c.routes {
+			if key.systemID != targetSystem {
+				continue
+			}
+			systemChannels[key.channel] = true
+			if targetComponent == 0 || key.componentID == targetComponent {
+				targets[key.channel] = true
+			}
+		}
+		if len(targets) == 0 {
+			targets = systemChannels
+		}
+	} else {
+		for channel := range c.routerChannels {
+			targets[channel] = true
+		}
+	}
+
+	destinations := make([]*gomavlib.Channel, 0, len(targets))
+	for channel := range targets {
+		if rc, ok := c.routerChannels[channel]; ok && channel != evt.Channel && rc.accepts(evt, now) {
+			destinations = append(destinations, channel)
+		}
+	}
+	return destinations
+}
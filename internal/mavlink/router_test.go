@@ -0,0 +1,142 @@
+package mav
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/frame"
+	"github.com/aler9/gomavlib/pkg/msg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func routedFrame(systemID uint8, message msg.Message) *gomavlib.EventFrame {
+	return &gomavlib.EventFrame{Frame: &frame.V2Frame{SystemID: systemID, ComponentID: 1, Message: message}}
+}
+
+func TestRouterChannelFilters(t *testing.T) {
+	now := time.Now()
+
+	rc := newRouterChannel(EndpointOptions{})
+	assert.False(t, rc.filtered)
+	assert.True(t, rc.accepts(routedFrame(1, &common.MessageHeartbeat{}), now))
+
+	rc = newRouterChannel(EndpointOptions{ReadOnly: true})
+	assert.True(t, rc.filtered)
+	assert.False(t, rc.accepts(routedFrame(1, &common.MessageHeartbeat{}), now))
+
+	rc = newRouterChannel(EndpointOptions{AllowMessages: []uint32{0}, DenySystems: []uint8{255}})
+	assert.True(t, rc.accepts(routedFrame(1, &common.MessageHeartbeat{}), now))
+	assert.False(t, rc.accepts(routedFrame(1, &common.MessageAttitude{}), now))
+	assert.False(t, rc.accepts(routedFrame(255, &common.MessageHeartbeat{}), now))
+
+	rc = newRouterChannel(EndpointOptions{DenyMessages: []uint32{22}, AllowSystems: []uint8{1}})
+	assert.True(t, rc.accepts(routedFrame(1, &common.MessageHeartbeat{}), now))
+	assert.False(t, rc.accepts(routedFrame(1, &common.MessageParamValue{}), now))
+	assert.False(t, rc.accepts(routedFrame(2, &common.MessageHeartbeat{}), now))
+}
+
+func TestRouterChannelRateLimit(t *testing.T) {
+	rc := newRouterChannel(EndpointOptions{RateLimits: map[uint32]float64{30: 2}})
+	now := time.Now()
+
+	assert.True(t, rc.accepts(routedFrame(1, &common.MessageAttitude{}), now))
+	assert.False(t, rc.accepts(routedFrame(1, &common.MessageAttitude{}), now.Add(100*time.Millisecond)))
+	// other systems and messages are limited separately
+	assert.True(t, rc.accepts(routedFrame(2, &common.MessageAttitude{}), now.Add(100*time.Millisecond)))
+	assert.True(t, rc.accepts(routedFrame(1, &common.MessageHeartbeat{}), now.Add(100*time.Millisecond)))
+	// slightly early frames are let through
+	assert.True(t, rc.accepts(routedFrame(1, &common.MessageAttitude{}), now.Add(480*time.Millisecond)))
+	assert.False(t, rc.accepts(routedFrame(1, &common.MessageAttitude{}), now.Add(700*time.Millisecond)))
+	assert.True(t, rc.accepts(routedFrame(1, &common.MessageAttitude{}), now.Add(1000*time.Millisecond)))
+}
+
+func TestRoutingTable(t *testing.T) {
+	c := &Client{}
+	c.setEndpointConfigs(nil)
+	plane, gcs, tracker := &gomavlib.Channel{}, &gomavlib.Channel{}, &gomavlib.Channel{}
+	c.routerChannels[plane] = newRouterChannel(EndpointOptions{})
+	c.routerChannels[gcs] = newRouterChannel(EndpointOptions{})
+	c.routerChannels[tracker] = newRouterChannel(EndpointOptions{})
+
+	heard := func(channel *gomavlib.Channel, systemID uint8, componentID uint8, message msg.Message) *gomavlib.EventFrame {
+		evt := &gomavlib.EventFrame{
+			Frame:   &frame.V2Frame{SystemID: systemID, ComponentID: componentID, Message: message},
+			Channel: channel,
+		}
+		c.learnRoute(evt, time.Now())
+		return evt
+	}
+	heard(plane, 1, 1, &common.MessageHeartbeat{})
+	heard(plane, 1, 100, &common.MessageHeartbeat{})
+	heard(tracker, 2, 1, &common.MessageHeartbeat{})
+
+	// untargeted frames go everywhere but back
+	evt := heard(gcs, 255, 190, &common.MessageHeartbeat{})
+	assert.ElementsMatch(t, []*gomavlib.Channel{plane, tracker}, c.frameDestinations(evt, time.Now()))
+	evt = heard(gcs, 255, 190, &common.MessageCommandLong{TargetSystem: 0})
+	assert.ElementsMatch(t, []*gomavlib.Channel{plane, tracker}, c.frameDestinations(evt, time.Now()))
+
+	// targeted frames only go to their system
+	evt = heard(gcs, 255, 190, &common.MessageCommandLong{TargetSystem: 1, TargetComponent: 1})
+	assert.Equal(t, []*gomavlib.Channel{plane}, c.frameDestinations(evt, time.Now()))
+	evt = heard(gcs, 255, 190, &common.MessageCommandLong{TargetSystem: 1, TargetComponent: 50})
+	assert.Equal(t, []*gomavlib.Channel{plane}, c.frameDestinations(evt, time.Now()))
+	evt = heard(plane, 1, 1, &common.MessageParamValue{})
+	assert.ElementsMatch(t, []*gomavlib.Channel{gcs, tracker}, c.frameDestinations(evt, time.Now()))
+	evt = heard(plane, 1, 1, &common.MessageMissionRequestInt{TargetSystem: 255})
+	assert.Equal(t, []*gomavlib.Channel{gcs}, c.frameDestinations(evt, time.Now()))
+	evt = heard(gcs, 255, 190, &common.MessageCommandLong{TargetSystem: 42})
+	assert.Empty(t, c.frameDestinations(evt, time.Now()))
+
+	routes := c.GetRoutes()
+	require.Len(t, routes, 4)
+	assert.Equal(t, uint8(1), routes[0].SystemID)
+	assert.Equal(t, uint8(1), routes[0].ComponentID)
+	assert.Equal(t, uint64(3), routes[0].Frames)
+	assert.Equal(t, uint8(255), routes[3].SystemID)
+
+	c.closeRouterChannel(plane)
+	assert.Len(t, c.GetRoutes(), 2)
+	evt = heard(gcs, 255, 190, &common.MessageCommandLong{TargetSystem: 1})
+	assert.Empty(t, c.frameDestinations(evt, time.Now()))
+}
+
+func TestIdenticalEndpointConfs(t *testing.T) {
+	port := freeUDPPort(t)
+	address := fmt.Sprintf("udp:127.0.0.1:%d", port)
+	plane, planeOptions, err := ParseEndpoint(address)
+	require.NoError(t, err)
+	router, routerOptions, err := ParseEndpoint(address + "?readonly")
+	require.NoError(t, err)
+
+	c := &Client{}
+	c.setEndpointConfigs([]*endpointConfig{
+		{conf: plane, options: planeOptions, plane: true},
+		{conf: router, options: routerOptions},
+	})
+	node, err := gomavlib.NewNode(gomavlib.NodeConf{
+		Endpoints:   []gomavlib.EndpointConf{router, plane},
+		Dialect:     common.Dialect,
+		OutVersion:  gomavlib.V2,
+		OutSystemID: systemID,
+	})
+	require.NoError(t, err)
+	t.Cleanup(node.Close)
+
+	// each endpoint gets the options of one of the confs, whichever opens first
+	var channels []*gomavlib.Channel
+	for len(channels) < 2 {
+		if evt, ok := (<-node.Events()).(*gomavlib.EventChannelOpen); ok {
+			c.openRouterChannel(evt.Channel)
+			channels = append(channels, evt.Channel)
+		}
+	}
+	assert.NotEqual(t, c.isPlaneEndpointChannel(channels[0]), c.isPlaneEndpointChannel(channels[1]))
+	for _, channel := range channels {
+		assert.Equal(t, !c.isPlaneEndpointChannel(channel), c.channelOptions(channel).ReadOnly)
+	}
+}
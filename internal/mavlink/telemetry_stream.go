@@ -0,0 +1,268 @@
+package mav
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/msg"
+)
+
+// ErrInvalidTelemetryRate is returned when subscribing to telemetry at a negative rate.
+var ErrInvalidTelemetryRate = errors.New("the telemetry rate can not be negative")
+
+// telemetryStreamBuffer is how many updates a stream holds for a slow reader before
+// new updates are dropped for it.
+const telemetryStreamBuffer = 64
+
+// TelemetrySubscription chooses the telemetry sent to a TelemetryStream.
+type TelemetrySubscription struct {
+	// Messages are the names or IDs of the messages to send. Every message is sent if
+	// it is empty.
+	Messages []string `json:"messages"`
+	// Fields are the fields to send from every message, such as "lat" or "voltage0".
+	// Every field is sent if it is empty.
+	Fields []string `json:"fields"`
+	// MaxRate is how many updates of each message are sent per second at most.
+	// Updates that arrive too soon after the last one sent are skipped. 0 sends
+	// every update.
+	MaxRate float64 `json:"max_rate"`
+}
+
+// TelemetryUpdate is a message received from the plane, with its fields named like in
+// the MAVLink spec and its enums named (see messageFields).
+type TelemetryUpdate struct {
+	Message  string                 `json:"message"`
+	ID       uint32                 `json:"id"`
+	SystemID uint8                  `json:"system_id"`
+	Time     time.Time              `json:"time"`
+	Fields   map[string]interface{} `json:"fields"`
+}
+
+// TelemetryStream receives the telemetry of the plane chosen by its subscription as it
+// arrives. Updates are dropped while the stream's buffer is full, so a slow reader
+// never holds up the client.
+type TelemetryStream struct {
+	client  *Client
+	updates chan TelemetryUpdate
+	done    chan struct{}
+	once    sync.Once
+
+	// mutex protects the subscription and when each message was last sent
+	mutex    sync.Mutex
+	messages map[uint32]bool
+	fields   map[string]bool
+	interval time.Duration
+	lastSent map[uint32]time.Time
+	dropped  uint64
+}
+
+// SubscribeTelemetry starts a stream of the plane's telemetry. Returns an error if a
+// message is unknown or the rate is negative. Close the stream once done with it.
+func (c *Client) SubscribeTelemetry(sub TelemetrySubscription) (*TelemetryStream, error) {
+	stream := &TelemetryStream{
+		client:  c,
+		updates: make(chan TelemetryUpdate, telemetryStreamBuffer),
+		done:    make(chan struct{}),
+	}
+	if err := stream.Resubscribe(sub); err != nil {
+		return nil, err
+	}
+
+	c.streamsMutex.Lock()
+	defer c.streamsMutex.Unlock()
+
+	c.telemetryStreams[stream] = true
+	return stream, nil
+}
+
+// Updates returns the channel updates arrive on. It is closed once the stream is
+// closed.
+func (s *TelemetryStream) Updates() <-chan TelemetryUpdate {
+	return s.updates
+}
+
+// Done is closed once the stream is closed, either by Close or by Listen stopping.
+func (s *TelemetryStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Dropped returns how many updates were dropped because the buffer was full.
+func (s *TelemetryStream) Dropped() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.dropped
+}
+
+// Resubscribe replaces the subscription of the stream. Returns an error without
+// changing anything if a message is unknown or the rate is negative.
+func (s *TelemetryStream) Resubscribe(sub TelemetrySubscription) error {
+	if sub.MaxRate < 0 {
+		return ErrInvalidTelemetryRate
+	}
+	ids, err := parseMessageList(sub.Messages)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = messageSet(ids)
+	s.fields = fieldSet(sub.Fields)
+	s.interval = 0
+	if sub.MaxRate > 0 {
+		s.interval = time.Duration(float64(time.Second) / sub.MaxRate)
+	}
+	s.lastSent = make(map[uint32]time.Time)
+	return nil
+}
+
+// Close stops the stream. It is safe to call more than once.
+func (s *TelemetryStream) Close() {
+	s.client.streamsMutex.Lock()
+	delete(s.client.telemetryStreams, s)
+	s.client.streamsMutex.Unlock()
+
+	s.close()
+}
+
+// close closes the channels of the stream. Must be called after the stream was
+// removed from telemetryStreams, or with streamsMutex locked, so that nothing sends
+// on them afterwards.
+func (s *TelemetryStream) close() {
+	s.once.Do(func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		close(s.done)
+		close(s.updates)
+	})
+}
+
+// wantsLocked reports whether the stream is subscribed to a message and due another
+// update of it. Must be called with mutex locked.
+func (s *TelemetryStream) wantsLocked(msgID uint32, now time.Time) bool {
+	if len(s.messages) > 0 && !s.messages[msgID] {
+		return false
+	}
+	return s.interval == 0 || now.Sub(s.lastSent[msgID]) >= s.interval
+}
+
+// send sends an update to the stream if it is subscribed to it, keeping only the
+// subscribed fields.
+func (s *TelemetryStream) send(update TelemetryUpdate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.wantsLocked(update.ID, update.Time) {
+		return
+	}
+	if len(s.fields) > 0 {
+		update.Fields = filterFields(update.Fields, s.fields)
+		if len(update.Fields) == 0 {
+			return
+		}
+	}
+
+	select {
+	case s.updates <- update:
+		s.lastSent[update.ID] = update.Time
+	default:
+		s.dropped++
+	}
+}
+
+// streamTelemetry sends every frame from the plane to the telemetry streams that are
+// subscribed to it. Messages outside the common dialect have no fields, so they are
+// never streamed.
+func (c *Client) streamTelemetry(evt *gomavlib.EventFrame, _ *gomavlib.Node) {
+	if !c.isFromPlane(evt) {
+		return
+	}
+	if _, unknown := evt.Frame.GetMessage().(*msg.MessageRaw); unknown {
+		return
+	}
+
+	c.streamsMutex.RLock()
+	defer c.streamsMutex.RUnlock()
+
+	if len(c.telemetryStreams) == 0 {
+		return
+	}
+
+	m := evt.Frame.GetMessage()
+	now := time.Now()
+	var update *TelemetryUpdate
+	for stream := range c.telemetryStreams {
+		stream.mutex.Lock()
+		wanted := stream.wantsLocked(m.GetID(), now)
+		stream.mutex.Unlock()
+		if !wanted {
+			continue
+		}
+
+		// the fields are only worked out once, and only if a stream wants them
+		if update == nil {
+			update = &TelemetryUpdate{
+				Message:  MessageName(m),
+				ID:       m.GetID(),
+				SystemID: evt.SystemID(),
+				Time:     now,
+				Fields:   telemetryFields(m, true),
+			}
+		}
+		stream.send(*update)
+	}
+}
+
+// closeTelemetryStreams closes every telemetry stream once Listen stops.
+func (c *Client) closeTelemetryStreams() {
+	c.streamsMutex.Lock()
+	defer c.streamsMutex.Unlock()
+
+	for stream := range c.telemetryStreams {
+		stream.close()
+		delete(c.telemetryStreams, stream)
+	}
+}
+
+// telemetryFields returns the fields of a message like messageFields. HEARTBEATs from
+// ArduPilot also get the flight mode name and arming state, which are packed into
+// custom_mode and base_mode.
+func telemetryFields(m msg.Message, enumNames bool) map[string]interface{} {
+	fields := messageFields(m, enumNames)
+	if heartbeat, ok := m.(*common.MessageHeartbeat); ok {
+		if heartbeat.Autopilot == common.MAV_AUTOPILOT_ARDUPILOTMEGA {
+			fields["mode"] = arduPlaneModeName(heartbeat.CustomMode)
+		}
+		fields["armed"] = heartbeat.BaseMode&common.MAV_MODE_FLAG_SAFETY_ARMED != 0
+	}
+	return fields
+}
+
+// telemetryFieldNames returns the lowercase names of every field telemetryFields
+// returns for a message in the common dialect, or nil if the message isn't in it.
+func telemetryFieldNames(id uint32) map[string]bool {
+	for _, m := range common.Dialect.Messages {
+		if m.GetID() != id {
+			continue
+		}
+		template := reflect.New(reflect.TypeOf(m).Elem()).Interface().(msg.Message)
+		if heartbeat, ok := template.(*common.MessageHeartbeat); ok {
+			// the flight mode is only there for ArduPilot
+			heartbeat.Autopilot = common.MAV_AUTOPILOT_ARDUPILOTMEGA
+		}
+		names := make(map[string]bool)
+		for name := range telemetryFields(template, false) {
+			names[strings.ToLower(name)] = true
+		}
+		return names
+	}
+	return nil
+}
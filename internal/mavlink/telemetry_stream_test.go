@@ -0,0 +1,97 @@
+package mav
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nextUpdate returns the next update of a telemetry stream.
+func nextUpdate(t *testing.T, stream *TelemetryStream) TelemetryUpdate {
+	t.Helper()
+	select {
+	case update, ok := <-stream.Updates():
+		require.True(t, ok, "stream was closed")
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatal("no telemetry update arrived")
+		return TelemetryUpdate{}
+	}
+}
+
+func TestTelemetryStream(t *testing.T) {
+	port := freeUDPPort(t)
+	newTestAutopilot(t, port)
+	c := newTestClient(t, port)
+
+	stream, err := c.SubscribeTelemetry(TelemetrySubscription{Messages: []string{"GLOBAL_POSITION_INT"}, Fields: []string{"lat,LON"}})
+	require.NoError(t, err)
+	update := nextUpdate(t, stream)
+	assert.Equal(t, "GLOBAL_POSITION_INT", update.Message)
+	assert.Equal(t, uint8(1), update.SystemID)
+	require.Len(t, update.Fields, 2)
+	assert.InDelta(t, 32.88e7, update.Fields["lat"], 0.01e7)
+
+	// the heartbeat carries the flight mode like in InfluxDB
+	require.NoError(t, stream.Resubscribe(TelemetrySubscription{Messages: []string{"HEARTBEAT"}}))
+	for update.Message != "HEARTBEAT" {
+		update = nextUpdate(t, stream)
+	}
+	assert.Equal(t, "MANUAL", update.Fields["mode"])
+	assert.Equal(t, "FIXED_WING", update.Fields["type"])
+
+	assert.ErrorIs(t, stream.Resubscribe(TelemetrySubscription{MaxRate: -1}), ErrInvalidTelemetryRate)
+	assert.Error(t, stream.Resubscribe(TelemetrySubscription{Messages: []string{"NOT_A_MESSAGE"}}))
+
+	stream.Close()
+	stream.Close()
+	for range stream.Updates() {
+		// drain what was buffered before closing
+	}
+}
+
+func TestTelemetryStreamRate(t *testing.T) {
+	port := freeUDPPort(t)
+	newTestAutopilot(t, port)
+	c := newTestClient(t, port)
+
+	// the autopilot sends ATTITUDE at 10 Hz
+	stream, err := c.SubscribeTelemetry(TelemetrySubscription{Messages: []string{"ATTITUDE"}, MaxRate: 2})
+	require.NoError(t, err)
+	defer stream.Close()
+
+	nextUpdate(t, stream)
+	received := 0
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case <-stream.Updates():
+			received++
+		case <-timeout:
+			done = true
+		}
+	}
+	assert.GreaterOrEqual(t, received, 1)
+	assert.LessOrEqual(t, received, 3, "ATTITUDE was not limited to 2 Hz")
+}
+
+func TestTelemetryStreamClosedWithListen(t *testing.T) {
+	port := freeUDPPort(t)
+	newTestAutopilot(t, port)
+	c := New(nil, "127.0.0.1", "1", fmt.Sprintf("udp:127.0.0.1:%d", port))
+	go c.Listen()
+
+	stream, err := c.SubscribeTelemetry(TelemetrySubscription{})
+	require.NoError(t, err)
+	nextUpdate(t, stream)
+
+	c.Kill()
+	select {
+	case <-stream.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed when Listen stopped")
+	}
+}
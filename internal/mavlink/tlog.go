@@ -0,0 +1,373 @@
+package mav
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/frame"
+)
+
+// ErrTlogRecording is returned when starting a tlog recording while one is already running.
+var ErrTlogRecording = errors.New("a tlog is already being recorded")
+
+// ErrTlogNotRecording is returned when stopping a tlog recording that isn't running.
+var ErrTlogNotRecording = errors.New("no tlog is being recorded")
+
+// ErrTlogNotFound is returned when looking up a tlog file that doesn't exist.
+var ErrTlogNotFound = errors.New("no tlog with this name exists")
+
+// DefaultTlogDir is the directory tlogs are recorded to until SetTlogDir is called.
+const DefaultTlogDir = "tlogs"
+
+// DefaultTlogMaxSize is the size in bytes at which a recording continues in a new file.
+const DefaultTlogMaxSize = 256 << 20
+
+// DefaultTlogMaxTotalSize is how many bytes of tlogs are kept until
+// SetTlogMaxTotalSize is called.
+const DefaultTlogMaxTotalSize = 4 << 30
+
+const (
+	tlogExtension = ".tlog"
+	// tlogTimeFormat names every recording after the time it started
+	tlogTimeFormat = "2006-01-02_15-04-05"
+	// tlogQueueSize is larger than other handlers' queues since every frame missed
+	// is missing from the recording for good
+	tlogQueueSize = 4096
+	// tlogFlushPeriod is how often buffered frames are written to disk
+	tlogFlushPeriod = time.Second
+)
+
+// TlogStatus describes the tlog recording in progress.
+type TlogStatus struct {
+	// Session is the name shared by every file of the recording
+	Session string    `json:"session"`
+	Started time.Time `json:"started"`
+	// Files holds the files of the recording, the last of which is being written to
+	Files  []string `json:"files"`
+	Frames uint64   `json:"frames"`
+	Bytes  int64    `json:"bytes"`
+}
+
+// TlogFile is a recorded tlog file.
+type TlogFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// tlogRecording is a recording in progress. Protected by tlogMutex.
+type tlogRecording struct {
+	session   string
+	started   time.Time
+	files     []string
+	file      *os.File
+	writer    *bufio.Writer
+	fileSize  int64
+	frames    uint64
+	bytes     int64
+	lastFlush time.Time
+}
+
+// SetTlogDir changes the directory tlogs are recorded to and listed from. A
+// recording in progress keeps writing to the directory it started in.
+func (c *Client) SetTlogDir(dir string) {
+	c.tlogMutex.Lock()
+	defer c.tlogMutex.Unlock()
+
+	c.tlogDir = dir
+}
+
+// SetTlogMaxTotalSize changes how many bytes of tlogs are kept in the tlog directory.
+// The oldest tlogs are deleted whenever a recording starts a new file that could
+// grow past it. 0 keeps every tlog.
+func (c *Client) SetTlogMaxTotalSize(size int64) {
+	c.tlogMutex.Lock()
+	defer c.tlogMutex.Unlock()
+
+	c.tlogMaxTotal = size
+}
+
+// StartTlog starts recording every frame received by the router to a new tlog
+// session, in the format used by Mission Planner: each frame is preceded by the time
+// it was received, as big-endian microseconds since the Unix epoch. The recording
+// continues in a new file whenever a file reaches DefaultTlogMaxSize.
+//
+// Returns ErrTlogRecording if a recording is already running.
+func (c *Client) StartTlog() (TlogStatus, error) {
+	c.tlogMutex.Lock()
+	defer c.tlogMutex.Unlock()
+
+	if c.tlog != nil {
+		return c.tlog.status(), ErrTlogRecording
+	}
+	if err := os.MkdirAll(c.tlogDir, 0750); err != nil {
+		return TlogStatus{}, err
+	}
+
+	started := time.Now()
+	session := started.Format(tlogTimeFormat)
+	// recordings started within the same second get a suffix
+	for i := 2; tlogExists(c.tlogDir, session); i++ {
+		session = fmt.Sprintf("%s-%d", started.Format(tlogTimeFormat), i)
+	}
+
+	recording := &tlogRecording{session: session, started: started, lastFlush: started}
+	if err := recording.openFile(c.tlogDir); err != nil {
+		return TlogStatus{}, err
+	}
+	c.tlog = recording
+	Log.Infof("Recording tlog %s", recording.files[0])
+	c.pruneTlogsLocked()
+	return recording.status(), nil
+}
+
+// StopTlog stops the tlog recording in progress and returns what was recorded.
+// Returns ErrTlogNotRecording if no recording is running.
+func (c *Client) StopTlog() (TlogStatus, error) {
+	c.tlogMutex.Lock()
+	defer c.tlogMutex.Unlock()
+
+	if c.tlog == nil {
+		return TlogStatus{}, ErrTlogNotRecording
+	}
+	recording := c.tlog
+	c.tlog = nil
+	err := recording.closeFile()
+	Log.Infof("Stopped recording tlog %s after %d frames", recording.session, recording.frames)
+	return recording.status(), err
+}
+
+// GetTlogStatus returns the tlog recording in progress. The second return value is
+// false if no recording is running.
+func (c *Client) GetTlogStatus() (TlogStatus, bool) {
+	c.tlogMutex.Lock()
+	defer c.tlogMutex.Unlock()
+
+	if c.tlog == nil {
+		return TlogStatus{}, false
+	}
+	return c.tlog.status(), true
+}
+
+// ListTlogs returns every tlog in the tlog directory, oldest first.
+func (c *Client) ListTlogs() ([]TlogFile, error) {
+	c.tlogMutex.Lock()
+	dir := c.tlogDir
+	c.tlogMutex.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []TlogFile{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	files := []TlogFile{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != tlogExtension {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, TlogFile{Name: entry.Name(), Size: info.Size(), Modified: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+// TlogPath returns the path of a tlog in the tlog directory from its name.
+// Returns ErrTlogNotFound for names that aren't tlogs in the directory.
+func (c *Client) TlogPath(name string) (string, error) {
+	c.tlogMutex.Lock()
+	dir := c.tlogDir
+	c.tlogMutex.Unlock()
+
+	if name != filepath.Base(name) || filepath.Ext(name) != tlogExtension {
+		return "", ErrTlogNotFound
+	}
+	path := filepath.Join(dir, name)
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return "", ErrTlogNotFound
+	}
+	return path, nil
+}
+
+// recordTlogFrame writes a frame to the tlog recording in progress, if any.
+func (c *Client) recordTlogFrame(evt *gomavlib.EventFrame, received time.Time) {
+	c.tlogMutex.Lock()
+	defer c.tlogMutex.Unlock()
+
+	if c.tlog == nil {
+		return
+	}
+	encoded, err := encodeFrame(evt.Frame)
+	if err != nil {
+		Log.Warnf("Cannot record message %d to tlog. Reason: %s", evt.Frame.GetMessage().GetID(), err.Error())
+		return
+	}
+	files := len(c.tlog.files)
+	if err := c.tlog.write(c.tlogDir, c.tlogMaxSize, encoded, received); err != nil {
+		Log.Errorf("Stopped recording tlog %s. Reason: %s", c.tlog.session, err.Error())
+		c.tlog.closeFile() //nolint: errcheck
+		c.tlog = nil
+		return
+	}
+	if len(c.tlog.files) != files {
+		c.pruneTlogsLocked()
+	}
+}
+
+// pruneTlogsLocked deletes the oldest tlogs until the file being recorded can grow to
+// tlogMaxSize without the tlogs taking up more than tlogMaxTotal. The file being
+// recorded is never deleted. tlogMutex must be held.
+func (c *Client) pruneTlogsLocked() {
+	if c.tlogMaxTotal <= 0 || c.tlog == nil {
+		return
+	}
+	entries, err := os.ReadDir(c.tlogDir)
+	if err != nil {
+		Log.Errorf("Cannot list tlogs to delete old ones. Reason: %s", err.Error())
+		return
+	}
+
+	recording := c.tlog.files[len(c.tlog.files)-1]
+	total := c.tlogMaxSize
+	old := []TlogFile{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || filepath.Ext(entry.Name()) != tlogExtension || entry.Name() == recording {
+			continue
+		}
+		total += info.Size()
+		old = append(old, TlogFile{Name: entry.Name(), Size: info.Size()})
+	}
+	// tlogs are named after the time they started, so they sort oldest first
+	sort.Slice(old, func(i, j int) bool {
+		return old[i].Name < old[j].Name
+	})
+
+	for _, file := range old {
+		if total <= c.tlogMaxTotal {
+			return
+		}
+		if err := os.Remove(filepath.Join(c.tlogDir, file.Name)); err != nil {
+			Log.Errorf("Cannot delete old tlog %s. Reason: %s", file.Name, err.Error())
+			return
+		}
+		Log.Infof("Deleted old tlog %s to stay under %d MB of tlogs", file.Name, c.tlogMaxTotal>>20)
+		total -= file.Size
+	}
+}
+
+// stopTlogIfRecording stops the tlog recording in progress, if any, when Listen stops.
+func (c *Client) stopTlogIfRecording() {
+	if _, err := c.StopTlog(); err != nil && !errors.Is(err, ErrTlogNotRecording) {
+		Log.Errorf("Cannot close tlog. Reason: %s", err.Error())
+	}
+}
+
+// write adds a timestamped frame to the recording, continuing in a new file first
+// if the current one would grow past maxSize.
+func (r *tlogRecording) write(dir string, maxSize int64, encoded []byte, received time.Time) error {
+	recordSize := int64(8 + len(encoded))
+	if r.fileSize > 0 && r.fileSize+recordSize > maxSize {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+		if err := r.openFile(dir); err != nil {
+			return err
+		}
+		Log.Infof("Continuing tlog recording in %s", r.files[len(r.files)-1])
+	}
+
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(received.UnixMicro()))
+	if _, err := r.writer.Write(timestamp[:]); err != nil {
+		return err
+	}
+	if _, err := r.writer.Write(encoded); err != nil {
+		return err
+	}
+	r.fileSize += recordSize
+	r.bytes += recordSize
+	r.frames++
+
+	if received.Sub(r.lastFlush) >= tlogFlushPeriod {
+		r.lastFlush = received
+		return r.writer.Flush()
+	}
+	return nil
+}
+
+// openFile creates the next file of the recording. The first file is named after
+// the session, and later ones get the number of the file as a suffix.
+func (r *tlogRecording) openFile(dir string) error {
+	name := r.session + tlogExtension
+	if len(r.files) > 0 {
+		name = fmt.Sprintf("%s_%d%s", r.session, len(r.files)+1, tlogExtension)
+	}
+	// #nosec G304 – the name is generated from the time the recording started
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	r.file = file
+	r.writer = bufio.NewWriter(file)
+	r.fileSize = 0
+	r.files = append(r.files, name)
+	return nil
+}
+
+// closeFile flushes and closes the file being written to.
+func (r *tlogRecording) closeFile() error {
+	flushErr := r.writer.Flush()
+	closeErr := r.file.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+func (r *tlogRecording) status() TlogStatus {
+	return TlogStatus{
+		Session: r.session,
+		Started: r.started,
+		Files:   append([]string{}, r.files...),
+		Frames:  r.frames,
+		Bytes:   r.bytes,
+	}
+}
+
+// tlogExists reports whether a recording with the given session name exists in dir.
+func tlogExists(dir string, session string) bool {
+	matches, _ := filepath.Glob(filepath.Join(dir, session+"*"+tlogExtension)) //nolint: errcheck
+	for _, match := range matches {
+		name := strings.TrimSuffix(filepath.Base(match), tlogExtension)
+		if name == session || strings.HasPrefix(name, session+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeFrame returns the bytes of a received frame as they were sent on the link.
+// Returns ErrPayloadMismatch if they can't be worked out from the decoded frame.
+func encodeFrame(f frame.Frame) ([]byte, error) {
+	payload, err := receivedPayload(f)
+	if err != nil {
+		return nil, err
+	}
+	return f.Encode(make([]byte, 0, v2FrameOverhead+v2SignatureBytes+len(payload)), payload)
+}
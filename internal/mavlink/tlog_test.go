@@ -0,0 +1,147 @@
+package mav
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib"
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/aler9/gomavlib/pkg/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withChecksum sets the checksum of a frame like its sender would.
+func withChecksum(t *testing.T, f *frame.V2Frame) *frame.V2Frame {
+	t.Helper()
+	payload, err := encodePayload(f)
+	require.NoError(t, err)
+	encoder, err := payloadEncoder(f.Message)
+	require.NoError(t, err)
+	f.Checksum = payloadChecksum(f, payload, encoder.CRCExtra())
+	return f
+}
+
+func TestReceivedPayload(t *testing.T) {
+	heartbeat := withChecksum(t, &frame.V2Frame{SystemID: 1, ComponentID: 1, Message: &common.MessageHeartbeat{MavlinkVersion: 3}})
+	payload, err := receivedPayload(heartbeat)
+	require.NoError(t, err)
+	assert.Len(t, payload, 9)
+
+	// a sender that doesn't truncate the zeros at the end of the payload
+	encoder, err := payloadEncoder(heartbeat.Message)
+	require.NoError(t, err)
+	untruncated := &frame.V2Frame{SystemID: 1, ComponentID: 1, Message: &common.MessageHeartbeat{}}
+	untruncated.Checksum = payloadChecksum(untruncated, make([]byte, 9), encoder.CRCExtra())
+	payload, err = receivedPayload(untruncated)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, 9), payload)
+
+	heartbeat.Checksum++
+	_, err = receivedPayload(heartbeat)
+	assert.ErrorIs(t, err, ErrPayloadMismatch)
+}
+
+func TestTlogRecording(t *testing.T) {
+	c := &Client{tlogDir: t.TempDir(), tlogMaxSize: DefaultTlogMaxSize}
+
+	_, err := c.StopTlog()
+	assert.ErrorIs(t, err, ErrTlogNotRecording)
+
+	status, err := c.StartTlog()
+	require.NoError(t, err)
+	_, err = c.StartTlog()
+	assert.ErrorIs(t, err, ErrTlogRecording)
+
+	received := time.UnixMicro(1680350400123456)
+	heartbeat := withChecksum(t, &frame.V2Frame{SequenceID: 7, SystemID: 1, ComponentID: 1, Message: &common.MessageHeartbeat{Type: common.MAV_TYPE_FIXED_WING}})
+	c.recordTlogFrame(&gomavlib.EventFrame{Frame: heartbeat}, received)
+	c.recordTlogFrame(&gomavlib.EventFrame{Frame: heartbeat}, received.Add(time.Second))
+
+	status, err = c.StopTlog()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), status.Frames)
+	require.Len(t, status.Files, 1)
+
+	data, err := os.ReadFile(filepath.Join(c.tlogDir, status.Files[0]))
+	require.NoError(t, err)
+	assert.Equal(t, status.Bytes, int64(len(data)))
+	assert.Equal(t, uint64(1680350400123456), binary.BigEndian.Uint64(data))
+	assert.Equal(t, byte(frame.V2MagicByte), data[8])
+	assert.Equal(t, byte(7), data[8+4])
+	recordSize := len(data) / 2
+	assert.Equal(t, uint64(1680350401123456), binary.BigEndian.Uint64(data[recordSize:]))
+
+	// frames are ignored once the recording stops
+	c.recordTlogFrame(&gomavlib.EventFrame{Frame: heartbeat}, received)
+	files, err := c.ListTlogs()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, int64(len(data)), files[0].Size)
+
+	path, err := c.TlogPath(files[0].Name)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(c.tlogDir, files[0].Name), path)
+	_, err = c.TlogPath("../" + files[0].Name)
+	assert.ErrorIs(t, err, ErrTlogNotFound)
+	_, err = c.TlogPath("missing.tlog")
+	assert.ErrorIs(t, err, ErrTlogNotFound)
+}
+
+func TestTlogRotation(t *testing.T) {
+	c := &Client{tlogDir: t.TempDir(), tlogMaxSize: 50}
+	first, err := c.StartTlog()
+	require.NoError(t, err)
+
+	heartbeat := withChecksum(t, &frame.V2Frame{SystemID: 1, ComponentID: 1, Message: &common.MessageHeartbeat{MavlinkVersion: 3}})
+	for i := 0; i < 3; i++ {
+		c.recordTlogFrame(&gomavlib.EventFrame{Frame: heartbeat}, time.Now())
+	}
+	status, err := c.StopTlog()
+	require.NoError(t, err)
+	// each record is 8+21 bytes, so only one fits in every file
+	assert.Equal(t, []string{first.Session + ".tlog", first.Session + "_2.tlog", first.Session + "_3.tlog"}, status.Files)
+
+	// a second recording in the same second gets its own name
+	second, err := c.StartTlog()
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Session, second.Session)
+	_, err = c.StopTlog()
+	require.NoError(t, err)
+
+	files, err := c.ListTlogs()
+	require.NoError(t, err)
+	assert.Len(t, files, 4)
+}
+
+func TestTlogRetention(t *testing.T) {
+	c := &Client{tlogDir: t.TempDir(), tlogMaxSize: 50}
+	for _, name := range []string{"2023-04-01_12-00-00.tlog", "2023-04-01_12-00-00_2.tlog", "2023-04-02_09-30-00.tlog"} {
+		require.NoError(t, os.WriteFile(filepath.Join(c.tlogDir, name), make([]byte, 40), 0600))
+	}
+	// room for the newest old tlog and a full file of the new recording
+	c.SetTlogMaxTotalSize(100)
+
+	status, err := c.StartTlog()
+	require.NoError(t, err)
+	files, err := c.ListTlogs()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, "2023-04-02_09-30-00.tlog", files[0].Name)
+
+	// starting a new file deletes old files of the same recording too
+	heartbeat := withChecksum(t, &frame.V2Frame{SystemID: 1, ComponentID: 1, Message: &common.MessageHeartbeat{MavlinkVersion: 3}})
+	for i := 0; i < 3; i++ {
+		c.recordTlogFrame(&gomavlib.EventFrame{Frame: heartbeat}, time.Now())
+	}
+	files, err = c.ListTlogs()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, status.Session+"_2.tlog", files[0].Name)
+	assert.Equal(t, status.Session+"_3.tlog", files[1].Name)
+	_, err = c.StopTlog()
+	require.NoError(t, err)
+}
@@ -0,0 +1,333 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aler9/gomavlib/pkg/dialects/common"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	mav "github.com/tritonuas/gcs/internal/mavlink"
+	"github.com/tritonuas/gcs/internal/mavlink/mavtest"
+	"github.com/tritonuas/gcs/internal/server"
+	"golang.org/x/net/websocket"
+)
+
+// newTestServer starts a fake autopilot and a mavlink client connected to it, and
+// returns the router of a server using the client once the plane has been found.
+func newTestServer(t *testing.T) (*mavtest.Autopilot, *gin.Engine) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	address, err := mavtest.FreeUDPAddress()
+	require.NoError(t, err)
+	ap, err := mavtest.NewAutopilot(mavtest.AutopilotConf{Address: address, HeartbeatPeriod: 50 * time.Millisecond})
+	require.NoError(t, err)
+	t.Cleanup(ap.Close)
+
+	mavlinkClient := mav.New(nil, "127.0.0.1", "1", ap.Endpoint())
+	go mavlinkClient.Listen()
+	t.Cleanup(mavlinkClient.Kill)
+	require.Eventually(t, mavlinkClient.IsConnectedToPlane, 5*time.Second, 20*time.Millisecond, "plane was never found")
+
+	return ap, server.New(nil, mavlinkClient, nil).SetupRouter()
+}
+
+// serve sends a request to the router and returns the response.
+func serve(router *gin.Engine, method string, path string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPlaneCommandRoutes(t *testing.T) {
+	ap, router := newTestServer(t)
+
+	w := serve(router, http.MethodPost, "/api/plane/command/arm", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serve(router, http.MethodPost, "/api/plane/command/set_mode", `{"mode": "AUTO"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serve(router, http.MethodPost, "/api/plane/command/set_mode", `{"mode": "BARREL_ROLL"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.True(t, ap.Armed())
+	assert.Equal(t, mavtest.ModeAuto, ap.Mode())
+
+	// the plane state follows once the autopilot's next heartbeat arrives
+	assert.Eventually(t, func() bool {
+		state := mav.PlaneState{}
+		w := serve(router, http.MethodGet, "/api/plane/state", "")
+		return w.Code == http.StatusOK && json.Unmarshal(w.Body.Bytes(), &state) == nil &&
+			state.Armed && state.Mode == "AUTO"
+	}, 5*time.Second, 20*time.Millisecond)
+
+	ap.SetCommandResult(common.MAV_RESULT_DENIED)
+	w = serve(router, http.MethodPost, "/api/plane/command/disarm", "")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.True(t, ap.Armed())
+}
+
+func TestPlaneParamRoutes(t *testing.T) {
+	ap, router := newTestServer(t)
+	ap.SetParams([]string{"ARSPD_FBW_MAX", "RTL_ALTITUDE"}, []float32{22, 100})
+
+	w := serve(router, http.MethodGet, "/api/plane/params/RTL_ALTITUDE", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	param := mav.Param{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &param))
+	assert.Equal(t, float32(100), param.Value)
+
+	w = serve(router, http.MethodPut, "/api/plane/params/RTL_ALTITUDE", `{"value": 120}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	value, _ := ap.Param("RTL_ALTITUDE")
+	assert.Equal(t, float32(120), value)
+
+	w = serve(router, http.MethodPut, "/api/plane/params/RTL_ALTITUDE", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPlaneMissionRoutes(t *testing.T) {
+	ap, router := newTestServer(t)
+	mission := `[
+		{"frame": 3, "command": 16, "autocontinue": true, "lat": 32.8801, "lon": -117.2340, "alt": 75},
+		{"frame": 3, "command": 16, "autocontinue": true, "lat": 32.8812, "lon": -117.2355, "alt": 75}
+	]`
+
+	w := serve(router, http.MethodPost, "/api/plane/mission/upload", mission)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, ap.Mission(), 2)
+
+	w = serve(router, http.MethodPost, "/api/plane/mission/upload", `[]`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(router, http.MethodGet, "/api/plane/mission?refresh=true", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	downloaded := mav.PlaneMission{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &downloaded))
+	require.Len(t, downloaded.Items, 2)
+	assert.InDelta(t, 32.8812, downloaded.Items[1].Latitude, 1e-7)
+}
+
+func TestMavlinkRouteTable(t *testing.T) {
+	_, router := newTestServer(t)
+
+	w := serve(router, http.MethodGet, "/api/mavlink/routes", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	routes := []mav.Route{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &routes))
+	require.NotEmpty(t, routes)
+	assert.Equal(t, uint8(1), routes[0].SystemID)
+
+	w = serve(router, http.MethodGet, "/api/mavlink/replay", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestMavlinkRateRoutes(t *testing.T) {
+	ap, router := newTestServer(t)
+
+	w := serve(router, http.MethodPut, "/api/mavlink/rates", `{"GLOBAL_POSITION_INT": 4}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	rates := []mav.MessageRate{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rates))
+	require.Len(t, rates, 1)
+	assert.Equal(t, 4.0, rates[0].Hz)
+
+	// the rates are requested from the plane after responding
+	require.Eventually(t, func() bool {
+		w = serve(router, http.MethodGet, "/api/mavlink/rates", "")
+		return json.Unmarshal(w.Body.Bytes(), &rates) == nil && len(rates) == 1 && rates[0].Accepted
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, int32(250000), ap.MessageIntervals()[33])
+
+	w = serve(router, http.MethodPut, "/api/mavlink/rates", `{"NOT_A_MESSAGE": 4}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTelemetryWebSocket(t *testing.T) {
+	_, router := newTestServer(t)
+	httpServer := httptest.NewServer(router)
+	t.Cleanup(httpServer.Close)
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/api/plane/telemetry/ws"
+
+	ws, err := websocket.Dial(url+"?messages=VFR_HUD&fields=airspeed", "", httpServer.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+	require.NoError(t, ws.SetDeadline(time.Now().Add(5*time.Second)))
+
+	update := mav.TelemetryUpdate{}
+	require.NoError(t, websocket.JSON.Receive(ws, &update))
+	assert.Equal(t, "VFR_HUD", update.Message)
+	assert.Equal(t, map[string]interface{}{"airspeed": 18.0}, update.Fields)
+
+	require.NoError(t, websocket.Message.Send(ws, `{"messages": ["NOT_A_MESSAGE"]}`))
+	require.NoError(t, websocket.Message.Send(ws, `{"messages": ["ATTITUDE"]}`))
+	sawError := false
+	for update.Message != "ATTITUDE" {
+		var data string
+		require.NoError(t, websocket.Message.Receive(ws, &data))
+		sawError = sawError || strings.Contains(data, `"error"`)
+		update = mav.TelemetryUpdate{}
+		require.NoError(t, json.Unmarshal([]byte(data), &update))
+	}
+	assert.True(t, sawError, "invalid subscription was not answered with an error")
+
+	w := serve(router, http.MethodGet, "/api/plane/telemetry/ws?rate=fast", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTelemetryServerSentEvents(t *testing.T) {
+	_, router := newTestServer(t)
+	httpServer := httptest.NewServer(router)
+	t.Cleanup(httpServer.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpServer.URL+"/api/plane/telemetry/stream?messages=GLOBAL_POSITION_INT&rate=5", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	lines := bufio.NewScanner(resp.Body)
+	require.True(t, lines.Scan())
+	assert.Equal(t, "event:GLOBAL_POSITION_INT", lines.Text())
+	require.True(t, lines.Scan())
+	update := mav.TelemetryUpdate{}
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines.Text(), "data:")), &update))
+	assert.Equal(t, uint32(33), update.ID)
+
+	w := serve(router, http.MethodGet, "/api/plane/telemetry/stream?messages=NOT_A_MESSAGE", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestLatestTelemetryRoutes(t *testing.T) {
+	_, router := newTestServer(t)
+
+	// InfluxDB isn't running, but the latest telemetry comes from the mavlink client
+	var w *httptest.ResponseRecorder
+	require.Eventually(t, func() bool {
+		w = serve(router, http.MethodGet, "/api/plane/telemetry?name=VFR_HUD&fields=airspeed,heading", "")
+		return w.Code == http.StatusOK
+	}, 5*time.Second, 20*time.Millisecond)
+	data := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+	assert.Len(t, data, 4)
+	assert.Equal(t, 18.0, data["airspeed"])
+	assert.Less(t, data["_age"], 1.0)
+
+	w = serve(router, http.MethodGet, "/api/plane/position", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	data = map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+	assert.InDelta(t, 32.88e7, data["lat"], 0.01e7)
+	assert.Contains(t, data, "_time")
+
+	w = serve(router, http.MethodGet, "/api/plane/telemetry?id=abc", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(router, http.MethodGet, "/api/plane/telemetry?id=44", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(router, http.MethodGet, "/api/plane/telemetry?id=60000", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(router, http.MethodGet, "/api/plane/telemetry?name=NOT_A_MESSAGE", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(router, http.MethodGet, "/api/plane/telemetry?name=VFR_HUD&fields=altitude", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// TestConcurrentPlaneReads serves reads of the plane's state from many goroutines
+// while the fake autopilot streams frames and the endpoints are replaced. Run with -race.
+func TestConcurrentPlaneReads(t *testing.T) {
+	ap, router := newTestServer(t)
+	paths := []string{
+		"/api/plane/voltage",
+		"/api/plane/telemetry?name=BATTERY_STATUS",
+		"/api/plane/position",
+		"/api/plane/state",
+		"/api/mavlink/endpoints",
+		"/api/mavlink/stats",
+		"/api/mavlink/routes",
+		"/api/mavlink/handlers",
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w := serve(router, http.MethodGet, path, "")
+				assert.NotEqual(t, http.StatusInternalServerError, w.Code, path)
+				time.Sleep(time.Millisecond)
+			}
+		}(path)
+	}
+
+	endpoints := `{"plane": "` + ap.Endpoint() + `", "router": []}`
+	for i := 0; i < 3; i++ {
+		w := serve(router, http.MethodPut, "/api/mavlink/endpoints", endpoints)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		time.Sleep(100 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	assert.Eventually(t, func() bool {
+		voltages := map[string]int{}
+		w := serve(router, http.MethodGet, "/api/plane/voltage", "")
+		return json.Unmarshal(w.Body.Bytes(), &voltages) == nil && voltages["0"] > 3500
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestBatteryRoutes(t *testing.T) {
+	_, router := newTestServer(t)
+
+	response := struct {
+		Thresholds mav.BatteryThresholds `json:"thresholds"`
+		Batteries  []mav.Battery         `json:"batteries"`
+	}{}
+	require.Eventually(t, func() bool {
+		w := serve(router, http.MethodGet, "/api/plane/battery", "")
+		return json.Unmarshal(w.Body.Bytes(), &response) == nil && len(response.Batteries) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, mav.DefaultBatteryThresholds, response.Thresholds)
+	battery := response.Batteries[0]
+	assert.Len(t, battery.CellVoltages, 6)
+	assert.Equal(t, mav.BatteryOK, battery.Level)
+	assert.Equal(t, 20.0, *battery.Current)
+
+	w := serve(router, http.MethodPut, "/api/plane/battery/thresholds", `{"low_cell_voltage": 4.3, "critical_cell_voltage": 3.4}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serve(router, http.MethodGet, "/api/plane/battery", "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 4.3, response.Thresholds.LowCellVoltage)
+	assert.Equal(t, mav.BatteryLow, response.Batteries[0].Level)
+
+	w = serve(router, http.MethodPut, "/api/plane/battery/thresholds", `{"low_cell_voltage": 3, "critical_cell_voltage": 3.4}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(router, http.MethodGet, "/api/plane/battery/thresholds", "")
+	assert.JSONEq(t, `{"low_cell_voltage": 4.3, "critical_cell_voltage": 3.4}`, w.Body.String())
+
+	w = serve(router, http.MethodPut, "/api/plane/battery/config", `{"0": {"cells": 6}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = serve(router, http.MethodPut, "/api/plane/battery/config", `{"0": {"cells": 20}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(router, http.MethodGet, "/api/plane/battery/config", "")
+	assert.JSONEq(t, `{"0": {"cells": 6, "capacity_mah": 0}}`, w.Body.String())
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -19,6 +21,7 @@ import (
 	mav "github.com/tritonuas/gcs/internal/mavlink"
 	"github.com/tritonuas/gcs/internal/obc"
 	"github.com/tritonuas/gcs/internal/protos"
+	"golang.org/x/net/websocket"
 )
 
 // Log is the logger for the server
@@ -107,11 +110,36 @@ func (server *Server) initBackend(router *gin.Engine) {
 		{
 			plane.GET("/telemetry/history", server.getTelemetryHistory())
 			plane.GET("/telemetry", server.getTelemetry())
+			plane.GET("/telemetry/stream", server.streamTelemetry())
+			plane.GET("/telemetry/ws", server.streamTelemetryWebSocket())
 
 			plane.GET("/position/history", server.getPositionHistory())
 			plane.GET("/position", server.getPosition())
 
 			plane.GET("/voltage", server.getBatteryVoltages())
+			plane.GET("/battery", server.getBattery())
+			plane.GET("/battery/thresholds", server.getBatteryThresholds())
+			plane.PUT("/battery/thresholds", server.putBatteryThresholds())
+			plane.GET("/battery/config", server.getBatteryConfig())
+			plane.PUT("/battery/config", server.putBatteryConfig())
+
+			plane.GET("/state", server.getPlaneState())
+
+			plane.GET("/params", server.getPlaneParams())
+			plane.GET("/params/:name", server.getPlaneParam())
+			plane.PUT("/params/:name", server.putPlaneParam())
+			plane.POST("/params/diff", server.diffPlaneParams())
+			plane.POST("/params/apply", server.applyPlaneParams())
+
+			plane.GET("/mission", server.getPlaneMission())
+			plane.POST("/mission/upload", server.uploadPlaneMission())
+			plane.GET("/mission/progress", server.getPlaneMissionProgress())
+
+			plane.POST("/command/rtl", server.commandRTL())
+			plane.POST("/command/loiter", server.commandLoiter())
+			plane.POST("/command/arm", server.commandArm())
+			plane.POST("/command/disarm", server.commandDisarm())
+			plane.POST("/command/set_mode", server.commandSetMode())
 
 			plane.POST("/dodropnow", server.doAirdropNow())
 		}
@@ -120,6 +148,25 @@ func (server *Server) initBackend(router *gin.Engine) {
 		{
 			mavlink.GET("/endpoints", server.getMavlinkEndpoints())
 			mavlink.PUT("/endpoints", server.putMavlinkEndpoints())
+
+			mavlink.GET("/routes", server.getMavlinkRoutes())
+			mavlink.GET("/stats", server.getMavlinkStats())
+			mavlink.GET("/rates", server.getMavlinkRates())
+			mavlink.PUT("/rates", server.putMavlinkRates())
+
+			mavlink.GET("/logs", server.getMavlinkLogs())
+			mavlink.POST("/logs/start", server.startMavlinkLog())
+			mavlink.POST("/logs/stop", server.stopMavlinkLog())
+			mavlink.GET("/logs/:name", server.downloadMavlinkLog())
+
+			mavlink.GET("/replay", server.getMavlinkReplay())
+			mavlink.POST("/replay/pause", server.pauseMavlinkReplay())
+			mavlink.POST("/replay/resume", server.resumeMavlinkReplay())
+			mavlink.POST("/replay/seek", server.seekMavlinkReplay())
+			mavlink.POST("/replay/speed", server.setMavlinkReplaySpeed())
+
+			mavlink.GET("/handlers", server.getMavlinkHandlers())
+			mavlink.PUT("/handlers", server.putMavlinkHandlers())
 		}
 
 		targets := api.Group("/targets")
@@ -200,17 +247,47 @@ func (server *Server) getOBCState() gin.HandlerFunc {
 
 /*
 User testing all of hubs connections. Returns JSON of all the connection statuses.
-TODO: Actually test the connections instead of just returning True.
+
+The mavlink connection is judged by the plane's heartbeats: "radio_mavlink" is true
+until its link is lost, and "radio_mavlink_link" holds its mav.SystemLink (or null
+before the first heartbeat) with the seconds since its last heartbeat. Every system
+heard on a mavlink link is listed in "mavlink_systems".
+
+Example response:
+
+	{
+		"radio_mavlink": true,
+		"radio_mavlink_link": {
+			"system_id": 1,
+			"component_id": 1,
+			"type": "FIXED_WING",
+			"plane": true,
+			"state": "degraded",
+			"channel": "serial:/dev/ttyUSB0",
+			"last_heartbeat": "2023-04-01T12:00:00.5Z",
+			"seconds_since_heartbeat": 4.2
+		},
+		"mavlink_systems": [...],
+		"plane_obc": true,
+		"antenna_tracker": false
+	}
 */
 func (server *Server) testConnections() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		obcConnected, _ := server.obcClient.IsConnected()
 
+		var planeLink *mav.SystemLink
+		if link, ok := server.mavlinkClient.GetPlaneLink(); ok {
+			planeLink = &link
+		}
+
 		c.JSON(http.StatusOK, gin.H{
-			"radio_mavlink":   server.mavlinkClient.IsConnectedToPlane(),
-			"plane_obc":       obcConnected,
-			"antenna_tracker": server.mavlinkClient.IsConnectedToAntennaTracker()})
+			"radio_mavlink":      server.mavlinkClient.IsConnectedToPlane(),
+			"radio_mavlink_link": planeLink,
+			"mavlink_systems":    server.mavlinkClient.GetSystemLinks(),
+			"plane_obc":          obcConnected,
+			"antenna_tracker":    server.mavlinkClient.IsConnectedToAntennaTracker()})
 	}
 }
 
@@ -295,7 +372,11 @@ func (server *Server) getTelemetryHistory() gin.HandlerFunc {
 // getTelemetry gets the latest telemetry.
 // Use query params to specify the message id, name and message fields.
 //
-// Example URL: localhost:5000/api/plane/telemetry?id=33&range=5&fields=alt,hdg
+// The telemetry comes straight from the last message the mavlink client received from
+// the plane, so it works even if InfluxDB is down. "_time" is when the message was
+// received and "_age" is how many seconds ago that was.
+//
+// Example URL: localhost:5000/api/plane/telemetry?id=33&fields=alt,hdg
 //
 // Note that only one of ID or name is required. If both are provided, it will
 // default to lookup the ID and ignore the name.
@@ -307,16 +388,18 @@ func (server *Server) getTelemetryHistory() gin.HandlerFunc {
 //     http://mavlink.io/en/messages/common.html
 //   - fields are the fields of the mavlink message to return. If none are specified then
 //     all the fields are returned. The fields are separated by commas. Example: "alt,hdg".
+//
+// Responds with 400 for messages outside the common dialect and fields the message
+// doesn't have, and with 404 if the plane hasn't sent the message yet.
+//
+// Example response:
+//
+//	{"alt": 175000, "hdg": 9000, "_time": "2023-04-01 12:00:00.1 +0000 UTC", "_age": 0.04}
 func (server *Server) getTelemetry() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		msgID := c.Query("id")
 		msgName := c.Query("name")
-		fieldsSeparatedByCommas := c.Query("fields")
-
-		fields := []string{}
-		if fieldsSeparatedByCommas != "" {
-			fields = strings.Split(fieldsSeparatedByCommas, ",")
-		}
+		fields := []string{c.Query("fields")}
 
 		if msgID != "" {
 			msgIDInt, err := strconv.Atoi(msgID)
@@ -330,42 +413,169 @@ func (server *Server) getTelemetry() gin.HandlerFunc {
 				return
 			}
 
-			data, err := server.influxDBClient.QueryMsgIDAndFields(uint32(msgIDInt), 0, fields...)
-			if err != nil {
-				// TODO: have other types of errors (id does not exist for example)
-				c.String(http.StatusInternalServerError, "Error processing database query. Reason: %s", err)
-				return
-			}
-
-			if len(data) == 0 {
-				c.String(http.StatusNotFound, "No telemetry found")
-				return
-			}
-
-			// only return the 0th index since data will always return a list with a single element if timeRange is 0
-			c.JSON(http.StatusOK, data[0])
+			server.respondWithLatestTelemetry(c, msgID, fields...)
 			return
 		}
 
 		if msgName != "" {
-			data, err := server.influxDBClient.QueryMsgNameAndFields(msgName, 0, fields...)
-			if err != nil {
-				// TODO: have other types of errors (name does not exist for example)
-				c.String(http.StatusInternalServerError, "Error processing database query. Reason: %s", err)
-				return
+			server.respondWithLatestTelemetry(c, msgName, fields...)
+			return
+		}
+
+		c.String(http.StatusBadRequest, "No message name or ID provided")
+	}
+}
+
+// respondWithLatestTelemetry responds with the fields of the last message with the
+// given name or ID received from the plane, along with when it was received (see
+// getTelemetry).
+func (server *Server) respondWithLatestTelemetry(c *gin.Context, nameOrID string, fields ...string) {
+	update, err := server.mavlinkClient.GetLatestTelemetry(nameOrID, fields...)
+	switch {
+	case errors.Is(err, mav.ErrNoTelemetry):
+		c.String(http.StatusNotFound, "No telemetry found")
+		return
+	case err != nil:
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	data := make(map[string]interface{}, len(update.Fields)+2)
+	for name, value := range update.Fields {
+		data[name] = value
+	}
+	data["_time"] = update.Time.UTC().String()
+	data["_age"] = time.Since(update.Time).Seconds()
+	c.JSON(http.StatusOK, data)
+}
+
+// streamTelemetry streams the plane's telemetry as Server-Sent Events as it arrives,
+// without going through InfluxDB. Every event is named after its message and holds a
+// mav.TelemetryUpdate, so browsers can listen for each message with
+// EventSource.addEventListener. Updates are dropped if the client can't keep up.
+//
+// Example URL: localhost:5000/api/plane/telemetry/stream?messages=GLOBAL_POSITION_INT,VFR_HUD&fields=lat,lon,airspeed&rate=5
+//
+// URL Params:
+//   - messages are the names or IDs of the messages to stream, separated by commas.
+//     Every message is streamed if none are specified.
+//   - fields are the fields to stream from every message, separated by commas. Every
+//     field is streamed if none are specified.
+//   - rate is how many updates of each message are sent per second at most. Every
+//     update is sent if it is not specified.
+//
+// Example event:
+//
+//	event:GLOBAL_POSITION_INT
+//	data:{"message":"GLOBAL_POSITION_INT","id":33,"system_id":1,"time":"2023-04-01T12:00:00.1Z","fields":{"lat":328801000,"lon":-1172340000}}
+func (server *Server) streamTelemetry() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sub, err := telemetrySubscription(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		stream, err := server.mavlinkClient.SubscribeTelemetry(sub)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		defer stream.Close()
+
+		c.Header("Cache-Control", "no-cache")
+		c.Stream(func(io.Writer) bool {
+			select {
+			case update, ok := <-stream.Updates():
+				if !ok {
+					return false
+				}
+				c.SSEvent(update.Message, update)
+				return true
+			case <-c.Request.Context().Done():
+				return false
 			}
+		})
+	}
+}
 
-			if len(data) == 0 {
-				c.String(http.StatusNotFound, "No telemetry found")
-				return
+// streamTelemetryWebSocket streams the plane's telemetry over a WebSocket as it
+// arrives, without going through InfluxDB. Every WebSocket message is a JSON
+// mav.TelemetryUpdate. The URL params are the same as streamTelemetry's, and the
+// subscription can be replaced at any time by sending a mav.TelemetrySubscription.
+// Updates are dropped if the client can't keep up.
+//
+// Example URL: ws://localhost:5000/api/plane/telemetry/ws?messages=GLOBAL_POSITION_INT&rate=10
+//
+// Example subscription:
+//
+//	{"messages": ["ATTITUDE", "VFR_HUD"], "fields": ["roll", "pitch", "airspeed"], "max_rate": 10}
+//
+// A subscription that can't be used is answered with {"error": "..."} and the
+// previous subscription is kept.
+func (server *Server) streamTelemetryWebSocket() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sub, err := telemetrySubscription(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		stream, err := server.mavlinkClient.SubscribeTelemetry(sub)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		defer stream.Close()
+
+		// websocket.Server instead of websocket.Handler so that any origin is allowed,
+		// like in CORSMiddleware
+		websocket.Server{Handler: func(ws *websocket.Conn) {
+			go receiveTelemetrySubscriptions(ws, stream)
+			for update := range stream.Updates() {
+				if err := websocket.JSON.Send(ws, update); err != nil {
+					return
+				}
 			}
+		}}.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// receiveTelemetrySubscriptions replaces the subscription of a telemetry stream with
+// every subscription received on a WebSocket, and closes the stream once the
+// WebSocket closes.
+func receiveTelemetrySubscriptions(ws *websocket.Conn, stream *mav.TelemetryStream) {
+	defer stream.Close()
 
-			c.JSON(http.StatusOK, data[0])
+	for {
+		var data string
+		if err := websocket.Message.Receive(ws, &data); err != nil {
 			return
 		}
+		sub := mav.TelemetrySubscription{}
+		err := json.Unmarshal([]byte(data), &sub)
+		if err == nil {
+			err = stream.Resubscribe(sub)
+		}
+		if err != nil {
+			websocket.JSON.Send(ws, gin.H{"error": err.Error()}) //nolint: errcheck
+		}
+	}
+}
 
-		c.String(http.StatusBadRequest, "No message name or ID provided")
+// telemetrySubscription returns the telemetry subscription in the URL params of a
+// streaming request (see streamTelemetry).
+func telemetrySubscription(c *gin.Context) (mav.TelemetrySubscription, error) {
+	sub := mav.TelemetrySubscription{
+		Messages: []string{c.Query("messages")},
+		Fields:   []string{c.Query("fields")},
+	}
+	if rate := c.Query("rate"); rate != "" {
+		maxRate, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return sub, fmt.Errorf("invalid rate %q", rate)
+		}
+		sub.MaxRate = maxRate
 	}
+	return sub, nil
 }
 
 // getPositionHistory gets the plane position from a certain point in the past.
@@ -397,32 +607,244 @@ func (server *Server) getPositionHistory() gin.HandlerFunc {
 	}
 }
 
-// getPosition gets the latest plane position.
+// getPosition gets the latest plane position from the mavlink client, with the
+// same "_time" and "_age" fields as getTelemetry.
 //
 // Matches format of GLOBAL_POSITION_INT mavlink message.
 // https://mavlink.io/en/messages/common.html#GLOBAL_POSITION_INT
 func (server *Server) getPosition() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		data, err := server.influxDBClient.QueryMsgID(33, 0)
+		server.respondWithLatestTelemetry(c, "GLOBAL_POSITION_INT")
+	}
+}
+
+// getBatteryVoltages retrieves the latest voltage of the first cell of every battery
+// in millivolts, keyed by battery ID. See getBattery for everything else about them.
+func (server *Server) getBatteryVoltages() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, server.mavlinkClient.GetBatteryVoltages())
+	}
+}
+
+// getBattery responds with the latest state of every battery of the plane as a list
+// of mav.Battery, along with the thresholds its level is judged by. Voltages are in
+// volts, currents in amps and the temperature in degrees Celsius. Values the
+// autopilot does not know are left out.
+//
+// Example response:
+//
+//	{
+//		"thresholds": {"low_cell_voltage": 3.6, "critical_cell_voltage": 3.4},
+//		"batteries": [
+//			{
+//				"id": 0,
+//				"cell_voltages": [3.9, 3.9, 3.9, 3.9, 3.9, 3.9],
+//				"lowest_cell_voltage": 3.9,
+//				"cells": 6,
+//				"average_cell_voltage": 3.9,
+//				"voltage": 23.4,
+//				"current": 20,
+//				"average_current": 19.6,
+//				"consumed_mah": 4000,
+//				"remaining_percent": 60,
+//				"seconds_remaining": 1102,
+//				"temperature": 25,
+//				"charge_state": "OK",
+//				"faults": [],
+//				"level": "ok",
+//				"time": "2022-04-20T18:30:07.318Z"
+//			}
+//		]
+//	}
+func (server *Server) getBattery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"thresholds": server.mavlinkClient.GetBatteryThresholds(),
+			"batteries":  server.mavlinkClient.GetBatteries(),
+		})
+	}
+}
+
+// getBatteryThresholds responds with the cell voltages in volts below which batteries
+// are low or critical.
+//
+// Example response:
+//
+//	{"low_cell_voltage": 3.6, "critical_cell_voltage": 3.4}
+func (server *Server) getBatteryThresholds() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, server.mavlinkClient.GetBatteryThresholds())
+	}
+}
+
+// putBatteryThresholds changes the cell voltages in volts below which batteries are
+// low or critical. Responds like getBatteryThresholds.
+//
+// Example body:
+//
+//	{"low_cell_voltage": 3.7, "critical_cell_voltage": 3.5}
+func (server *Server) putBatteryThresholds() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		thresholds := mav.BatteryThresholds{}
+		err := c.BindJSON(&thresholds)
 		if err != nil {
-			// TODO: have other types of errors (id does not exist for example)
-			c.String(http.StatusInternalServerError, "Error processing database query. Reason: %s", err)
+			c.String(http.StatusBadRequest, err.Error())
 			return
 		}
 
-		if len(data) == 0 {
-			c.String(http.StatusNotFound, "No telemetry found")
+		if err := server.mavlinkClient.SetBatteryThresholds(thresholds); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
 			return
 		}
+		c.JSON(http.StatusOK, thresholds)
+	}
+}
 
-		c.JSON(http.StatusOK, data[0])
+// getBatteryConfig responds with what is configured about the plane's batteries,
+// keyed by battery ID. Batteries that aren't configured are left out.
+//
+// Example response:
+//
+//	{"0": {"cells": 6, "capacity_mah": 10000}}
+func (server *Server) getBatteryConfig() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, server.mavlinkClient.GetBatteryConfigs())
 	}
 }
 
-// getBatteryVoltages retrieves the latest voltage information from the mavlink client
-func (server *Server) getBatteryVoltages() gin.HandlerFunc {
+// putBatteryConfig replaces the configuration of the plane's batteries, keyed by
+// battery ID. The cell count is needed to judge the level of batteries whose cells the
+// autopilot doesn't measure, and the capacity to work out how long batteries last if
+// the autopilot doesn't estimate it. Responds like getBatteryConfig.
+//
+// Example body:
+//
+//	{"0": {"cells": 6, "capacity_mah": 10000}, "1": {"cells": 12, "capacity_mah": 0}}
+func (server *Server) putBatteryConfig() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		configs := map[uint8]mav.BatteryConfig{}
+		err := c.BindJSON(&configs)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := server.mavlinkClient.SetBatteryConfigs(configs); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, configs)
+	}
+}
+
+// getPlaneMission responds with the mission that is loaded on the autopilot as a
+// mav.PlaneMission, so it can be compared with the path from the OBC (see getInitialPath).
+//
+// The mission is downloaded from the plane over mavlink if it has not been downloaded
+// yet, or if the refresh query param is true. Otherwise the cached mission is returned.
+//
+// Example URL: localhost:5000/api/plane/mission?refresh=true
+func (server *Server) getPlaneMission() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mission := server.mavlinkClient.GetPlaneMission()
+		if mission != nil && c.Query("refresh") != "true" {
+			c.JSON(http.StatusOK, mission)
+			return
+		}
+
+		resultChan, err := server.mavlinkClient.StartMissionDownload()
+		switch {
+		case errors.Is(err, mav.ErrMissionTransferInProgress):
+			c.String(http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		result := <-resultChan
+		switch {
+		case result.Accepted:
+			c.JSON(http.StatusOK, server.mavlinkClient.GetPlaneMission())
+		case result.Result == mav.MissionResultTimeout:
+			c.JSON(http.StatusGatewayTimeout, result)
+		default:
+			c.JSON(http.StatusBadGateway, result)
+		}
+	}
+}
+
+// getPlaneState responds with the plane's flight mode and arming state as a
+// mav.PlaneState, decoded from its latest HEARTBEAT. The response also lists the
+// most recent mode and arming changes.
+//
+// Responds with 503 if no HEARTBEAT has been received from the plane yet.
+func (server *Server) getPlaneState() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state, ok := server.mavlinkClient.GetPlaneState()
+		if !ok {
+			c.String(http.StatusServiceUnavailable, "no heartbeat received from the plane yet")
+			return
+		}
+		c.JSON(http.StatusOK, state)
+	}
+}
+
+// getPlaneMissionProgress responds with the plane's progress through its mission
+// as a mav.MissionProgress: the item it is flying to, when each item was reached,
+// and the distance and ETA to the current item.
+//
+// The distance and ETA are only known once the mission has been downloaded
+// (see getPlaneMission) or uploaded through Hub.
+func (server *Server) getPlaneMissionProgress() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.JSON(http.StatusOK, server.mavlinkClient.LatestBatteryInfo)
+		c.JSON(http.StatusOK, server.mavlinkClient.GetMissionProgress())
+	}
+}
+
+// uploadPlaneMission uploads a mission straight to the autopilot over mavlink,
+// without going through the OBC. Responds once the plane acknowledges the mission
+// (or the upload times out) with a mav.MissionUploadResult.
+//
+// The JSON body should be a list of mav.MissionItem.
+//
+// Example body:
+//
+//	[
+//		{"frame": 3, "command": 16, "autocontinue": true, "lat": 32.8801, "lon": -117.2340, "alt": 75},
+//		{"frame": 3, "command": 16, "autocontinue": true, "lat": 32.8812, "lon": -117.2355, "alt": 75}
+//	]
+func (server *Server) uploadPlaneMission() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		items := []mav.MissionItem{}
+		err := c.BindJSON(&items)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		resultChan, err := server.mavlinkClient.StartMissionUpload(items)
+		switch {
+		case errors.Is(err, mav.ErrEmptyMission), errors.Is(err, mav.ErrMissionTooLarge):
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		case errors.Is(err, mav.ErrMissionTransferInProgress):
+			c.String(http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		result := <-resultChan
+		switch {
+		case result.Accepted:
+			c.JSON(http.StatusOK, result)
+		case result.Result == mav.MissionResultTimeout:
+			c.JSON(http.StatusGatewayTimeout, result)
+		default:
+			c.JSON(http.StatusBadGateway, result)
+		}
 	}
 }
 
@@ -454,12 +876,17 @@ func (server *Server) getMavlinkEndpoints() gin.HandlerFunc {
 // Example body:
 //
 //	{
-//			"plane": "serial:/dev/ttyUSB0",
+//			"plane": "serial:/dev/ttyUSB0?baud=115200",
 //			"router": [
-//						"udp:192.168.1.7:14551",
-//						"tcp:localhost:14550"
+//						"udp:192.168.1.7:14551?deny_msg=PARAM_VALUE&rate=ATTITUDE:2",
+//						"tcp:localhost:14550?readonly",
+//						"tcpin:0.0.0.0:14553"
 //					  ]
 //	}
+//
+// See mav.NewEndpoint for every supported type of endpoint and mav.ParseEndpoint for
+// their options. Responds with 400 without changing anything if any of the endpoints
+// is invalid.
 func (server *Server) putMavlinkEndpoints() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		endpointData := mav.EndpointData{}
@@ -469,6 +896,13 @@ func (server *Server) putMavlinkEndpoints() gin.HandlerFunc {
 			return
 		}
 
+		for _, endpoint := range append([]string{endpointData.Plane}, endpointData.Router...) {
+			if err := mav.ValidateEndpoint(endpoint); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
 		server.mavlinkClient.UpdateEndpoints(endpointData.Plane, endpointData.Router)
 		c.String(http.StatusOK, "Updated mavlink endpoints")
 	}
@@ -740,10 +1174,590 @@ func (server *Server) pushSavedTargets() gin.HandlerFunc {
 	}
 }
 
-// RTL handles return-to-launch request
+// RTL handles return-to-launch request. The request goes through the OBC, and if the
+// OBC cannot be reached (or fails) the RTL command is sent straight to the plane over mavlink.
 func (server *Server) RTL() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		body, status := server.obcClient.RTL()
-		c.Data(status, "text/plain", body)
+		if status == http.StatusOK {
+			c.Data(status, "text/plain", body)
+			return
+		}
+
+		Log.Warnf("RTL through the OBC failed with status %d. Sending RTL directly to the plane", status)
+		result, err := server.mavlinkClient.ReturnToLaunch()
+		respondWithCommandResult(c, result, err)
+	}
+}
+
+// commandRTL sends MAV_CMD_NAV_RETURN_TO_LAUNCH straight to the plane over mavlink.
+// Responds with a mav.CommandResult.
+func (server *Server) commandRTL() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := server.mavlinkClient.ReturnToLaunch()
+		respondWithCommandResult(c, result, err)
+	}
+}
+
+// loiterRequest is the optional body of commandLoiter
+type loiterRequest struct {
+	Lat    *float64 `json:"lat"`
+	Lon    *float64 `json:"lon"`
+	Alt    float32  `json:"alt"`
+	Radius float32  `json:"radius"`
+}
+
+// commandLoiter makes the plane loiter. With no body the plane switches to LOITER mode
+// at its current position. If a lat/lon is provided the plane flies there and loiters
+// at the given altitude (meters relative to home) and radius (meters).
+// Responds with a mav.CommandResult.
+//
+// Example body:
+//
+//	{"lat": 32.8801, "lon": -117.2340, "alt": 100, "radius": 80}
+func (server *Server) commandLoiter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := loiterRequest{}
+		if c.Request.ContentLength > 0 {
+			err := c.BindJSON(&req)
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		if req.Lat == nil || req.Lon == nil {
+			result, err := server.mavlinkClient.Loiter()
+			respondWithCommandResult(c, result, err)
+			return
+		}
+
+		result, err := server.mavlinkClient.LoiterAt(*req.Lat, *req.Lon, req.Alt, req.Radius)
+		respondWithCommandResult(c, result, err)
+	}
+}
+
+// commandArm arms the plane. Use the query param force=true to skip pre-arm checks.
+// Responds with a mav.CommandResult.
+func (server *Server) commandArm() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := server.mavlinkClient.Arm(c.Query("force") == "true")
+		respondWithCommandResult(c, result, err)
+	}
+}
+
+// commandDisarm disarms the plane. Use the query param force=true to disarm in flight.
+// Responds with a mav.CommandResult.
+func (server *Server) commandDisarm() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := server.mavlinkClient.Disarm(c.Query("force") == "true")
+		respondWithCommandResult(c, result, err)
+	}
+}
+
+// commandSetMode switches the plane's flight mode. Responds with a mav.CommandResult.
+//
+// Example body:
+//
+//	{"mode": "AUTO"}
+func (server *Server) commandSetMode() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := struct {
+			Mode string `json:"mode"`
+		}{}
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		result, err := server.mavlinkClient.SetMode(req.Mode)
+		respondWithCommandResult(c, result, err)
+	}
+}
+
+// respondWithCommandResult picks the HTTP status that matches how a mavlink command went.
+func respondWithCommandResult(c *gin.Context, result mav.CommandResult, err error) {
+	switch {
+	case errors.Is(err, mav.ErrUnknownMode):
+		c.String(http.StatusBadRequest, err.Error())
+	case errors.Is(err, mav.ErrCommandInProgress):
+		c.String(http.StatusConflict, err.Error())
+	case err != nil:
+		c.String(http.StatusServiceUnavailable, err.Error())
+	case result.Accepted:
+		c.JSON(http.StatusOK, result)
+	case result.Result == mav.CommandResultTimeout:
+		c.JSON(http.StatusGatewayTimeout, result)
+	default:
+		c.JSON(http.StatusBadGateway, result)
+	}
+}
+
+// getPlaneParams responds with every cached autopilot parameter and the progress of
+// downloading them from the plane:
+//
+//	{"progress": {"total": 1024, "received": 1024, "complete": true, ...}, "params": [{"name": "ARSPD_FBW_MAX", "value": 22, ...}]}
+//
+// The first request (or any request with ?refresh=true) starts downloading the
+// parameters in the background. Poll this route until progress.complete is true.
+func (server *Server) getPlaneParams() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		progress := server.mavlinkClient.GetParamProgress()
+		if c.Query("refresh") == "true" || (progress.Total < 0 && !progress.Fetching) {
+			err := server.mavlinkClient.StartParamFetch()
+			if err != nil {
+				c.String(http.StatusServiceUnavailable, err.Error())
+				return
+			}
+		}
+
+		params, progress := server.mavlinkClient.GetParams()
+		c.JSON(http.StatusOK, gin.H{"progress": progress, "params": params})
+	}
+}
+
+// getPlaneParam responds with a single autopilot parameter as a mav.Param. Uncached
+// parameters (or any parameter with ?refresh=true) are read from the plane.
+func (server *Server) getPlaneParam() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		param, ok := server.mavlinkClient.GetParam(name)
+		if ok && c.Query("refresh") != "true" {
+			c.JSON(http.StatusOK, param)
+			return
+		}
+
+		param, err := server.mavlinkClient.ReadParam(name)
+		if err != nil {
+			respondWithParamError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, param)
+	}
+}
+
+// putPlaneParam sets an autopilot parameter and verifies the value the plane reports
+// back. Responds with a mav.ParamSetResult.
+//
+// Example body:
+//
+//	{"value": 22.5}
+func (server *Server) putPlaneParam() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := struct {
+			Value *float32 `json:"value"`
+		}{}
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Value == nil {
+			c.String(http.StatusBadRequest, "missing value")
+			return
+		}
+
+		result, err := server.mavlinkClient.SetParam(c.Param("name"), *req.Value)
+		switch {
+		case err != nil:
+			respondWithParamError(c, err)
+		case result.Verified:
+			c.JSON(http.StatusOK, result)
+		case result.Result == mav.ParamResultTimeout:
+			c.JSON(http.StatusGatewayTimeout, result)
+		default:
+			c.JSON(http.StatusBadGateway, result)
+		}
+	}
+}
+
+// respondWithParamError picks the HTTP status that matches why a parameter could not be read or set.
+func respondWithParamError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, mav.ErrParamNotFound):
+		c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, mav.ErrParamNameTooLong):
+		c.String(http.StatusBadRequest, err.Error())
+	case errors.Is(err, mav.ErrParamInProgress):
+		c.String(http.StatusConflict, err.Error())
+	default:
+		c.String(http.StatusServiceUnavailable, err.Error())
+	}
+}
+
+// diffPlaneParams compares a Mission Planner style .param file, sent as the request
+// body, against the plane's live parameters and responds with a mav.ParamDiff.
+//
+// ?tolerance sets the relative difference below which values are considered equal
+// (defaults to mav.DefaultParamDiffTolerance). Responds with 409 if the parameters
+// have not been fully downloaded yet (see getPlaneParams).
+func (server *Server) diffPlaneParams() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tolerance := mav.DefaultParamDiffTolerance
+		if toleranceStr := c.Query("tolerance"); toleranceStr != "" {
+			var err error
+			tolerance, err = strconv.ParseFloat(toleranceStr, 64)
+			if err != nil || tolerance < 0 {
+				c.String(http.StatusBadRequest, "tolerance must be a non-negative number")
+				return
+			}
+		}
+
+		entries, err := mav.ParseParamFile(c.Request.Body)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		diff, err := server.mavlinkClient.DiffParams(entries, tolerance)
+		if err != nil {
+			c.String(http.StatusConflict, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, diff)
+	}
+}
+
+// applyPlaneParams sets several parameters on the plane, such as the changes picked
+// from diffPlaneParams, and responds with a mav.ParamSetResult for each of them.
+// Responds with 200 only if every parameter was verified, otherwise 502.
+//
+// Example body:
+//
+//	[{"name": "ARSPD_FBW_MAX", "value": 22}, {"name": "RTL_ALTITUDE", "value": 100}]
+func (server *Server) applyPlaneParams() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		entries := []mav.ParamFileEntry{}
+		err := c.BindJSON(&entries)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		results := server.mavlinkClient.ApplyParams(entries)
+		for _, result := range results {
+			if !result.Verified {
+				c.JSON(http.StatusBadGateway, results)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, results)
+	}
+}
+
+// getMavlinkRoutes responds with the route table the mavlink router has learned: every
+// system and component heard on an open channel, as a list of mav.Route. Messages
+// addressed to a system are only forwarded to the channels listed for it.
+//
+// Example response:
+//
+//	[
+//		{
+//			"system_id": 1,
+//			"component_id": 1,
+//			"endpoint": "serial:/dev/ttyUSB0",
+//			"channel": "serial:/dev/ttyUSB0",
+//			"frames": 18234,
+//			"last_seen": "2023-04-01T12:00:00.5Z"
+//		}
+//	]
+func (server *Server) getMavlinkRoutes() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, server.mavlinkClient.GetRoutes())
+	}
+}
+
+// getMavlinkStats responds with the traffic received on every open mavlink channel
+// as a list of mav.LinkStats: frame and byte rates, rates of each message, packet
+// loss of each system worked out from sequence numbers, parse errors and the latest
+// RADIO_STATUS of telemetry radios. Rates are recalculated every few seconds.
+//
+// Example response (shortened):
+//
+//	[
+//		{
+//			"endpoint": "serial:/dev/ttyUSB0",
+//			"channel": "serial:/dev/ttyUSB0",
+//			"frames": 48213,
+//			"frames_per_second": 61.4,
+//			"bytes_per_second": 2380.2,
+//			"parse_errors": 3,
+//			"messages": [{"id": 0, "name": "HEARTBEAT", "count": 802, "per_second": 1}],
+//			"systems": [{"system_id": 1, "component_id": 1, "received": 48001, "lost": 212, "loss_percent": 0.44}],
+//			"radio": {"rssi": 180, "remote_rssi": 172, "noise": 40, "remote_noise": 38, "rx_errors": 2}
+//		}
+//	]
+func (server *Server) getMavlinkStats() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, server.mavlinkClient.GetLinkStats())
+	}
+}
+
+// getMavlinkRates responds with the rates messages are requested from the plane at as
+// a list of mav.MessageRate, along with how the plane answered the last request.
+//
+// Example response:
+//
+//	[
+//		{"message": "BATTERY_STATUS", "id": 147, "hz": 1, "result": "MAV_RESULT_ACCEPTED", "accepted": true},
+//		{"message": "GLOBAL_POSITION_INT", "id": 33, "hz": 10, "result": "MAV_RESULT_ACCEPTED", "accepted": true}
+//	]
+func (server *Server) getMavlinkRates() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, server.mavlinkClient.GetMessageRates())
+	}
+}
+
+// putMavlinkRates replaces the rates in Hz that messages are requested from the plane
+// at. A rate of 0 stops a message and messages left out go back to the autopilot's
+// default rate. Responds with the new rates right away, like getMavlinkRates, while
+// they are requested from the plane in the background. They are requested again
+// whenever its link comes back.
+//
+// Example body:
+//
+//	{"GLOBAL_POSITION_INT": 10, "ATTITUDE": 10, "BATTERY_STATUS": 1}
+func (server *Server) putMavlinkRates() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rates := map[string]float64{}
+		err := c.BindJSON(&rates)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		updated, err := server.mavlinkClient.SetMessageRates(rates)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, updated)
+	}
+}
+
+// getMavlinkLogs responds with the tlog recording in progress (null if there is
+// none) and every recorded tlog file.
+//
+// Example response:
+//
+//	{
+//		"recording": {
+//			"session": "2023-04-01_12-00-00",
+//			"started": "2023-04-01T12:00:00Z",
+//			"files": ["2023-04-01_12-00-00.tlog"],
+//			"frames": 48213,
+//			"bytes": 1984332
+//		},
+//		"logs": [{"name": "2023-04-01_12-00-00.tlog", "size": 1980416, "modified": "2023-04-01T12:13:20Z"}]
+//	}
+func (server *Server) getMavlinkLogs() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		logs, err := server.mavlinkClient.ListTlogs()
+		if err != nil {
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		var recording *mav.TlogStatus
+		if status, ok := server.mavlinkClient.GetTlogStatus(); ok {
+			recording = &status
+		}
+		c.JSON(http.StatusOK, gin.H{"recording": recording, "logs": logs})
+	}
+}
+
+// startMavlinkLog starts recording every mavlink frame Hub receives to a new tlog
+// session and responds with its mav.TlogStatus. Responds with 409 if a recording is
+// already running.
+func (server *Server) startMavlinkLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, err := server.mavlinkClient.StartTlog()
+		switch {
+		case errors.Is(err, mav.ErrTlogRecording):
+			c.String(http.StatusConflict, err.Error())
+		case err != nil:
+			c.String(http.StatusInternalServerError, err.Error())
+		default:
+			c.JSON(http.StatusOK, status)
+		}
+	}
+}
+
+// stopMavlinkLog stops the tlog recording in progress and responds with its final
+// mav.TlogStatus. Responds with 409 if no recording is running.
+func (server *Server) stopMavlinkLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, err := server.mavlinkClient.StopTlog()
+		switch {
+		case errors.Is(err, mav.ErrTlogNotRecording):
+			c.String(http.StatusConflict, err.Error())
+		case err != nil:
+			c.String(http.StatusInternalServerError, err.Error())
+		default:
+			c.JSON(http.StatusOK, status)
+		}
+	}
+}
+
+// downloadMavlinkLog responds with a recorded tlog file as an attachment, which can
+// be opened in Mission Planner or QGC. Responds with 404 if there is no tlog with
+// the given name.
+//
+// Example URL: localhost:5000/api/mavlink/logs/2023-04-01_12-00-00.tlog
+func (server *Server) downloadMavlinkLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		path, err := server.mavlinkClient.TlogPath(name)
+		if err != nil {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		c.FileAttachment(path, name)
+	}
+}
+
+// getMavlinkReplay responds with the mav.ReplayStatus of the tlog replayed as the
+// plane endpoint (see the replay endpoint type of putMavlinkEndpoints). Responds with
+// 404 if the plane endpoint isn't a replay.
+//
+// Example response:
+//
+//	{
+//		"file": "tlogs/2023-04-01_12-00-00.tlog",
+//		"speed": 2,
+//		"paused": false,
+//		"finished": false,
+//		"position_seconds": 73.4,
+//		"duration_seconds": 800.2,
+//		"frame": 4410,
+//		"frames": 48213
+//	}
+func (server *Server) getMavlinkReplay() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, err := server.mavlinkClient.GetReplayStatus()
+		respondWithReplayStatus(c, status, err)
+	}
+}
+
+// pauseMavlinkReplay pauses the tlog replay and responds with its mav.ReplayStatus.
+func (server *Server) pauseMavlinkReplay() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, err := server.mavlinkClient.PauseReplay()
+		respondWithReplayStatus(c, status, err)
+	}
+}
+
+// resumeMavlinkReplay resumes the tlog replay and responds with its mav.ReplayStatus.
+func (server *Server) resumeMavlinkReplay() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, err := server.mavlinkClient.ResumeReplay()
+		respondWithReplayStatus(c, status, err)
+	}
+}
+
+// seekMavlinkReplay continues the tlog replay from a position in seconds since the
+// start of the tlog and responds with its mav.ReplayStatus.
+//
+// Example body:
+//
+//	{"position": 120}
+func (server *Server) seekMavlinkReplay() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := struct {
+			Position float64 `json:"position"`
+		}{}
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Position < 0 {
+			c.String(http.StatusBadRequest, "the position can not be negative")
+			return
+		}
+
+		status, err := server.mavlinkClient.SeekReplay(time.Duration(req.Position * float64(time.Second)))
+		respondWithReplayStatus(c, status, err)
+	}
+}
+
+// setMavlinkReplaySpeed changes how many times faster than real time the tlog is
+// replayed and responds with its mav.ReplayStatus. A speed of 0 replays it as fast as
+// Hub can handle the frames.
+//
+// Example body:
+//
+//	{"speed": 4}
+func (server *Server) setMavlinkReplaySpeed() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := struct {
+			Speed float64 `json:"speed"`
+		}{}
+		err := c.BindJSON(&req)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		status, err := server.mavlinkClient.SetReplaySpeed(req.Speed)
+		respondWithReplayStatus(c, status, err)
+	}
+}
+
+// respondWithReplayStatus picks the HTTP status that matches how controlling a replay went.
+func respondWithReplayStatus(c *gin.Context, status mav.ReplayStatus, err error) {
+	switch {
+	case errors.Is(err, mav.ErrNoReplay):
+		c.String(http.StatusNotFound, err.Error())
+	case errors.Is(err, mav.ErrInvalidReplaySpeed):
+		c.String(http.StatusBadRequest, err.Error())
+	case err != nil:
+		c.String(http.StatusServiceUnavailable, err.Error())
+	default:
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+// getMavlinkHandlers responds with every registered mavlink EventFrameHandler as a
+// list of mav.HandlerInfo, in the order they run. Handlers that run off the Listen
+// loop also report how many frames are waiting in their queue and how many were
+// dropped because the queue was full.
+func (server *Server) getMavlinkHandlers() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, server.mavlinkClient.GetHandlers())
+	}
+}
+
+// putMavlinkHandlers enables, disables and reorders mavlink EventFrameHandlers while
+// Hub is running. The handlers in "order" are moved to the front in the order given,
+// and the handlers in "handlers" are enabled or disabled if "enabled" is present.
+// Handlers are only reordered if "order" is given. Responds with the updated handlers.
+//
+// Example body that stops forwarding to the antenna tracker:
+//
+//	{"handlers": [{"name": "antenna_tracker", "enabled": false}]}
+//
+// Example body that forwards to the antenna tracker before anything else:
+//
+//	{"order": ["antenna_tracker"]}
+func (server *Server) putMavlinkHandlers() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		settings := mav.HandlerSettings{}
+		err := c.BindJSON(&settings)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		err = server.mavlinkClient.ConfigureHandlers(settings)
+		switch {
+		case errors.Is(err, mav.ErrHandlerNotFound):
+			c.String(http.StatusNotFound, err.Error())
+		case err != nil:
+			c.String(http.StatusBadRequest, err.Error())
+		default:
+			c.JSON(http.StatusOK, server.mavlinkClient.GetHandlers())
+		}
 	}
 }
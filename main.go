@@ -7,7 +7,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -22,22 +24,35 @@ var log = logrus.New()
 
 // Defines globally used variables for ports and IPs and other things.
 var ENVS = map[string]*string{
-	"HUB_PATH":             flag.String("hub_path", "/home/mat/gopath/src/github.com/tritonuas/hub", "Path to hub folder"),
-	"OBC_ADDR":             flag.String("obc_addr", "127.0.0.1:5010", "ip of obc"),
-	"MAV_DEVICE":           flag.String("mav_device", "serial:/dev/serial", "serial port or tcp address of plane to receive messages from"),
-	"MAV_OUTPUT1":          flag.String("mav_output1", "", "first output of mavlink messages"),
-	"MAV_OUTPUT2":          flag.String("mav_output2", "", "second output of mavlink messages"),
-	"MAV_OUTPUT3":          flag.String("mav_output3", "", "third output of mavlink messages"),
-	"MAV_OUTPUT4":          flag.String("mav_output4", "", "fourth output of mavlink messages"),
-	"MAV_OUTPUT5":          flag.String("mav_output5", "", "fifth output of mavlink messages"),
-	"INFLUXDB_URI":         flag.String("influxdb_uri", "http://influxdb:8086", "uri of inlux database for mavlink messages"),
-	"INFLUXDB_TOKEN":       flag.String("influxdb_token", "influxdbToken", "token to allow read/write access to influx database"),
-	"INFLUXDB_BUCKET":      flag.String("influxdb_bucket", "mavlink", "bucket for the influx database"),
-	"INFLUXDB_ORG":         flag.String("influxdb_org", "TritonUAS", "org for the influx database"),
-	"DEBUG_MODE":           flag.String("debug", "False", "Boolean to determine logging mode"),
-	"ANTENNA_TRACKER_IP":   flag.String("antenna_tracker_ip", "192.168.1.9", "ip address of antenna tracker arduino"),
-	"ANTENNA_TRACKER_PORT": flag.String("antenna_tracker_port", "4000", "port of antenna tracker arduino"),
-	"HOUSTON_PATH":         flag.String("houston_path", "../houston2", "Path to Houston files"),
+	"HUB_PATH":                flag.String("hub_path", "/home/mat/gopath/src/github.com/tritonuas/hub", "Path to hub folder"),
+	"OBC_ADDR":                flag.String("obc_addr", "127.0.0.1:5010", "ip of obc"),
+	"MAV_DEVICE":              flag.String("mav_device", "serial:/dev/serial", "serial port or tcp address of plane to receive messages from"),
+	"MAV_OUTPUT1":             flag.String("mav_output1", "", "first output of mavlink messages"),
+	"MAV_OUTPUT2":             flag.String("mav_output2", "", "second output of mavlink messages"),
+	"MAV_OUTPUT3":             flag.String("mav_output3", "", "third output of mavlink messages"),
+	"MAV_OUTPUT4":             flag.String("mav_output4", "", "fourth output of mavlink messages"),
+	"MAV_OUTPUT5":             flag.String("mav_output5", "", "fifth output of mavlink messages"),
+	"MAV_DEGRADED_TIMEOUT":    flag.String("mav_degraded_timeout", "3s", "time without a heartbeat before a mavlink link is degraded"),
+	"MAV_LOST_TIMEOUT":        flag.String("mav_lost_timeout", "10s", "time without a heartbeat before a mavlink link is lost"),
+	"MAV_TLOG_DIR":            flag.String("mav_tlog_dir", mav.DefaultTlogDir, "directory mavlink tlogs are recorded to"),
+	"MAV_TLOG_RECORD":         flag.String("mav_tlog_record", "False", "Boolean to determine whether to record a tlog from startup"),
+	"MAV_TLOG_MAX_TOTAL_MB":   flag.String("mav_tlog_max_total_mb", "4096", "megabytes of tlogs kept before the oldest are deleted, or 0 to keep every tlog"),
+	"MAV_MESSAGE_RATES":       flag.String("mav_message_rates", "", "comma separated message:rate pairs in Hz requested from the plane, replacing the default rates. Example: GLOBAL_POSITION_INT:10,BATTERY_STATUS:1"),
+	"MAV_BATTERY_LOW":         flag.String("mav_battery_low", "3.6", "cell voltage in volts below which a battery is low"),
+	"MAV_BATTERY_CRITICAL":    flag.String("mav_battery_critical", "3.4", "cell voltage in volts below which a battery is critical"),
+	"MAV_BATTERY_CELLS":       flag.String("mav_battery_cells", "", "comma separated id:cells pairs of batteries whose cells the autopilot doesn't measure. Example: 0:6,1:12"),
+	"MAV_BATTERY_CAPACITY":    flag.String("mav_battery_capacity", "", "comma separated id:mAh pairs of the capacity of every battery, used to work out how long it lasts. Example: 0:10000,1:5000"),
+	"MAV_INFLUXDB_INCLUDE":    flag.String("mav_influxdb_include", "", "comma separated mavlink messages to store in InfluxDB, or empty to store every message"),
+	"MAV_INFLUXDB_EXCLUDE":    flag.String("mav_influxdb_exclude", "", "comma separated mavlink messages to never store in InfluxDB"),
+	"MAV_INFLUXDB_ENUM_NAMES": flag.String("mav_influxdb_enum_names", "True", "Boolean to determine whether mavlink enums are stored in InfluxDB by name"),
+	"INFLUXDB_URI":            flag.String("influxdb_uri", "http://influxdb:8086", "uri of inlux database for mavlink messages"),
+	"INFLUXDB_TOKEN":          flag.String("influxdb_token", "influxdbToken", "token to allow read/write access to influx database"),
+	"INFLUXDB_BUCKET":         flag.String("influxdb_bucket", "mavlink", "bucket for the influx database"),
+	"INFLUXDB_ORG":            flag.String("influxdb_org", "TritonUAS", "org for the influx database"),
+	"DEBUG_MODE":              flag.String("debug", "False", "Boolean to determine logging mode"),
+	"ANTENNA_TRACKER_IP":      flag.String("antenna_tracker_ip", "192.168.1.9", "ip address of antenna tracker arduino"),
+	"ANTENNA_TRACKER_PORT":    flag.String("antenna_tracker_port", "4000", "port of antenna tracker arduino"),
+	"HOUSTON_PATH":            flag.String("houston_path", "../houston2", "Path to Houston files"),
 }
 
 // setEnvVars will check for any hub related environment variables and
@@ -72,6 +87,100 @@ func setupEverything() {
 	}
 }
 
+// setLinkTimeouts configures when the mavlink client considers links degraded or lost,
+// keeping the defaults if the timeouts are invalid.
+func setLinkTimeouts(mavlinkClient *mav.Client) {
+	degraded, err := time.ParseDuration(*ENVS["MAV_DEGRADED_TIMEOUT"])
+	if err != nil {
+		log.Errorf("Invalid mavlink degraded timeout. Reason: %s", err.Error())
+		return
+	}
+	lost, err := time.ParseDuration(*ENVS["MAV_LOST_TIMEOUT"])
+	if err != nil {
+		log.Errorf("Invalid mavlink lost timeout. Reason: %s", err.Error())
+		return
+	}
+	if err := mavlinkClient.SetLinkTimeouts(mav.LinkTimeouts{Degraded: degraded, Lost: lost}); err != nil {
+		log.Errorf("Invalid mavlink link timeouts. Reason: %s", err.Error())
+	}
+}
+
+// setInfluxDBMessages configures which mavlink messages are stored in InfluxDB,
+// storing every message if the configuration is invalid.
+func setInfluxDBMessages(mavlinkClient *mav.Client) {
+	messages := mav.InfluxDBMessages{
+		Include:   mav.SplitList(*ENVS["MAV_INFLUXDB_INCLUDE"]),
+		Exclude:   mav.SplitList(*ENVS["MAV_INFLUXDB_EXCLUDE"]),
+		EnumNames: *ENVS["MAV_INFLUXDB_ENUM_NAMES"] == "True",
+	}
+	if err := mavlinkClient.SetInfluxDBMessages(messages); err != nil {
+		log.Errorf("Invalid InfluxDB mavlink messages. Reason: %s", err.Error())
+	}
+}
+
+// setMessageRates configures the rates messages are requested from the plane at,
+// keeping the default rates if MAV_MESSAGE_RATES is empty or invalid.
+func setMessageRates(mavlinkClient *mav.Client) {
+	if *ENVS["MAV_MESSAGE_RATES"] == "" {
+		return
+	}
+	rates, err := mav.ParseMessageRates(*ENVS["MAV_MESSAGE_RATES"])
+	if err == nil {
+		_, err = mavlinkClient.SetMessageRates(rates)
+	}
+	if err != nil {
+		log.Errorf("Invalid mavlink message rates. Reason: %s", err.Error())
+	}
+}
+
+// setBatteryThresholds configures the cell voltages below which batteries are low or
+// critical, keeping the defaults if the thresholds are invalid.
+func setBatteryThresholds(mavlinkClient *mav.Client) {
+	low, err := strconv.ParseFloat(*ENVS["MAV_BATTERY_LOW"], 64)
+	if err != nil {
+		log.Errorf("Invalid low battery cell voltage. Reason: %s", err.Error())
+		return
+	}
+	critical, err := strconv.ParseFloat(*ENVS["MAV_BATTERY_CRITICAL"], 64)
+	if err != nil {
+		log.Errorf("Invalid critical battery cell voltage. Reason: %s", err.Error())
+		return
+	}
+	thresholds := mav.BatteryThresholds{LowCellVoltage: low, CriticalCellVoltage: critical}
+	if err := mavlinkClient.SetBatteryThresholds(thresholds); err != nil {
+		log.Errorf("Invalid battery thresholds. Reason: %s", err.Error())
+	}
+}
+
+// setBatteryConfigs configures the number of cells and the capacity of every battery,
+// leaving the batteries unconfigured if the configuration is invalid.
+func setBatteryConfigs(mavlinkClient *mav.Client) {
+	cells, err := mav.ParseBatteryValues(*ENVS["MAV_BATTERY_CELLS"])
+	if err != nil {
+		log.Errorf("Invalid battery cell counts. Reason: %s", err.Error())
+		return
+	}
+	capacities, err := mav.ParseBatteryValues(*ENVS["MAV_BATTERY_CAPACITY"])
+	if err != nil {
+		log.Errorf("Invalid battery capacities. Reason: %s", err.Error())
+		return
+	}
+	configs := make(map[uint8]mav.BatteryConfig, len(cells))
+	for id, count := range cells {
+		config := configs[id]
+		config.Cells = count
+		configs[id] = config
+	}
+	for id, capacity := range capacities {
+		config := configs[id]
+		config.CapacityMah = capacity
+		configs[id] = config
+	}
+	if err := mavlinkClient.SetBatteryConfigs(configs); err != nil {
+		log.Errorf("Invalid battery configuration. Reason: %s", err.Error())
+	}
+}
+
 func main() {
 	setupEverything()
 
@@ -96,6 +205,23 @@ func main() {
 		*ENVS["MAV_OUTPUT5"],
 	)
 
+	setLinkTimeouts(mavlinkClient)
+	setInfluxDBMessages(mavlinkClient)
+	setMessageRates(mavlinkClient)
+	setBatteryThresholds(mavlinkClient)
+	setBatteryConfigs(mavlinkClient)
+	mavlinkClient.SetTlogDir(*ENVS["MAV_TLOG_DIR"])
+	if maxTotal, err := strconv.ParseInt(*ENVS["MAV_TLOG_MAX_TOTAL_MB"], 10, 64); err == nil && maxTotal >= 0 {
+		mavlinkClient.SetTlogMaxTotalSize(maxTotal << 20)
+	} else {
+		log.Errorf("Invalid tlog total size %q. Keeping %d MB of tlogs", *ENVS["MAV_TLOG_MAX_TOTAL_MB"], mav.DefaultTlogMaxTotalSize>>20)
+	}
+	if *ENVS["MAV_TLOG_RECORD"] == "True" {
+		if _, err := mavlinkClient.StartTlog(); err != nil {
+			log.Errorf("Cannot start recording a tlog. Reason: %s", err.Error())
+		}
+	}
+
 	obcClient := obc.NewClient(*ENVS["OBC_ADDR"], 999)
 
 	go mavlinkClient.Listen()